@@ -0,0 +1,133 @@
+package tcmu
+
+import (
+	"encoding/binary"
+
+	"github.com/coreos/go-tcmu/scsi"
+)
+
+// ALUAState is the asymmetric access state of the device's target port group,
+// as reported by REPORT TARGET PORT GROUPS.
+type ALUAState byte
+
+const (
+	ALUAActiveOptimized    ALUAState = 0x0
+	ALUAActiveNonOptimized ALUAState = 0x1
+	ALUAStandby            ALUAState = 0x2
+	ALUAUnavailable        ALUAState = 0x3
+	ALUAOffline            ALUAState = 0xe
+	ALUATransitioning      ALUAState = 0xf
+)
+
+// aluaSupportedStates is the supported states byte of the target port group
+// descriptor: transitioning, offline, unavailable, standby, active/non-optimized
+// and active/optimized.
+const aluaSupportedStates = 0xcf
+
+// aluaRelativePort is the relative target port identifier of the only port in
+// the device's target port group.
+const aluaRelativePort = 1
+
+// notReady returns the ASC that TEST UNIT READY and medium access fail with in
+// state s, or false if they are allowed.
+func (s ALUAState) notReady() (uint16, bool) {
+	switch s {
+	case ALUAStandby:
+		return scsi.AscTargetPortStandby, true
+	case ALUAUnavailable:
+		return scsi.AscTargetPortUnavailable, true
+	case ALUAOffline:
+		return scsi.AscTargetPortOffline, true
+	case ALUATransitioning:
+		return scsi.AscTargetPortTransitioning, true
+	}
+	return 0, false
+}
+
+// AccessState returns the ALUA access state of the device's target port group.
+// It is active/optimized until changed by SetAccessState or SET TARGET PORT
+// GROUPS.
+func (d *Device) AccessState() ALUAState {
+	d.state.mu.RLock()
+	defer d.state.mu.RUnlock()
+	return d.state.alua
+}
+
+// SetAccessState changes the ALUA access state of the device's target port
+// group, as an implicit transition would, to emulate a path going to standby or
+// becoming unavailable. In states other than the active ones, TEST UNIT READY
+// and medium access fail with NOT READY.
+func (d *Device) SetAccessState(s ALUAState) {
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+	d.state.alua = s
+}
+
+// targetPortGroup returns the identifier of the device's target port group,
+// which is its TPGT.
+func (d *Device) targetPortGroup() uint16 {
+	return uint16(d.scsi.tpgt())
+}
+
+// EmulateReportTargetPortGroups responds to REPORT TARGET PORT GROUPS with the
+// device's single target port group, holding a single port, in its current
+// access state. Both the length only and the extended header formats are
+// supported.
+func EmulateReportTargetPortGroups(cmd *SCSICmd) (SCSIResponse, error) {
+	d := cmd.Device()
+	hdrLen := 4
+	ext := cmd.GetCDB(1)&0xe0 == scsi.MiExtHdrParamFmt
+	if ext {
+		hdrLen = 8
+	}
+	data := make([]byte, hdrLen+12)
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(data)-4))
+	if ext {
+		data[4] = 0x10 // format type: extended header
+	}
+	desc := data[hdrLen:]
+	desc[0] = byte(d.AccessState())
+	desc[1] = aluaSupportedStates
+	binary.BigEndian.PutUint16(desc[2:4], d.targetPortGroup())
+	desc[7] = 1 // target port count
+	binary.BigEndian.PutUint16(desc[10:12], aluaRelativePort)
+
+	outlen := int(binary.BigEndian.Uint32(cmd.cdb[6:10]))
+	if outlen < len(data) {
+		data = data[:outlen]
+	}
+	return cmd.Respond(data), nil
+}
+
+// EmulateSetTargetPortGroups handles SET TARGET PORT GROUPS, changing the access
+// state of the device's target port group to the one requested for it. Only the
+// active, standby and unavailable states may be requested.
+func EmulateSetTargetPortGroups(cmd *SCSICmd) (SCSIResponse, error) {
+	length := int(binary.BigEndian.Uint32(cmd.cdb[6:10]))
+	if length == 0 {
+		return cmd.Ok(), nil
+	}
+	// The length comes from the CDB; there can't be more than was sent.
+	if length < 4 || (length-4)%4 != 0 || length > cmd.dataLen() {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+	}
+	params := make([]byte, length)
+	if n, _ := cmd.Read(params); n < length {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+	}
+	d := cmd.Device()
+	state := d.AccessState()
+	for desc := params[4:]; len(desc) > 0; desc = desc[4:] {
+		if binary.BigEndian.Uint16(desc[2:4]) != d.targetPortGroup() {
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList), nil
+		}
+		switch s := ALUAState(desc[0] & 0x0f); s {
+		case ALUAActiveOptimized, ALUAActiveNonOptimized, ALUAStandby, ALUAUnavailable:
+			state = s
+		default:
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList), nil
+		}
+	}
+	d.SetAccessState(state)
+	return cmd.Ok(), nil
+}
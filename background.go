@@ -0,0 +1,130 @@
+package tcmu
+
+import (
+	"context"
+
+	"github.com/coreos/go-tcmu/scsi"
+	"github.com/prometheus/common/log"
+)
+
+// backgroundTask is an operation that can carry on after the command that
+// started it has completed, as asked for by the IMMED bit of FORMAT UNIT or
+// SYNCHRONIZE CACHE. Only one runs on a device at a time. While it does,
+// REQUEST SENSE reports its sense key and ASC along with a progress indication.
+type backgroundTask struct {
+	key byte
+	asc uint16
+
+	// progress is the fraction done, out of 65536.
+	progress uint16
+}
+
+// blocking reports whether the task makes the logical unit NOT READY, failing
+// TEST UNIT READY and medium access until it completes.
+func (t backgroundTask) blocking() bool {
+	return t.key == scsi.SenseNotReady
+}
+
+// beginTask marks a task reporting key and asc as in progress. If another task
+// is already running it returns false, along with that task.
+func (d *Device) beginTask(key byte, asc uint16) (backgroundTask, bool) {
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+	if d.state.task != nil {
+		return *d.state.task, false
+	}
+	d.state.task = &backgroundTask{key: key, asc: asc}
+	return *d.state.task, true
+}
+
+func (d *Device) setTaskProgress(progress uint16) {
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+	if d.state.task != nil {
+		d.state.task.progress = progress
+	}
+}
+
+func (d *Device) endTask() {
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+	d.state.task = nil
+}
+
+// setDeferredError records the sense data of a background task that failed
+// after its command completed.
+func (d *Device) setDeferredError(s Sense) {
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+	d.state.deferred = &s
+}
+
+// takeDeferredError returns and clears the pending deferred error, if any.
+func (d *Device) takeDeferredError() (Sense, bool) {
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+	s := d.state.deferred
+	d.state.deferred = nil
+	if s == nil {
+		return Sense{}, false
+	}
+	return *s, true
+}
+
+// taskState returns the background task in progress, if there is one.
+func (d *Device) taskState() (backgroundTask, bool) {
+	d.state.mu.RLock()
+	defer d.state.mu.RUnlock()
+	if d.state.task == nil {
+		return backgroundTask{}, false
+	}
+	return *d.state.task, true
+}
+
+// runTask runs fn as the device's background task, reporting key and asc while
+// it runs; fn reports how far along it is through progress, and should stop
+// early once ctx is done. With immed set, cmd completes straight away and fn
+// carries on in the background until it finishes or the device is closed. If it
+// fails, the MEDIUM ERROR is reported as a deferred error by the next TEST UNIT
+// READY or REQUEST SENSE. Otherwise cmd completes when fn does, with a MEDIUM
+// ERROR if it fails. name identifies the operation in the log.
+func runTask(cmd *SCSICmd, name string, key byte, asc uint16, immed bool, fn func(ctx context.Context, progress func(uint16)) error) (SCSIResponse, error) {
+	d := cmd.Device()
+	if t, ok := d.beginTask(key, asc); !ok {
+		return taskInProgress(cmd, t), nil
+	}
+	if immed {
+		d.background.Add(1)
+		go func() {
+			defer d.background.Done()
+			defer d.endTask()
+			// cmd's own context ends as it completes.
+			if err := fn(d.context(), d.setTaskProgress); err != nil {
+				log.Errorln(name+" failed: error:", err)
+				s := NewSense(scsi.SenseMediumError, scsi.AscReadError)
+				s.Deferred = true
+				d.setDeferredError(s)
+			}
+		}()
+		return cmd.Ok(), nil
+	}
+	defer d.endTask()
+	if err := fn(cmd.Context(), d.setTaskProgress); err != nil {
+		log.Errorln(name+" failed: error:", err)
+		return cmd.MediumError(), nil
+	}
+	return cmd.Ok(), nil
+}
+
+// taskInProgress is the NOT READY response to commands refused because of the
+// running task t. A task that doesn't block medium access only refuses another
+// task, reported as OPERATION IN PROGRESS.
+func taskInProgress(cmd *SCSICmd, t backgroundTask) SCSIResponse {
+	asc := t.asc
+	if !t.blocking() {
+		asc = scsi.AscNotReadyOperationInProgress
+	}
+	s := NewSense(scsi.SenseNotReady, asc)
+	s.Progress = &t.progress
+	return cmd.RespondSense(s)
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/coreos/go-tcmu"
 	"github.com/sirupsen/logrus"
@@ -15,13 +17,23 @@ func main() {
 		die("not enough arguments")
 	}
 	filename := os.Args[1]
+	readOnly := false
 	f, err := os.OpenFile(filename, os.O_RDWR, 0700)
+	if os.IsPermission(err) || errors.Is(err, syscall.EROFS) {
+		// Serve files we can't write, or on a read-only filesystem, as a
+		// write protected disk.
+		readOnly = true
+		f, err = os.Open(filename)
+	}
 	if err != nil {
 		die("couldn't open: %v", err)
 	}
 	defer f.Close()
 	fi, _ := f.Stat()
 	handler := tcmu.BasicSCSIHandler(f)
+	if readOnly {
+		handler = tcmu.BasicReadOnlyHandler(f)
+	}
 	handler.VolumeName = fi.Name()
 	handler.DataSizes.VolumeSize = fi.Size()
 	d, err := tcmu.OpenTCMUDevice("/dev/tcmufile", handler)
@@ -41,7 +53,13 @@ func main() {
 			close(mainClose)
 		}
 	}()
-	<-mainClose
+	select {
+	case <-mainClose:
+	case err := <-d.Err():
+		fmt.Printf("go-tcmu device stopped: %v\n", err)
+	case <-d.Done():
+		fmt.Println("go-tcmu device stopped")
+	}
 }
 
 func die(why string, args ...interface{}) {
@@ -2,8 +2,12 @@ package tcmu
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"io"
+	"math/bits"
+	"sort"
 
 	"github.com/coreos/go-tcmu/scsi"
 	"github.com/prometheus/common/log"
@@ -18,6 +22,27 @@ type SCSICmdHandler interface {
 type ReadWriterAtCmdHandler struct {
 	RW  ReadWriterAt
 	Inq *InquiryInfo
+
+	// vpd holds the pages added with RegisterVPD.
+	vpd map[byte]VPDPageFunc
+}
+
+// VPDPageFunc returns the contents of a VPD page for an INQUIRY, after the four
+// byte page header.
+type VPDPageFunc func(cmd *SCSICmd) []byte
+
+// RegisterVPD makes fn supply VPD page page, such as a vendor specific page
+// carrying product metadata. The page is added to the Supported VPD Pages list;
+// registering one of the built-in pages replaces it. Page 0x00 itself can't be
+// replaced. Pages must be registered before the handler is passed to DevReady.
+func (h *ReadWriterAtCmdHandler) RegisterVPD(page byte, fn VPDPageFunc) {
+	if page == 0x00 {
+		return
+	}
+	if h.vpd == nil {
+		h.vpd = make(map[byte]VPDPageFunc)
+	}
+	h.vpd[page] = fn
 }
 
 // InquiryInfo holds the general vendor information for the emulated SCSI Device. Fields used from this will be padded or trunacted to meet the spec.
@@ -25,6 +50,82 @@ type InquiryInfo struct {
 	VendorID   string
 	ProductID  string
 	ProductRev string
+	// SerialNumber is reported in the Unit Serial Number VPD page (0x80). If unset,
+	// GenerateSerial of the volume name is used.
+	SerialNumber string
+
+	// Block Limits (VPD page 0xB0) fields, in logical blocks. Zero values take
+	// defaults derived from the device's DataSizes and OptimalIOSize; see
+	// blockLimits. The
+	// granularity defaults to the physical block size. READs and WRITEs longer
+	// than MaxTransferLength are rejected by ReadWriterAtCmdHandler, bounding
+	// the buffer allocated for them.
+	OptimalTransferLengthGranularity uint16
+	MaxTransferLength                uint32
+	OptimalTransferLength            uint32
+	// MaxUnmapLBACount and MaxUnmapBlockDescriptorCount are zero unless the
+	// handler supports UNMAP.
+	MaxUnmapLBACount             uint32
+	MaxUnmapBlockDescriptorCount uint32
+
+	// RotationRate is reported in the Block Device Characteristics VPD page (0xB1).
+	// 1 means non-rotating (solid state) media, and is used if unset; other
+	// values are the nominal RPM of a spinning disk.
+	RotationRate uint16
+
+	// NoTaggedQueuing clears the CmdQue bit of the standard INQUIRY data, so
+	// initiators send one command at a time rather than queuing commands that
+	// may complete out of order. Backends that depend on ordering should set
+	// it, and serve the device with SingleThreadedDevReady.
+	NoTaggedQueuing bool
+
+	// Version is the VERSION field of the standard INQUIRY data, the SPC
+	// standard the device claims to conform to, such as VersionSPC3. If unset,
+	// SPC-3 is claimed, or SPC-4 if MaxUnmapLBACount is set, since thin
+	// provisioning is only described by SBC-3 and SPC-4.
+	Version byte
+}
+
+// VERSION field values of the standard INQUIRY data.
+const (
+	VersionSPC2 byte = 0x04
+	VersionSPC3 byte = 0x05
+	VersionSPC4 byte = 0x06
+)
+
+// version returns the VERSION to report for inq; see InquiryInfo.Version.
+func (inq *InquiryInfo) version() byte {
+	if inq.Version == 0 {
+		if inq.MaxUnmapLBACount != 0 {
+			return VersionSPC4
+		}
+		return VersionSPC3
+	}
+	if inq.Version < VersionSPC4 && inq.MaxUnmapLBACount != 0 {
+		log.Warnf("inquiry version 0x%02x predates SPC-4, but UNMAP is advertised", inq.Version)
+	}
+	return inq.Version
+}
+
+// defaultMaxTransferBytes is the largest single transfer advertised in the Block
+// Limits VPD page when InquiryInfo.MaxTransferLength is not set.
+const defaultMaxTransferBytes = 8 * 1024 * 1024
+
+// blockLimits returns the granularity, maximum and optimal transfer lengths to
+// advertise, filling in defaults for unset fields from the device's sizes and
+// its SCSIHandler.OptimalIOSize, in bytes.
+func (inq *InquiryInfo) blockLimits(sizes DataSizes, optimalIOSize int64) (gran uint16, max uint32, opt uint32) {
+	gran, max, opt = inq.OptimalTransferLengthGranularity, inq.MaxTransferLength, inq.OptimalTransferLength
+	if gran == 0 {
+		gran = uint16(sizes.physicalBlocks())
+	}
+	if max == 0 {
+		max = uint32(defaultMaxTransferBytes / sizes.BlockSize)
+	}
+	if opt == 0 {
+		opt = uint32(optimalIOSize / sizes.BlockSize)
+	}
+	return gran, max, opt
 }
 
 var defaultInquiry = InquiryInfo{
@@ -33,41 +134,326 @@ var defaultInquiry = InquiryInfo{
 	ProductRev: "0001",
 }
 
-func (h ReadWriterAtCmdHandler) HandleCommand(cmd *SCSICmd) (SCSIResponse, error) {
+// checkDeviceState fails commands the device can't accept in its current
+// state, such as while a UNIT ATTENTION is pending, against another I_T
+// nexus's reservation, or during a FORMAT UNIT. It returns false, with the
+// response, if cmd is refused.
+func checkDeviceState(cmd *SCSICmd) (SCSIResponse, bool) {
 	switch cmd.Command() {
-	case scsi.Inquiry:
-		if h.Inq == nil {
-			h.Inq = &defaultInquiry
-		}
-		return EmulateInquiry(cmd, h.Inq)
-	case scsi.TestUnitReady:
-		return EmulateTestUnitReady(cmd)
-	case scsi.ServiceActionIn16:
-		return EmulateServiceActionIn(cmd)
-	case scsi.ModeSense, scsi.ModeSense10:
-		return EmulateModeSense(cmd, false)
-	case scsi.ModeSelect, scsi.ModeSelect10:
-		return EmulateModeSelect(cmd, false)
-	case scsi.Read6, scsi.Read10, scsi.Read12, scsi.Read16:
-		return EmulateRead(cmd, h.RW)
-	case scsi.Write6, scsi.Write10, scsi.Write12, scsi.Write16:
-		return EmulateWrite(cmd, h.RW)
+	case scsi.Inquiry, scsi.ReportLuns, scsi.RequestSense:
 	default:
-		log.Debugf("Ignore unknown SCSI command 0x%x\n", cmd.Command())
+		if cmd.Device().takeUnitAttention() {
+			return cmd.CheckCondition(scsi.SenseUnitAttention, scsi.AscPowerOnReset), false
+		}
 	}
-	return cmd.NotHandled(), nil
+	if cmd.Device().reservationConflict(cmd) {
+		return cmd.RespondStatus(scsi.SamStatReservationConflict), false
+	}
+	if cmd.Device().readOnly() && isWriteCommand(cmd.Command()) {
+		return cmd.CheckCondition(scsi.SenseDataProtect, scsi.AscWriteProtected), false
+	}
+	if cmd.Device().scsi.StrictStartStop && cmd.Device().Stopped() && isMediumAccess(cmd.Command()) {
+		return cmd.CheckCondition(scsi.SenseNotReady, scsi.AscInitializingCommandRequired), false
+	}
+	if asc, ok := cmd.Device().AccessState().notReady(); ok &&
+		(cmd.Command() == scsi.TestUnitReady || isMediumAccess(cmd.Command())) {
+		return cmd.CheckCondition(scsi.SenseNotReady, asc), false
+	}
+	if t, ok := cmd.Device().taskState(); ok && t.blocking() &&
+		(cmd.Command() == scsi.TestUnitReady || isMediumAccess(cmd.Command())) {
+		return taskInProgress(cmd, t), false
+	}
+	return SCSIResponse{}, true
+}
+
+// checkTransferLength fails READs and WRITEs longer than the MAXIMUM TRANSFER
+// LENGTH advertised in the Block Limits VPD page, before a buffer is allocated
+// for them. It returns false along with the response if cmd is refused.
+func checkTransferLength(cmd *SCSICmd, inq *InquiryInfo) (SCSIResponse, bool) {
+	switch cmd.Command() {
+	case scsi.Read6, scsi.Read10, scsi.Read12, scsi.Read16,
+		scsi.Write6, scsi.Write10, scsi.Write12, scsi.Write16,
+		scsi.WriteVerify, scsi.WriteVerify12, scsi.WriteVerify16:
+	default:
+		return SCSIResponse{}, true
+	}
+	n, err := cmd.XferLenE()
+	if err != nil {
+		return cmd.IllegalRequest(), false
+	}
+	if _, max, _ := inq.blockLimits(cmd.Device().Sizes(), cmd.Device().scsi.OptimalIOSize); n > max {
+		log.Debugf("Transfer of %d blocks exceeds the maximum of %d", n, max)
+		return cmd.IllegalRequest(), false
+	}
+	return SCSIResponse{}, true
+}
+
+// HandleCommand emulates the commands in handledCommands, those the backend
+// supports at least; the rest are refused with INVALID COMMAND OPERATION CODE.
+// Other commands, and service actions that aren't emulated, are left to the
+// kernel with NotHandled.
+func (h ReadWriterAtCmdHandler) HandleCommand(cmd *SCSICmd) (SCSIResponse, error) {
+	if h.Inq == nil {
+		h.Inq = &defaultInquiry
+	}
+	if resp, ok := checkDeviceState(cmd); !ok {
+		return resp, nil
+	}
+	if resp, ok := checkTransferLength(cmd, h.Inq); !ok {
+		return resp, nil
+	}
+	c := findCommand(cmd.Command(), cmd.ServiceAction())
+	if c == nil {
+		log.Debugf("Ignore unknown SCSI command %s\n", scsi.CommandName(cmd.Command(), cmd.ServiceAction()))
+		return cmd.NotHandled(), nil
+	}
+	if !c.supported(h) {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidCommandOperationCode), nil
+	}
+	return c.emulate(h, cmd)
+}
+
+// handledCommand is an entry of the table ReadWriterAtCmdHandler dispatches
+// commands with, and reports them from in REPORT SUPPORTED OPERATION CODES.
+type handledCommand struct {
+	op     byte
+	sa     uint16
+	hasSA  bool
+	cdbLen int
+	// available, if set, reports whether the handler's backend supports the
+	// command, such as by implementing an optional interface.
+	available func(h ReadWriterAtCmdHandler) bool
+	emulate   func(h ReadWriterAtCmdHandler, cmd *SCSICmd) (SCSIResponse, error)
+}
+
+func (c *handledCommand) supported(h ReadWriterAtCmdHandler) bool {
+	return c.available == nil || c.available(h)
+}
+
+// handledCommands lists the commands ReadWriterAtCmdHandler emulates, in opcode
+// order. It is set in init, as REPORT SUPPORTED OPERATION CODES refers to it.
+var handledCommands []handledCommand
+
+func init() {
+	handledCommands = []handledCommand{
+		{op: scsi.TestUnitReady, cdbLen: 6, emulate: cmdOnly(EmulateTestUnitReady)},
+		{op: scsi.RequestSense, cdbLen: 6, emulate: cmdOnly(EmulateRequestSense)},
+		{op: scsi.FormatUnit, cdbLen: 6, emulate: ReadWriterAtCmdHandler.formatUnit},
+		{op: scsi.ReadBlockLimits, cdbLen: 6, emulate: cmdOnly(EmulateReadBlockLimits)},
+		{op: scsi.Read6, cdbLen: 6, emulate: ReadWriterAtCmdHandler.read},
+		{op: scsi.Write6, cdbLen: 6, emulate: ReadWriterAtCmdHandler.write},
+		{op: scsi.Inquiry, cdbLen: 6, emulate: ReadWriterAtCmdHandler.inquiry},
+		{op: scsi.ModeSelect, cdbLen: 6, emulate: ReadWriterAtCmdHandler.modeSelect},
+		{op: scsi.ModeSense, cdbLen: 6, emulate: ReadWriterAtCmdHandler.modeSense},
+		{op: scsi.StartStop, cdbLen: 6, emulate: cmdOnly(EmulateStartStop)},
+		{op: scsi.ReceiveDiagnostic, cdbLen: 6, emulate: cmdOnly(EmulateReceiveDiagnostic)},
+		{op: scsi.SendDiagnostic, cdbLen: 6, emulate: cmdOnly(EmulateSendDiagnostic)},
+		{op: scsi.AllowMediumRemoval, cdbLen: 6, emulate: cmdOnly(EmulatePreventAllowMediumRemoval)},
+		{op: scsi.ReadCapacity, cdbLen: 10, emulate: cmdOnly(EmulateReadCapacity10)},
+		{op: scsi.Read10, cdbLen: 10, emulate: ReadWriterAtCmdHandler.read},
+		{op: scsi.Write10, cdbLen: 10, emulate: ReadWriterAtCmdHandler.write},
+		{op: scsi.WriteVerify, cdbLen: 10, emulate: ReadWriterAtCmdHandler.writeVerify},
+		{op: scsi.Verify, cdbLen: 10, emulate: ReadWriterAtCmdHandler.verify},
+		{op: scsi.PreFetch, cdbLen: 10, emulate: ReadWriterAtCmdHandler.preFetch},
+		{op: scsi.SynchronizeCache, cdbLen: 10, emulate: ReadWriterAtCmdHandler.synchronizeCache},
+		{op: scsi.ReadDefectData, cdbLen: 10, emulate: cmdOnly(EmulateReadDefectData)},
+		{op: scsi.LogSense, cdbLen: 10, emulate: cmdOnly(EmulateLogSense)},
+		{op: scsi.ModeSelect10, cdbLen: 10, emulate: ReadWriterAtCmdHandler.modeSelect},
+		{op: scsi.ModeSense10, cdbLen: 10, emulate: ReadWriterAtCmdHandler.modeSense},
+		{op: scsi.PersistentReserveIn, sa: scsi.PriReadKeys, hasSA: true, cdbLen: 10, emulate: cmdOnly(EmulatePersistentReserveIn)},
+		{op: scsi.PersistentReserveIn, sa: scsi.PriReadReservation, hasSA: true, cdbLen: 10, emulate: cmdOnly(EmulatePersistentReserveIn)},
+		{op: scsi.PersistentReserveOut, sa: scsi.ProRegister, hasSA: true, cdbLen: 10, emulate: cmdOnly(EmulatePersistentReserveOut)},
+		{op: scsi.PersistentReserveOut, sa: scsi.ProReserve, hasSA: true, cdbLen: 10, emulate: cmdOnly(EmulatePersistentReserveOut)},
+		{op: scsi.PersistentReserveOut, sa: scsi.ProRelease, hasSA: true, cdbLen: 10, emulate: cmdOnly(EmulatePersistentReserveOut)},
+		{op: scsi.PersistentReserveOut, sa: scsi.ProClear, hasSA: true, cdbLen: 10, emulate: cmdOnly(EmulatePersistentReserveOut)},
+		{op: scsi.PersistentReserveOut, sa: scsi.ProPreempt, hasSA: true, cdbLen: 10, emulate: cmdOnly(EmulatePersistentReserveOut)},
+		{op: scsi.PersistentReserveOut, sa: scsi.ProPreemptAndAbort, hasSA: true, cdbLen: 10, emulate: cmdOnly(EmulatePersistentReserveOut)},
+		{op: scsi.PersistentReserveOut, sa: scsi.ProRegisterAndIgnoreExistingKey, hasSA: true, cdbLen: 10, emulate: cmdOnly(EmulatePersistentReserveOut)},
+		{op: scsi.AtaPassThrough16, cdbLen: 16, available: ReadWriterAtCmdHandler.satHandler, emulate: ReadWriterAtCmdHandler.ataPassThrough},
+		{op: scsi.Read16, cdbLen: 16, emulate: ReadWriterAtCmdHandler.read},
+		{op: scsi.CompareAndWrite, cdbLen: 16, emulate: ReadWriterAtCmdHandler.compareAndWrite},
+		{op: scsi.Write16, cdbLen: 16, emulate: ReadWriterAtCmdHandler.write},
+		{op: scsi.WriteVerify16, cdbLen: 16, emulate: ReadWriterAtCmdHandler.writeVerify},
+		{op: scsi.Verify16, cdbLen: 16, emulate: ReadWriterAtCmdHandler.verify},
+		{op: scsi.PreFetch16, cdbLen: 16, emulate: ReadWriterAtCmdHandler.preFetch},
+		{op: scsi.SynchronizeCache16, cdbLen: 16, emulate: ReadWriterAtCmdHandler.synchronizeCache},
+		{op: scsi.ServiceActionIn16, sa: scsi.SaiReadCapacity16, hasSA: true, cdbLen: 16, emulate: cmdOnly(EmulateReadCapacity16)},
+		{op: scsi.ServiceActionIn16, sa: scsi.SaiGetLbaStatus, hasSA: true, cdbLen: 16, emulate: ReadWriterAtCmdHandler.getLbaStatus},
+		{op: scsi.ReportLuns, cdbLen: 12, emulate: cmdOnly(EmulateReportLuns)},
+		{op: scsi.AtaPassThrough12, cdbLen: 12, available: ReadWriterAtCmdHandler.satHandler, emulate: ReadWriterAtCmdHandler.ataPassThrough},
+		{op: scsi.MaintenanceIn, sa: scsi.MiReportTargetPgs, hasSA: true, cdbLen: 12, emulate: cmdOnly(EmulateReportTargetPortGroups)},
+		{op: scsi.MaintenanceIn, sa: scsi.MiReportSupportedOperationCodes, hasSA: true, cdbLen: 12, emulate: ReadWriterAtCmdHandler.reportSupportedOpcodes},
+		{op: scsi.MaintenanceOut, sa: scsi.MoSetTargetPgs, hasSA: true, cdbLen: 12, emulate: cmdOnly(EmulateSetTargetPortGroups)},
+		{op: scsi.Read12, cdbLen: 12, emulate: ReadWriterAtCmdHandler.read},
+		{op: scsi.Write12, cdbLen: 12, emulate: ReadWriterAtCmdHandler.write},
+		{op: scsi.WriteVerify12, cdbLen: 12, emulate: ReadWriterAtCmdHandler.writeVerify},
+		{op: scsi.Verify12, cdbLen: 12, emulate: ReadWriterAtCmdHandler.verify},
+		{op: scsi.ReadDefectData12, cdbLen: 12, emulate: cmdOnly(EmulateReadDefectData)},
+	}
+}
+
+// findCommand returns the handledCommands entry for the opcode and, for
+// commands with service actions, service action sa, or nil if there is none.
+func findCommand(op byte, sa uint16) *handledCommand {
+	for i, c := range handledCommands {
+		if c.op == op && (!c.hasSA || c.sa == sa) {
+			return &handledCommands[i]
+		}
+	}
+	return nil
+}
+
+// cmdOnly adapts an Emulate function that needs nothing from the handler for
+// handledCommands.
+func cmdOnly(fn func(cmd *SCSICmd) (SCSIResponse, error)) func(ReadWriterAtCmdHandler, *SCSICmd) (SCSIResponse, error) {
+	return func(_ ReadWriterAtCmdHandler, cmd *SCSICmd) (SCSIResponse, error) {
+		return fn(cmd)
+	}
+}
+
+func (h ReadWriterAtCmdHandler) inquiry(cmd *SCSICmd) (SCSIResponse, error) {
+	return emulateInquiry(cmd, h.Inq, h.vpd)
+}
+
+func (h ReadWriterAtCmdHandler) modeSense(cmd *SCSICmd) (SCSIResponse, error) {
+	return EmulateModeSense(cmd, cmd.Device().WriteCacheEnabled())
+}
+
+func (h ReadWriterAtCmdHandler) modeSelect(cmd *SCSICmd) (SCSIResponse, error) {
+	wce := cmd.Device().WriteCacheEnabled()
+	resp, err := EmulateModeSelect(cmd, wce)
+	if err == nil && resp.status == scsi.SamStatGood && wce && !cmd.Device().WriteCacheEnabled() {
+		// Write back whatever the cache holds now that it's disabled.
+		if err := flushBackend(h.RW); err != nil {
+			log.Errorln("mode select/flush failed: error:", err)
+			return cmd.MediumError(), nil
+		}
+	}
+	return resp, err
+}
+
+func (h ReadWriterAtCmdHandler) read(cmd *SCSICmd) (SCSIResponse, error) {
+	return EmulateRead(cmd, h.RW)
+}
+
+func (h ReadWriterAtCmdHandler) write(cmd *SCSICmd) (SCSIResponse, error) {
+	return EmulateWrite(cmd, h.RW)
+}
+
+func (h ReadWriterAtCmdHandler) compareAndWrite(cmd *SCSICmd) (SCSIResponse, error) {
+	return EmulateCompareAndWrite(cmd, h.RW)
+}
+
+func (h ReadWriterAtCmdHandler) writeVerify(cmd *SCSICmd) (SCSIResponse, error) {
+	return EmulateWriteVerify(cmd, h.RW)
+}
+
+func (h ReadWriterAtCmdHandler) verify(cmd *SCSICmd) (SCSIResponse, error) {
+	return EmulateVerify(cmd, h.RW)
+}
+
+func (h ReadWriterAtCmdHandler) synchronizeCache(cmd *SCSICmd) (SCSIResponse, error) {
+	return EmulateSynchronizeCache(cmd, h.RW)
+}
+
+func (h ReadWriterAtCmdHandler) formatUnit(cmd *SCSICmd) (SCSIResponse, error) {
+	return EmulateFormatUnit(cmd, h.RW)
+}
+
+func (h ReadWriterAtCmdHandler) preFetch(cmd *SCSICmd) (SCSIResponse, error) {
+	return EmulatePreFetch(cmd, h.RW)
+}
+
+func (h ReadWriterAtCmdHandler) getLbaStatus(cmd *SCSICmd) (SCSIResponse, error) {
+	t, _ := h.RW.(LBAStatusReporter)
+	return EmulateGetLbaStatus(cmd, t)
+}
+
+func (h ReadWriterAtCmdHandler) satHandler() bool {
+	_, ok := h.RW.(SatHandler)
+	return ok
+}
+
+func (h ReadWriterAtCmdHandler) ataPassThrough(cmd *SCSICmd) (SCSIResponse, error) {
+	return EmulateAtaPassThrough(cmd, h.RW)
+}
+
+// isWriteCommand reports whether the opcode modifies the medium, and so must be
+// rejected on a read-only device.
+func isWriteCommand(op byte) bool {
+	switch op {
+	case scsi.Write6, scsi.Write10, scsi.Write12, scsi.Write16,
+		scsi.WriteVerify, scsi.WriteVerify12, scsi.WriteVerify16,
+		scsi.WriteSame, scsi.WriteSame16, scsi.Unmap, scsi.CompareAndWrite,
+		scsi.FormatUnit:
+		return true
+	}
+	return false
+}
+
+// isMediumAccess reports whether the opcode reads or writes the medium, and so
+// requires the logical unit to be started.
+func isMediumAccess(op byte) bool {
+	switch op {
+	case scsi.Read6, scsi.Read10, scsi.Read12, scsi.Read16,
+		scsi.Verify, scsi.Verify12, scsi.Verify16:
+		return true
+	}
+	return isWriteCommand(op)
 }
 
 func EmulateInquiry(cmd *SCSICmd, inq *InquiryInfo) (SCSIResponse, error) {
+	return emulateInquiry(cmd, inq, nil)
+}
+
+func emulateInquiry(cmd *SCSICmd, inq *InquiryInfo, vpd map[byte]VPDPageFunc) (SCSIResponse, error) {
 	if (cmd.GetCDB(1) & 0x01) == 0 {
 		if cmd.GetCDB(2) == 0x00 {
 			return EmulateStdInquiry(cmd, inq)
 		}
 		return cmd.IllegalRequest(), nil
 	}
+	if fn, ok := vpd[cmd.GetCDB(2)]; ok {
+		return emulateRegisteredVPD(cmd, fn)
+	}
+	if cmd.GetCDB(2) == 0x00 && len(vpd) > 0 {
+		return emulateSupportedVPDPages(cmd, vpd)
+	}
 	return EmulateEvpdInquiry(cmd, inq)
 }
 
+// emulateRegisteredVPD responds with a page added by RegisterVPD.
+func emulateRegisteredVPD(cmd *SCSICmd, fn VPDPageFunc) (SCSIResponse, error) {
+	page := fn(cmd)
+	data := make([]byte, 4, 4+len(page))
+	data[1] = cmd.GetCDB(2)
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(page)))
+	data = append(data, page...)
+	if outlen := int(binary.BigEndian.Uint16(cmd.cdb[3:5])); outlen < len(data) {
+		data = data[:outlen]
+	}
+	return cmd.Respond(data), nil
+}
+
+// emulateSupportedVPDPages responds with the Supported VPD Pages page, including
+// the pages added by RegisterVPD.
+func emulateSupportedVPDPages(cmd *SCSICmd, vpd map[byte]VPDPageFunc) (SCSIResponse, error) {
+	pages := append([]byte(nil), supportedVPDPages...)
+	for p := range vpd {
+		if bytes.IndexByte(pages, p) < 0 {
+			pages = append(pages, p)
+		}
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i] < pages[j] })
+	data := make([]byte, 4+len(pages))
+	data[3] = byte(len(pages))
+	copy(data[4:], pages)
+	if outlen := int(binary.BigEndian.Uint16(cmd.cdb[3:5])); outlen < len(data) {
+		data = data[:outlen]
+	}
+	return cmd.Respond(data), nil
+}
+
 func FixedString(s string, length int) []byte {
 	p := []byte(s)
 	l := len(p)
@@ -80,9 +466,12 @@ func FixedString(s string, length int) []byte {
 
 func EmulateStdInquiry(cmd *SCSICmd, inq *InquiryInfo) (SCSIResponse, error) {
 	buf := make([]byte, 36)
-	buf[2] = 0x05 // SPC-3
-	buf[3] = 0x02 // response data format
-	buf[7] = 0x02 // CmdQue
+	buf[2] = inq.version()
+	buf[3] = 0x02 // response data format, the only one defined since SPC-2
+	buf[5] = 0x30 // TPGS: implicit and explicit ALUA
+	if !inq.NoTaggedQueuing {
+		buf[7] = 0x02 // CmdQue
+	}
 	vendorID := FixedString(inq.VendorID, 8)
 	copy(buf[8:16], vendorID)
 	productID := FixedString(inq.ProductID, 16)
@@ -91,78 +480,86 @@ func EmulateStdInquiry(cmd *SCSICmd, inq *InquiryInfo) (SCSIResponse, error) {
 	copy(buf[32:36], productRev)
 
 	buf[4] = 31 // Set additional length to 31
-	_, err := cmd.Write(buf)
-	if err != nil {
-		return SCSIResponse{}, err
-	}
-	return cmd.Ok(), nil
+	return cmd.Respond(buf), nil
 }
 
+// supportedVPDPages is the list of VPD pages returned for page 0x00, in ascending order.
+var supportedVPDPages = []byte{0x00, 0x80, 0x83, 0xb0, 0xb1}
+
+// serialNumberLength is the fixed, space-padded length of the unit serial number.
+const serialNumberLength = 32
+
 func EmulateEvpdInquiry(cmd *SCSICmd, inq *InquiryInfo) (SCSIResponse, error) {
 	vpdType := cmd.GetCDB(2)
 	log.Debugf("SCSI EVPD Inquiry 0x%x\n", vpdType)
 	switch vpdType {
 	case 0x0: // Supported VPD pages
-		// The absolute minimum.
-		data := make([]byte, 6)
+		data := make([]byte, 4+len(supportedVPDPages))
+		data[3] = byte(len(supportedVPDPages))
+		copy(data[4:], supportedVPDPages)
 
-		// We support 0x00 and 0x83 only
-		data[3] = 2
-		data[4] = 0x00
-		data[5] = 0x83
+		return cmd.Respond(data), nil
+	case 0x80: // Unit serial number
+		serial := inq.SerialNumber
+		if serial == "" {
+			serial = GenerateSerial(cmd.Device().scsi.VolumeName)
+		}
+		data := make([]byte, 4+serialNumberLength)
+		data[1] = 0x80
+		data[3] = serialNumberLength
+		copy(data[4:], FixedString(serial, serialNumberLength))
 
-		cmd.Write(data)
-		return cmd.Ok(), nil
+		return cmd.Respond(data), nil
 	case 0x83: // Device identification
 		used := 4
 		data := make([]byte, 512)
 		data[1] = 0x83
-		wwn := []byte("") // TODO(barakmich): Report WWN. See tcmu_get_wwn;
+		wwn := cmd.Device().scsi.WWN
 
-		// 1/3: T10 Vendor id
+		// 1/4: T10 Vendor id
 		ptr := data[used:]
 		ptr[0] = 2 // code set: ASCII
 		ptr[1] = 1 // identifier: T10 vendor id
 		copy(ptr[4:], FixedString(inq.VendorID, 8))
-		n := copy(ptr[12:], wwn)
+		n := copy(ptr[12:], []byte(wwn.DeviceID()))
 		ptr[3] = byte(8 + n + 1)
 		used += int(ptr[3]) + 4
 
-		// 2/3: NAA binary // TODO(barakmich): Emulate given a real WWN
-
-		ptr = data[used:]
-		ptr[0] = 1  // code set: binary
-		ptr[1] = 3  // identifier: NAA
-		ptr[3] = 16 // body length for naa registered extended format
-
-		// Set type 6 and use OpenFabrics IEEE Company ID: 00 14 05
-		ptr[4] = 0x60
-		ptr[5] = 0x01
-		ptr[6] = 0x40
-		ptr[7] = 0x50
-		next := true
-		i := 7
-		for _, x := range wwn {
-			if i >= 20 {
-				break
-			}
-			v, ok := charToHex(x)
-			if !ok {
-				continue
-			}
+		// 2/4: NAA or EUI-64 binary
+		var bin []byte
+		var idType byte
+		switch w := wwn.(type) {
+		case NaaWWN:
+			bin, idType = w.Binary(), 3 // identifier: NAA
+		case EUI64WWN:
+			bin, idType = w.Binary(), 2 // identifier: EUI-64
+		}
+		if bin != nil {
+			ptr = data[used:]
+			ptr[0] = 1 // code set: binary
+			ptr[1] = idType
+			ptr[3] = byte(len(bin))
+			copy(ptr[4:], bin)
+			used += len(bin) + 4
+		}
 
-			if next {
-				next = false
-				ptr[i] |= v
-				i++
-			} else {
-				next = true
-				ptr[i] = (v << 4)
-			}
+		// 3/4: Relative target port and target port group, for ALUA
+		for _, d := range []struct {
+			idType byte
+			id     uint16
+		}{
+			{4, aluaRelativePort},
+			{5, cmd.Device().targetPortGroup()},
+		} {
+			ptr = data[used:]
+			ptr[0] = 1               // code set: binary
+			ptr[1] = 0x10 | d.idType // association: target port
+			ptr[3] = 4
+			binary.BigEndian.PutUint16(ptr[6:8], d.id)
+			used += 8
 		}
-		used += 20
 
-		// 3/3: Vendor specific
+		// 4/4: Vendor specific
 		ptr = data[used:]
 		ptr[0] = 2 // code set: ASCII
 		ptr[1] = 0 // identifier: vendor-specific
@@ -176,14 +573,43 @@ func EmulateEvpdInquiry(cmd *SCSICmd, inq *InquiryInfo) (SCSIResponse, error) {
 		order := binary.BigEndian
 		order.PutUint16(data[2:4], uint16(used-4))
 
-		cmd.Write(data[:used])
-		return cmd.Ok(), nil
+		return cmd.Respond(data[:used]), nil
+	case 0xb0: // Block Limits
+		data := make([]byte, 64)
+		data[1] = 0xb0
+		order := binary.BigEndian
+		order.PutUint16(data[2:4], uint16(len(data)-4))
+		data[5] = maxCompareAndWriteBlocks
+		gran, max, opt := inq.blockLimits(cmd.Device().Sizes(), cmd.Device().scsi.OptimalIOSize)
+		order.PutUint16(data[6:8], gran)
+		order.PutUint32(data[8:12], max)
+		order.PutUint32(data[12:16], opt)
+		order.PutUint32(data[20:24], inq.MaxUnmapLBACount)
+		order.PutUint32(data[24:28], inq.MaxUnmapBlockDescriptorCount)
+
+		return cmd.Respond(data), nil
+	case 0xb1: // Block Device Characteristics
+		data := make([]byte, 64)
+		data[1] = 0xb1
+		order := binary.BigEndian
+		order.PutUint16(data[2:4], uint16(len(data)-4))
+		rate := inq.RotationRate
+		if rate == 0 {
+			rate = 1
+		}
+		order.PutUint16(data[4:6], rate)
+		// Product type and nominal form factor are left as "not indicated".
+
+		return cmd.Respond(data), nil
 	default:
 		return cmd.IllegalRequest(), nil
 	}
 }
 
 func EmulateTestUnitReady(cmd *SCSICmd) (SCSIResponse, error) {
+	if s, ok := cmd.Device().takeDeferredError(); ok {
+		return cmd.RespondSense(s), nil
+	}
 	return cmd.Ok(), nil
 }
 
@@ -194,29 +620,427 @@ func EmulateServiceActionIn(cmd *SCSICmd) (SCSIResponse, error) {
 	return cmd.NotHandled(), nil
 }
 
+// EmulateReadBlockLimits responds to READ BLOCK LIMITS, a sequential access
+// command some device probes send regardless of the device type, with the
+// logical block size as both the maximum and minimum block length. The MLOC
+// variant, which reports the maximum logical object identifier, isn't
+// supported.
+func EmulateReadBlockLimits(cmd *SCSICmd) (SCSIResponse, error) {
+	if cmd.GetCDB(1)&0x01 != 0 {
+		return cmd.IllegalRequest(), nil
+	}
+	blockSize := cmd.Device().Sizes().BlockSize
+	buf := make([]byte, 6)
+	// buf[0] is the granularity, 0 as any block length in the range will do.
+	buf[1] = byte(blockSize >> 16)
+	binary.BigEndian.PutUint16(buf[2:4], uint16(blockSize))
+	binary.BigEndian.PutUint16(buf[4:6], uint16(blockSize))
+	return cmd.Respond(buf), nil
+}
+
+// EmulateReadCapacity10 responds to the 10-byte READ CAPACITY. Devices with more
+// LBAs than fit in 32 bits report 0xFFFFFFFF, telling the initiator to use READ
+// CAPACITY (16) instead.
+func EmulateReadCapacity10(cmd *SCSICmd) (SCSIResponse, error) {
+	sizes := cmd.Device().Sizes()
+	if err := sizes.Validate(); err != nil {
+		log.Errorln("read capacity failed: error:", err)
+		return cmd.TargetFailure(), nil
+	}
+	buf := make([]byte, 8)
+	order := binary.BigEndian
+	// As in READ CAPACITY (16), this is the index of the last LBA.
+	lastLBA := uint64(sizes.VolumeSize/sizes.BlockSize) - 1
+	if lastLBA > 0xffffffff {
+		lastLBA = 0xffffffff
+	}
+	order.PutUint32(buf[0:4], uint32(lastLBA))
+	order.PutUint32(buf[4:8], uint32(sizes.BlockSize))
+	cmd.Write(buf)
+	return cmd.Ok(), nil
+}
+
 func EmulateReadCapacity16(cmd *SCSICmd) (SCSIResponse, error) {
+	sizes := cmd.Device().Sizes()
+	if err := sizes.Validate(); err != nil {
+		log.Errorln("read capacity failed: error:", err)
+		return cmd.TargetFailure(), nil
+	}
 	buf := make([]byte, 32)
 	order := binary.BigEndian
 	// This is in LBAs, and the "index of the last LBA", so minus 1. Friggin spec.
-	order.PutUint64(buf[0:8], uint64(cmd.Device().Sizes().VolumeSize/cmd.Device().Sizes().BlockSize)-1)
+	order.PutUint64(buf[0:8], uint64(sizes.VolumeSize/sizes.BlockSize)-1)
 	// This is in BlockSize
-	order.PutUint32(buf[8:12], uint32(cmd.Device().Sizes().BlockSize))
+	order.PutUint32(buf[8:12], uint32(sizes.BlockSize))
+	// Logical blocks per physical block exponent, and the lowest aligned LBA.
+	buf[13] = sizes.PhysicalBlockExponent & 0x0f
+	order.PutUint16(buf[14:16], sizes.LowestAlignedLBA)
 	// All the rest is 0
 	cmd.Write(buf)
 	return cmd.Ok(), nil
 }
 
-func charToHex(c byte) (byte, bool) {
-	if c >= '0' && c <= '9' {
-		return c - '0', true
+// EmulateMaintenanceIn dispatches the MAINTENANCE IN service actions.
+func EmulateMaintenanceIn(cmd *SCSICmd) (SCSIResponse, error) {
+	switch cmd.ServiceAction() {
+	case scsi.MiReportTargetPgs:
+		return EmulateReportTargetPortGroups(cmd)
+	case scsi.MiReportSupportedOperationCodes:
+		return EmulateReportSupportedOpcodes(cmd)
 	}
-	if c >= 'a' && c <= 'f' {
-		return c - 'a' + 10, true
+	return cmd.NotHandled(), nil
+}
+
+// EmulateMaintenanceOut dispatches the MAINTENANCE OUT service actions.
+func EmulateMaintenanceOut(cmd *SCSICmd) (SCSIResponse, error) {
+	switch cmd.ServiceAction() {
+	case scsi.MoSetTargetPgs:
+		return EmulateSetTargetPortGroups(cmd)
 	}
-	if c >= 'A' && c <= 'F' {
-		return c - 'A' + 10, true
+	return cmd.NotHandled(), nil
+}
+
+// EmulateReportSupportedOpcodes responds to REPORT SUPPORTED OPERATION CODES, in
+// either the all-commands format or the one-command format, from the commands
+// ReadWriterAtCmdHandler emulates for the device's SCSIHandler.Backend.
+func EmulateReportSupportedOpcodes(cmd *SCSICmd) (SCSIResponse, error) {
+	var h ReadWriterAtCmdHandler
+	if rw, ok := cmd.Device().scsi.Backend.(ReadWriterAt); ok {
+		h.RW = rw
+	}
+	return h.reportSupportedOpcodes(cmd)
+}
+
+func (h ReadWriterAtCmdHandler) reportSupportedOpcodes(cmd *SCSICmd) (SCSIResponse, error) {
+	order := binary.BigEndian
+	options := cmd.GetCDB(2) & 0x07
+	var data []byte
+	switch options {
+	case 0x0: // All commands
+		data = make([]byte, 4)
+		for i := range handledCommands {
+			c := &handledCommands[i]
+			if !c.supported(h) {
+				continue
+			}
+			desc := make([]byte, 8)
+			desc[0] = c.op
+			order.PutUint16(desc[2:4], c.sa)
+			if c.hasSA {
+				desc[5] = 0x01 // SERVACTV
+			}
+			order.PutUint16(desc[6:8], uint16(c.cdbLen))
+			data = append(data, desc...)
+		}
+		order.PutUint32(data[0:4], uint32(len(data)-4))
+	case 0x1, 0x2, 0x3: // One command
+		op := cmd.GetCDB(3)
+		sa := uint16(cmd.GetCDB(4))<<8 | uint16(cmd.GetCDB(5))
+		var found *handledCommand
+		for i, c := range handledCommands {
+			if c.op != op {
+				continue
+			}
+			if (c.hasSA && options == 0x1) || (!c.hasSA && options == 0x2) {
+				return cmd.IllegalRequest(), nil
+			}
+			if !c.hasSA || c.sa == sa {
+				found = &handledCommands[i]
+				break
+			}
+		}
+		if found == nil || !found.supported(h) {
+			data = make([]byte, 4)
+			data[1] = 0x01 // SUPPORT: not supported
+			break
+		}
+		data = make([]byte, 4+found.cdbLen)
+		data[1] = 0x03 // SUPPORT: supported, conforming to the standard
+		order.PutUint16(data[2:4], uint16(found.cdbLen))
+		// CDB usage data: we may look at any bit of the CDB.
+		data[4] = found.op
+		for i := 5; i < len(data); i++ {
+			data[i] = 0xff
+		}
+	default:
+		return cmd.IllegalRequest(), nil
+	}
+	xlen, err := cmd.XferLenE()
+	if err != nil {
+		return cmd.IllegalRequest(), nil
+	}
+	outlen := int(xlen)
+	if outlen < len(data) {
+		data = data[:outlen]
+	}
+	return cmd.Respond(data), nil
+}
+
+// EmulateStartStop handles START STOP UNIT, tracking whether the logical unit is
+// started. A POWER CONDITION of ACTIVE starts the unit; other power conditions are
+// accepted but don't change the state. With LOEJ set, stopping the unit also ejects
+// the medium and starting it loads it, unless removal is prevented by PREVENT
+// ALLOW MEDIUM REMOVAL. The change is immediate, so the IMMED bit makes no
+// difference.
+func EmulateStartStop(cmd *SCSICmd) (SCSIResponse, error) {
+	pc := cmd.GetCDB(4) >> 4
+	loej := cmd.GetCDB(4)&0x02 != 0
+	start := cmd.GetCDB(4)&0x01 != 0
+	switch pc {
+	case 0x0: // START_VALID
+		if !cmd.Device().startStop(start, loej) {
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscMediumRemovalPrevented), nil
+		}
+	case 0x1: // ACTIVE
+		cmd.Device().startStop(true, false)
+	}
+	return cmd.Ok(), nil
+}
+
+// EmulatePreventAllowMediumRemoval handles PREVENT ALLOW MEDIUM REMOVAL,
+// recording whether the medium is locked in; see Device.MediumLocked. Only the
+// PREVENT values of 0 (allow) and 1 (prevent) are supported, as for a direct
+// access device; the medium changer values are rejected.
+func EmulatePreventAllowMediumRemoval(cmd *SCSICmd) (SCSIResponse, error) {
+	switch cmd.GetCDB(4) & 0x03 {
+	case 0x0:
+		cmd.Device().setMediumLocked(false)
+	case 0x1:
+		cmd.Device().setMediumLocked(true)
+	default:
+		return cmd.IllegalRequest(), nil
+	}
+	return cmd.Ok(), nil
+}
+
+// LBAStatusReporter is an optional interface for thin-provisioned backends, to
+// report which parts of the device are allocated. StatusAt returns whether the
+// byte offset off is mapped, and the length in bytes of the run of the same
+// status starting there.
+type LBAStatusReporter interface {
+	StatusAt(off int64) (mapped bool, runLength int64, err error)
+}
+
+// EmulateGetLbaStatus responds to GET LBA STATUS with descriptors of the mapped and
+// deallocated runs of blocks from the requested LBA, as many as fit in the
+// allocation length. If t is nil the whole device is reported as mapped.
+func EmulateGetLbaStatus(cmd *SCSICmd, t LBAStatusReporter) (SCSIResponse, error) {
+	order := binary.BigEndian
+	bs := cmd.Device().Sizes().BlockSize
+	blocks := uint64(cmd.Device().Sizes().VolumeSize / bs)
+	lba := order.Uint64(cmd.cdb[2:10])
+	allocLen := int(order.Uint32(cmd.cdb[10:14]))
+	if lba >= blocks {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscLBAOutOfRange), nil
+	}
+	// The allocation length comes from the CDB; there's no room for more
+	// descriptors than the data buffer holds.
+	if allocLen > cmd.dataLen() {
+		allocLen = cmd.dataLen()
+	}
+	maxDescs := (allocLen - 8) / 16
+	if maxDescs < 1 {
+		maxDescs = 1
+	}
+	data := make([]byte, 8, 8+16*maxDescs)
+	for i := 0; i < maxDescs && lba < blocks; i++ {
+		mapped, run := true, (blocks-lba)*uint64(bs)
+		if t != nil {
+			m, r, err := t.StatusAt(int64(lba) * bs)
+			if err != nil {
+				log.Errorln("get lba status failed: error:", err)
+				return cmd.MediumErrorAt(lba), nil
+			}
+			mapped, run = m, uint64(r)
+		}
+		n := (run + uint64(bs) - 1) / uint64(bs)
+		if n == 0 {
+			n = 1
+		}
+		if n > blocks-lba {
+			n = blocks - lba
+		}
+		if n > 0xffffffff {
+			n = 0xffffffff
+		}
+		desc := make([]byte, 16)
+		order.PutUint64(desc[0:8], lba)
+		order.PutUint32(desc[8:12], uint32(n))
+		if !mapped {
+			desc[12] = 0x01 // deallocated
+		}
+		data = append(data, desc...)
+		lba += n
+	}
+	order.PutUint32(data[0:4], uint32(len(data)-4))
+	if allocLen < len(data) {
+		data = data[:allocLen]
+	}
+	return cmd.Respond(data), nil
+}
+
+// formatChunkBytes is how much EmulateFormatUnit zeroes at a time, between
+// updates of the progress indication.
+const formatChunkBytes = 1024 * 1024
+
+// EmulateFormatUnit handles FORMAT UNIT. Without FMTDATA there's nothing to do, as
+// the block layout can't change, and the defect list options (CMPLST) are moot on
+// a device without defects. With a parameter list the device is zeroed, through
+// Trimmer if the backend implements it, or by writing zeros. If the IMMED bit is
+// set this happens in the background, and the initiator sees NOT READY / FORMAT IN
+// PROGRESS, with a progress indication, until it completes.
+func EmulateFormatUnit(cmd *SCSICmd, rw ReadWriterAt) (SCSIResponse, error) {
+	if cmd.GetCDB(1)&0xc0 != 0 {
+		// Protection information isn't supported.
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb), nil
+	}
+	if cmd.GetCDB(1)&0x10 == 0 {
+		return cmd.Ok(), nil
+	}
+	hdr := make([]byte, 4)
+	if cmd.GetCDB(1)&0x20 != 0 {
+		// LONGLIST
+		hdr = make([]byte, 8)
+	}
+	if n, _ := cmd.Read(hdr); n < len(hdr) {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+	}
+	immed := hdr[1]&0x02 != 0
+	return runTask(cmd, "format-unit", scsi.SenseNotReady, scsi.AscFormatInProgress, immed,
+		func(ctx context.Context, progress func(uint16)) error {
+			return formatBackend(ctx, cmd.Device(), rw, progress)
+		})
+}
+
+// formatBackend zeroes the whole device, reporting how far along it is through
+// progress. It gives up if ctx is done first.
+func formatBackend(ctx context.Context, d *Device, rw ReadWriterAt, progress func(uint16)) error {
+	size := d.Sizes().VolumeSize
+	if t, ok := rw.(Trimmer); ok {
+		return t.TrimAt(size, 0)
+	}
+	zeros := make([]byte, formatChunkBytes)
+	for off := int64(0); off < size; off += formatChunkBytes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		buf := zeros
+		if rest := size - off; rest < int64(len(buf)) {
+			buf = buf[:rest]
+		}
+		if _, err := rw.WriteAt(buf, off); err != nil {
+			return err
+		}
+		progress(formatProgress(off+int64(len(buf)), size))
+	}
+	return flushBackend(rw)
+}
+
+// formatProgress returns done bytes out of size as a progress indication, in
+// 65536ths. The product is taken in 128 bits, as done*65535 overflows an int64
+// for devices past 128TiB.
+func formatProgress(done, size int64) uint16 {
+	hi, lo := bits.Mul64(uint64(done), 65535)
+	q, _ := bits.Div64(hi, lo, uint64(size))
+	return uint16(q)
+}
+
+// EmulateAtaPassThrough handles ATA PASS-THROUGH (12) and (16), as sent by tools
+// like smartctl for SAT devices. If the backend implements SatHandler the command
+// is passed on to it; otherwise there is no ATA device behind this one, and the
+// command is failed outright with INVALID COMMAND OPERATION CODE, rather than
+// left to the kernel.
+func EmulateAtaPassThrough(cmd *SCSICmd, rw ReadWriterAt) (SCSIResponse, error) {
+	if s, ok := rw.(SatHandler); ok {
+		return s.AtaPassThrough(cmd)
+	}
+	return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidCommandOperationCode), nil
+}
+
+// EmulateReportLuns responds with the single LUN this device is configured with.
+// There are no well-known logical units, so a SELECT REPORT of 0x01 returns an
+// empty list.
+func EmulateReportLuns(cmd *SCSICmd) (SCSIResponse, error) {
+	var luns []int
+	switch cmd.GetCDB(2) {
+	case 0x00, 0x02:
+		luns = []int{cmd.Device().scsi.LUN}
+	case 0x01:
+	default:
+		return cmd.IllegalRequest(), nil
+	}
+	order := binary.BigEndian
+	data := make([]byte, 8+8*len(luns))
+	order.PutUint32(data[0:4], uint32(8*len(luns)))
+	for i, lun := range luns {
+		ent := data[8+8*i:]
+		if lun < 256 {
+			// Peripheral device addressing
+			ent[1] = byte(lun)
+		} else {
+			// Flat space addressing
+			order.PutUint16(ent[0:2], 0x4000|uint16(lun&0x3fff))
+		}
+	}
+	xlen, err := cmd.XferLenE()
+	if err != nil {
+		return cmd.IllegalRequest(), nil
+	}
+	outlen := int(xlen)
+	if outlen < len(data) {
+		data = data[:outlen]
 	}
-	return 0x00, false
+	return cmd.Respond(data), nil
+}
+
+// EmulateRequestSense reports the sense data of the most recent CHECK CONDITION on
+// the device, clearing it, or NO SENSE if there is none. Failing that, it reports
+// the deferred error of a background task that failed, such as a FORMAT UNIT with
+// IMMED set, or while one is running, that instead, with a progress indication.
+// If the DESC bit is set the data is returned in descriptor format, otherwise in
+// fixed format.
+func EmulateRequestSense(cmd *SCSICmd) (SCSIResponse, error) {
+	desc := cmd.GetCDB(1)&0x01 != 0
+	var s Sense
+	last := cmd.Device().takeLastSense()
+	switch {
+	case len(last) >= 14 && last[0]&0x7e == 0x70:
+		if !desc && len(last) >= 8+int(last[7]) {
+			// Replay fixed format sense as-is.
+			return requestSenseWrite(cmd, last[:8+int(last[7])])
+		}
+		s = Sense{Key: last[2] & 0x0f, ASC: last[12], ASCQ: last[13], Deferred: last[0]&0x01 != 0}
+	case len(last) >= 4 && last[0]&0x7e == 0x72:
+		s = Sense{Key: last[1] & 0x0f, ASC: last[2], ASCQ: last[3], Deferred: last[0]&0x01 != 0}
+	}
+	pending := false
+	if len(last) == 0 {
+		s, pending = cmd.Device().takeDeferredError()
+	}
+	ua := len(last) == 0 && !pending && cmd.Device().takeUnitAttention()
+	if ua {
+		s = NewSense(scsi.SenseUnitAttention, scsi.AscPowerOnReset)
+	}
+	if task, running := cmd.Device().taskState(); running && len(last) == 0 && !pending && !ua {
+		s = NewSense(task.key, task.asc)
+		s.Progress = &task.progress
+	}
+	if desc {
+		return requestSenseWrite(cmd, s.Descriptor())
+	}
+	return requestSenseWrite(cmd, s.Fixed())
+}
+
+func requestSenseWrite(cmd *SCSICmd, data []byte) (SCSIResponse, error) {
+	xlen, err := cmd.XferLenE()
+	if err != nil {
+		return cmd.IllegalRequest(), nil
+	}
+	outlen := int(xlen)
+	if outlen < len(data) {
+		data = data[:outlen]
+	}
+	return cmd.Respond(data), nil
 }
 
 func CachingModePage(w io.Writer, wce bool) {
@@ -229,19 +1053,217 @@ func CachingModePage(w io.Writer, wce bool) {
 	w.Write(buf)
 }
 
-// EmulateModeSense responds to a static Mode Sense command. `wce` enables or diables
-// the SCSI "Write Cache Enabled" flag.
+// RWErrorRecoveryModePage writes the Read-Write Error Recovery mode page (0x01).
+// Automatic read and write reallocation (ARRE/AWRE) are disabled, and no retries
+// are advertised, since the backend reports errors rather than recovering them.
+func RWErrorRecoveryModePage(w io.Writer) {
+	buf := make([]byte, 12)
+	buf[0] = 0x01 // read-write error recovery mode page
+	buf[1] = 0x0a // page length
+	// buf[2]: AWRE, ARRE and the other recovery flags are all clear
+	buf[3] = 0x00 // read retry count
+	buf[8] = 0x00 // write retry count
+	w.Write(buf)
+}
+
+// supportedLogPages lists the log pages returned by EmulateLogSense.
+var supportedLogPages = []byte{0x00, 0x2f}
+
+// EmulateLogSense responds to LOG SENSE for the Supported Log Pages page and an
+// Informational Exceptions page that always reports no failure predicted. There
+// are no thresholds, so only the current and default cumulative values may be
+// asked for, and both are the same.
+func EmulateLogSense(cmd *SCSICmd) (SCSIResponse, error) {
+	if cmd.GetCDB(1)&0x01 != 0 {
+		// Saving parameters isn't supported.
+		return cmd.IllegalRequest(), nil
+	}
+	if pc := cmd.GetCDB(2) >> 6; pc != 0x01 && pc != 0x03 {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb), nil
+	}
+	page := cmd.GetCDB(2) & 0x3f
+	if cmd.GetCDB(3) != 0 {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb), nil
+	}
+	var params []byte
+	switch page {
+	case 0x00:
+		params = supportedLogPages
+	case 0x2f:
+		params = []byte{
+			0x00, 0x00, // parameter code
+			0x03, // format and linking: binary list
+			0x03, // parameter length
+			0x00, // informational exception ASC
+			0x00, // informational exception ASCQ
+			0xff, // most recent temperature: unavailable
+		}
+	default:
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb), nil
+	}
+	data := make([]byte, 4, 4+len(params))
+	data[0] = page
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(params)))
+	data = append(data, params...)
+	xlen, err := cmd.XferLenE()
+	if err != nil {
+		return cmd.IllegalRequest(), nil
+	}
+	outlen := int(xlen)
+	if outlen < len(data) {
+		data = data[:outlen]
+	}
+	return cmd.Respond(data), nil
+}
+
+// supportedDiagnosticPages lists the diagnostic pages handled by
+// EmulateSendDiagnostic and EmulateReceiveDiagnostic.
+var supportedDiagnosticPages = []byte{0x00, 0x40}
+
+// EmulateSendDiagnostic responds to SEND DIAGNOSTIC. There is no hardware to
+// test, so the default self-test and the short and extended self-tests all
+// pass immediately. A parameter list may hold one of the supported diagnostic
+// pages, which is accepted and otherwise ignored.
+func EmulateSendDiagnostic(cmd *SCSICmd) (SCSIResponse, error) {
+	cdbone := cmd.GetCDB(1)
+	selfTestCode := cdbone >> 5
+	pf := cdbone&0x10 != 0
+	selfTest := cdbone&0x04 != 0
+	paramLen := int(binary.BigEndian.Uint16(cmd.cdb[3:5]))
+
+	if selfTest {
+		if selfTestCode != 0 || paramLen != 0 {
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb), nil
+		}
+		return cmd.Ok(), nil
+	}
+	switch selfTestCode {
+	case 0:
+	case 1, 2, 4, 5, 6:
+		// Background, foreground and abort self-tests take no parameters.
+		if paramLen != 0 {
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb), nil
+		}
+		return cmd.Ok(), nil
+	default:
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb), nil
+	}
+	if paramLen == 0 {
+		return cmd.Ok(), nil
+	}
+	if !pf {
+		// Vendor specific parameter lists aren't understood.
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb), nil
+	}
+	if paramLen < 4 || paramLen > cmd.dataLen() {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+	}
+	params := make([]byte, paramLen)
+	n, err := cmd.Read(params)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return SCSIResponse{}, err
+	}
+	if n < 4 || 4+int(binary.BigEndian.Uint16(params[2:4])) > n {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+	}
+	if bytes.IndexByte(supportedDiagnosticPages, params[0]) < 0 {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList), nil
+	}
+	return cmd.Ok(), nil
+}
+
+// EmulateReceiveDiagnostic responds to RECEIVE DIAGNOSTIC RESULTS with the
+// Supported Diagnostic Pages page, or a Translate Address page that translates
+// no addresses. Results of a previous SEND DIAGNOSTIC (PCV clear) are reported
+// as the Supported Diagnostic Pages page, as no page produces any.
+func EmulateReceiveDiagnostic(cmd *SCSICmd) (SCSIResponse, error) {
+	page := byte(0x00)
+	if cmd.GetCDB(1)&0x01 != 0 {
+		page = cmd.GetCDB(2)
+	} else if cmd.GetCDB(2) != 0 {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb), nil
+	}
+	var params []byte
+	switch page {
+	case 0x00:
+		params = supportedDiagnosticPages
+	case 0x40:
+		params = []byte{
+			0x00, // supplied format: short block
+			0x00, // translated format: short block, no addresses follow
+		}
+	default:
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb), nil
+	}
+	data := make([]byte, 4, 4+len(params))
+	data[0] = page
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(params)))
+	data = append(data, params...)
+	outlen := int(binary.BigEndian.Uint16(cmd.cdb[3:5]))
+	if outlen < len(data) {
+		data = data[:outlen]
+	}
+	return cmd.Respond(data), nil
+}
+
+// EmulateReadDefectData responds to READ DEFECT DATA (10) and (12). There are no
+// defects, so the header reports an empty list, in whichever defect list format
+// was requested, with the PLIST and GLIST bits echoed as valid.
+func EmulateReadDefectData(cmd *SCSICmd) (SCSIResponse, error) {
+	var flags byte
+	var data []byte
+	var outlen int
+	if cmd.Command() == scsi.ReadDefectData {
+		flags = cmd.GetCDB(2)
+		data = make([]byte, 4)
+		outlen = int(binary.BigEndian.Uint16(cmd.cdb[7:9]))
+	} else {
+		flags = cmd.GetCDB(1)
+		data = make([]byte, 8)
+		outlen = int(binary.BigEndian.Uint32(cmd.cdb[6:10]))
+	}
+	if flags&0x07 == 0x07 {
+		// Reserved defect list format.
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb), nil
+	}
+	data[1] = flags & 0x1f // PLISTV, GLISTV, defect list format
+	// The defect list length, whether in bytes 2-3 or 4-7, is zero.
+	if outlen < len(data) {
+		data = data[:outlen]
+	}
+	return cmd.Respond(data), nil
+}
+
+// EmulateModeSense responds to a Mode Sense command with the device's mode pages;
+// see Device.RegisterModePage. `wce` enables or diables the SCSI "Write Cache
+// Enabled" flag of the built-in caching page. On a read-only device the write
+// protect bit is set and the write cache reported as disabled.
 func EmulateModeSense(cmd *SCSICmd, wce bool) (SCSIResponse, error) {
 	pgs := &bytes.Buffer{}
-	outlen := int(cmd.XferLen())
+	xlen, err := cmd.XferLenE()
+	if err != nil {
+		return cmd.IllegalRequest(), nil
+	}
+	outlen := int(xlen)
+	readOnly := cmd.Device().readOnly()
 
 	page := cmd.GetCDB(2)
-	if page == 0x3f || page == 0x08 {
-		CachingModePage(pgs, wce)
+	for _, p := range cmd.Device().ModePages() {
+		if page != 0x3f && page != p.PageCode() {
+			continue
+		}
+		if c, ok := p.(cachingModePage); ok {
+			pgs.Write(c.marshal(wce && !readOnly))
+		} else {
+			pgs.Write(p.Marshal())
+		}
 	}
 	scsiCmd := cmd.Command()
 
 	dsp := byte(0x10) // Support DPO/FUA
+	if readOnly {
+		dsp |= 0x80 // WP
+	}
 
 	pgdata := pgs.Bytes()
 	var hdr []byte
@@ -263,82 +1285,150 @@ func EmulateModeSense(cmd *SCSICmd, wce bool) (SCSIResponse, error) {
 	if outlen < len(data) {
 		data = data[:outlen]
 	}
-	cmd.Write(data)
-	return cmd.Ok(), nil
+	return cmd.Respond(data), nil
 }
 
-// EmulateModeSelect checks that the only mode selected is the static one returned from
-// EmulateModeSense. `wce` should match the Write Cache Enabled of the EmulateModeSense call.
+// EmulateModeSelect applies each mode page in the parameter list through the
+// device's handler for it; see Device.RegisterModePage. Of the built-in pages,
+// only the WCE bit of the caching page may be changed, and the new setting is
+// stored on the device (see Device.WriteCacheEnabled). `wce` is no longer used:
+// the caching page compares against the device's current setting.
 func EmulateModeSelect(cmd *SCSICmd, wce bool) (SCSIResponse, error) {
 	selectTen := (cmd.GetCDB(0) == scsi.ModeSelect10)
-	page := cmd.GetCDB(2) & 0x3f
-	subpage := cmd.GetCDB(3)
-	allocLen := cmd.XferLen()
+	allocLen, err := cmd.XferLenE()
+	if err != nil {
+		return cmd.IllegalRequest(), nil
+	}
 	hdrLen := 4
 	if selectTen {
 		hdrLen = 8
 	}
 	inBuf := make([]byte, 512)
-	gotSense := false
 
 	if allocLen == 0 {
 		return cmd.Ok(), nil
 	}
-	n, err := cmd.Read(inBuf)
-	if err != nil {
-		return SCSIResponse{}, err
-	}
-	if n >= len(inBuf) {
+	if int(allocLen) >= len(inBuf) || int(allocLen) > cmd.dataLen() {
 		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
 	}
+	n, err := cmd.Read(inBuf[:allocLen])
+	if err != nil && err != io.EOF {
+		return SCSIResponse{}, err
+	}
 
 	cdbone := cmd.GetCDB(1)
 	if cdbone&0x10 == 0 || cdbone&0x01 != 0 {
 		return cmd.IllegalRequest(), nil
 	}
 
-	pgs := &bytes.Buffer{}
-	// TODO(barakmich): select over handlers. Today we have one.
-	if page == 0x08 && subpage == 0 {
-		CachingModePage(pgs, wce)
-		gotSense = true
+	if n < hdrLen {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
 	}
-	if !gotSense {
-		return cmd.IllegalRequest(), nil
+	params := inBuf[:n]
+	// Any block descriptors sit between the header and the pages.
+	bdLen := int(params[3])
+	if selectTen {
+		bdLen = int(binary.BigEndian.Uint16(params[6:8]))
 	}
-	b := pgs.Bytes()
-	if int(allocLen) < (hdrLen + len(b)) {
+	if hdrLen+bdLen > n {
 		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
 	}
-	/* Verify what was selected is identical to what sense returns, since we
-	don't support actually setting anything. */
-	if !bytes.Equal(inBuf[hdrLen:len(b)], b) {
-		log.Errorf("not equal for some reason: %#v %#v", inBuf[hdrLen:len(b)], b)
-		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList), nil
+	pages := params[hdrLen+bdLen:]
+	for len(pages) > 0 {
+		if len(pages) < 2 || 2+int(pages[1]) > len(pages) {
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+		}
+		pg := pages[:2+int(pages[1])]
+		pages = pages[len(pg):]
+		h := cmd.Device().modePage(pg[0] & 0x3f)
+		if h == nil || pg[0]&0x40 != 0 {
+			// Unknown page, or a subpage.
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList), nil
+		}
+		if err := h.Unmarshal(pg); err != nil {
+			log.Errorln("mode select failed: error:", err)
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList), nil
+		}
 	}
 	return cmd.Ok(), nil
 }
 
+// lbaXferLen returns the LBA and transfer length fields of a medium access command.
+func lbaXferLen(cmd *SCSICmd) (uint64, uint32, error) {
+	lba, err := cmd.LBAE()
+	if err != nil {
+		return 0, 0, err
+	}
+	n, err := cmd.XferLenE()
+	return lba, n, err
+}
+
+// lbaInRange reports whether the range of blocks starting at lba lies within
+// the device.
+func lbaInRange(cmd *SCSICmd, lba uint64, blocks uint64) bool {
+	sizes := cmd.Device().Sizes()
+	total := uint64(sizes.VolumeSize / sizes.BlockSize)
+	return blocks <= total && lba <= total-blocks
+}
+
+// failedLBA returns the LBA of the block that a backend transfer failed in, given
+// the number of bytes it completed.
+func failedLBA(cmd *SCSICmd, n int) uint64 {
+	return cmd.LBA() + uint64(n)/uint64(cmd.Device().Sizes().BlockSize)
+}
+
+// forceUnitAccess reports whether the FUA bit is set on a READ or WRITE. The
+// 6-byte forms have no FUA bit. DPO, next to it, is only a cache hint, and is
+// ignored.
+func forceUnitAccess(cmd *SCSICmd) bool {
+	return cmd.CdbLen() != 6 && cmd.GetCDB(1)&0x08 != 0
+}
+
+// EmulateRead reads the requested blocks from the backend. With FUA set the backend
+// is flushed first, so the data comes from stable storage.
+//
+// The backend reads straight into the command's data buffers (see
+// SCSICmd.IOVecs), with a single ReadAtv if it is a VectoredReadWriter, saving a
+// copy. That isn't done if the device has a CommandTimeout: a handler that may
+// be abandoned mustn't write to the ring directly, so the data is read into
+// scratch space first.
 func EmulateRead(cmd *SCSICmd, r io.ReaderAt) (SCSIResponse, error) {
-	offset := cmd.LBA() * uint64(cmd.Device().Sizes().BlockSize)
-	length := int(cmd.XferLen() * uint32(cmd.Device().Sizes().BlockSize))
-	if cmd.Buf == nil {
-		cmd.Buf = make([]byte, length)
+	lba, blocks, err := lbaXferLen(cmd)
+	if err != nil {
+		return cmd.IllegalRequest(), nil
 	}
-	if len(cmd.Buf) < int(length) {
-		//realloc
-		cmd.Buf = make([]byte, length)
+	if !lbaInRange(cmd, lba, uint64(blocks)) {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscLBAOutOfRange), nil
 	}
-	n, err := r.ReadAt(cmd.Buf[:length], int64(offset))
+	if forceUnitAccess(cmd) {
+		if err := flushBackend(r); err != nil {
+			log.Errorln("read/flush failed: error:", err)
+			return cmd.MediumError(), nil
+		}
+	}
+	offset := lba * uint64(cmd.Device().Sizes().BlockSize)
+	if cmd.Device().scsi.CommandTimeout <= 0 {
+		length := int(blocks) * int(cmd.Device().Sizes().BlockSize)
+		n, err := readAtVecs(r, cmd.vecs, int64(offset), length)
+		if err != nil {
+			log.Errorln("read/read failed: error:", err)
+			return cmd.MediumErrorAt(failedLBA(cmd, n)), nil
+		}
+		cmd.Device().stats.read(length)
+		return cmd.Ok(), nil
+	}
+	buf := cmd.DataBuffer()
+	length := len(buf)
+	n, err := r.ReadAt(buf, int64(offset))
 	if n < length {
 		log.Errorln("read/read failed: unable to copy enough")
-		return cmd.MediumError(), nil
+		return cmd.MediumErrorAt(failedLBA(cmd, n)), nil
 	}
 	if err != nil {
 		log.Errorln("read/read failed: error:", err)
-		return cmd.MediumError(), nil
+		return cmd.MediumErrorAt(failedLBA(cmd, n)), nil
 	}
-	n, err = cmd.Write(cmd.Buf[:length])
+	n, err = cmd.Write(buf)
 	if n < length {
 		log.Errorln("read/write failed: unable to copy enough")
 		return cmd.MediumError(), nil
@@ -347,20 +1437,83 @@ func EmulateRead(cmd *SCSICmd, r io.ReaderAt) (SCSIResponse, error) {
 		log.Errorln("read/write failed: error:", err)
 		return cmd.MediumError(), nil
 	}
+	cmd.Device().stats.read(length)
 	return cmd.Ok(), nil
 }
 
+// trimVecs returns the leading buffers of vecs holding exactly length bytes.
+func trimVecs(vecs [][]byte, length int) ([][]byte, error) {
+	out := make([][]byte, 0, len(vecs))
+	for _, v := range vecs {
+		if length == 0 {
+			break
+		}
+		if len(v) > length {
+			v = v[:length]
+		}
+		out = append(out, v)
+		length -= len(v)
+	}
+	if length > 0 {
+		return nil, errors.New("out of buffer scsi cmd buffer space")
+	}
+	return out, nil
+}
+
+// readAtVecs reads length bytes at off from r into vecs, with a single ReadAtv
+// if r is a VectoredReadWriter, or one ReadAt per buffer otherwise.
+func readAtVecs(r io.ReaderAt, vecs [][]byte, off int64, length int) (int, error) {
+	vecs, err := trimVecs(vecs, length)
+	if err != nil {
+		return 0, err
+	}
+	if v, ok := r.(VectoredReadWriter); ok {
+		return v.ReadAtv(vecs, off)
+	}
+	total := 0
+	for _, v := range vecs {
+		n, err := r.ReadAt(v, off+int64(total))
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if n < len(v) {
+			return total, errors.New("unable to copy enough")
+		}
+	}
+	return total, nil
+}
+
+// EmulateWrite writes the data-out buffer to the backend. With FUA set the backend
+// is flushed before completing, so the data is on stable storage. A
+// VectoredReadWriter backend is passed the command's data buffers directly with
+// WriteAtv, unless the device has a CommandTimeout; see EmulateRead.
 func EmulateWrite(cmd *SCSICmd, r io.WriterAt) (SCSIResponse, error) {
-	offset := cmd.LBA() * uint64(cmd.Device().Sizes().BlockSize)
-	length := int(cmd.XferLen() * uint32(cmd.Device().Sizes().BlockSize))
-	if cmd.Buf == nil {
-		cmd.Buf = make([]byte, length)
+	lba, blocks, err := lbaXferLen(cmd)
+	if err != nil {
+		return cmd.IllegalRequest(), nil
 	}
-	if len(cmd.Buf) < int(length) {
-		//realloc
-		cmd.Buf = make([]byte, length)
+	if !lbaInRange(cmd, lba, uint64(blocks)) {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscLBAOutOfRange), nil
 	}
-	n, err := cmd.Read(cmd.Buf[:int(length)])
+	offset := lba * uint64(cmd.Device().Sizes().BlockSize)
+	if v, ok := r.(VectoredReadWriter); ok && cmd.Device().scsi.CommandTimeout <= 0 {
+		length := int(blocks) * int(cmd.Device().Sizes().BlockSize)
+		vecs, err := trimVecs(cmd.vecs, length)
+		if err != nil {
+			log.Errorln("write/read failed: error:", err)
+			return cmd.MediumError(), nil
+		}
+		n, err := v.WriteAtv(vecs, int64(offset))
+		if err != nil {
+			log.Errorln("write/write failed: error:", err)
+			return cmd.MediumErrorAt(failedLBA(cmd, n)), nil
+		}
+		return finishWrite(cmd, r, length)
+	}
+	buf := cmd.DataBuffer()
+	length := len(buf)
+	n, err := cmd.Read(buf)
 	if n < length {
 		log.Errorln("write/read failed: unable to copy enough")
 		return cmd.MediumError(), nil
@@ -369,14 +1522,286 @@ func EmulateWrite(cmd *SCSICmd, r io.WriterAt) (SCSIResponse, error) {
 		log.Errorln("write/read failed: error:", err)
 		return cmd.MediumError(), nil
 	}
-	n, err = r.WriteAt(cmd.Buf[:length], int64(offset))
+	n, err = r.WriteAt(buf, int64(offset))
 	if n < length {
 		log.Errorln("write/write failed: unable to copy enough")
-		return cmd.MediumError(), nil
+		return cmd.MediumErrorAt(failedLBA(cmd, n)), nil
 	}
 	if err != nil {
 		log.Errorln("write/write failed: error:", err)
+		return cmd.MediumErrorAt(failedLBA(cmd, n)), nil
+	}
+	return finishWrite(cmd, r, length)
+}
+
+// finishWrite flushes the backend after a write with FUA set, and completes it.
+func finishWrite(cmd *SCSICmd, r io.WriterAt, length int) (SCSIResponse, error) {
+	if forceUnitAccess(cmd) {
+		if err := flushBackend(r); err != nil {
+			log.Errorln("write/flush failed: error:", err)
+			return cmd.MediumError(), nil
+		}
+	}
+	cmd.Device().stats.wrote(length)
+	return cmd.Ok(), nil
+}
+
+// EmulateSynchronizeCache flushes the backend if it implements Flusher (or has a
+// Sync method, like *os.File). The LBA range in the CDB is ignored; the whole
+// backend is flushed. If the IMMED bit is set the flush runs as a background task,
+// reported by REQUEST SENSE as OPERATION IN PROGRESS until it completes.
+func EmulateSynchronizeCache(cmd *SCSICmd, rw ReadWriterAt) (SCSIResponse, error) {
+	if cmd.GetCDB(1)&0x02 != 0 {
+		return runTask(cmd, "synchronize cache", scsi.SenseNoSense, scsi.AscOperationInProgress, true,
+			func(context.Context, func(uint16)) error {
+				return flushBackend(rw)
+			})
+	}
+	if err := flushBackend(rw); err != nil {
+		log.Errorln("synchronize cache failed: error:", err)
+		return cmd.MediumError(), nil
+	}
+	return cmd.Ok(), nil
+}
+
+// Prefetcher is an optional interface for caching backends, to warm the cache
+// for a range of the device in response to PRE-FETCH.
+type Prefetcher interface {
+	PrefetchAt(length, off int64) error
+}
+
+// EmulatePreFetch handles PRE-FETCH. It is a no-op unless the backend implements
+// Prefetcher. If the IMMED bit is set the prefetch runs in the background and the
+// command completes immediately.
+func EmulatePreFetch(cmd *SCSICmd, r io.ReaderAt) (SCSIResponse, error) {
+	p, ok := r.(Prefetcher)
+	if !ok {
+		return cmd.Ok(), nil
+	}
+	bs := cmd.Device().Sizes().BlockSize
+	lba, blocks, err := lbaXferLen(cmd)
+	if err != nil {
+		return cmd.IllegalRequest(), nil
+	}
+	if !lbaInRange(cmd, lba, uint64(blocks)) {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscLBAOutOfRange), nil
+	}
+	offset := int64(lba) * bs
+	length := int64(blocks) * bs
+	if cmd.GetCDB(1)&0x02 != 0 {
+		d := cmd.Device()
+		d.background.Add(1)
+		go func() {
+			defer d.background.Done()
+			if err := p.PrefetchAt(length, offset); err != nil {
+				log.Errorln("prefetch failed: error:", err)
+			}
+		}()
+		return cmd.Ok(), nil
+	}
+	if err := p.PrefetchAt(length, offset); err != nil {
+		log.Errorln("prefetch failed: error:", err)
+		return cmd.MediumError(), nil
+	}
+	return cmd.Ok(), nil
+}
+
+// maxCompareAndWriteBlocks is the MAXIMUM COMPARE AND WRITE LENGTH reported in
+// the Block Limits VPD page.
+const maxCompareAndWriteBlocks = 1
+
+// EmulateCompareAndWrite handles COMPARE AND WRITE (ATS). The data-out buffer holds
+// N blocks to compare followed by N blocks to write, and the write only happens if
+// the compare blocks match what is currently on the device. Concurrent ATS commands
+// over overlapping LBAs are serialized so the compare and write appear atomic. N
+// is at most the one block advertised in the Block Limits VPD page, and with FUA
+// set the backend is flushed after the write.
+func EmulateCompareAndWrite(cmd *SCSICmd, rw ReadWriterAt) (SCSIResponse, error) {
+	blocks := uint64(cmd.GetCDB(13))
+	if blocks == 0 {
+		return cmd.Ok(), nil
+	}
+	if blocks > maxCompareAndWriteBlocks {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb), nil
+	}
+	lba, err := cmd.LBAE()
+	if err != nil {
+		return cmd.IllegalRequest(), nil
+	}
+	if !lbaInRange(cmd, lba, blocks) {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscLBAOutOfRange), nil
+	}
+	offset := lba * uint64(cmd.Device().Sizes().BlockSize)
+	length := int(blocks * uint64(cmd.Device().Sizes().BlockSize))
+	buf := cmd.buffer(2 * length)
+	n, err := cmd.Read(buf)
+	if n < 2*length {
+		log.Errorln("compare-and-write/read failed: unable to copy enough")
+		return cmd.MediumError(), nil
+	}
+	if err != nil {
+		log.Errorln("compare-and-write/read failed: error:", err)
 		return cmd.MediumError(), nil
 	}
+	compare := buf[:length]
+	data := buf[length:]
+
+	r := cmd.Device().atsLock.Lock(lba, blocks)
+	defer cmd.Device().atsLock.Unlock(r)
+
+	current := make([]byte, length)
+	n, err = rw.ReadAt(current, int64(offset))
+	if n < length {
+		log.Errorln("compare-and-write/compare failed: unable to copy enough")
+		return cmd.MediumError(), nil
+	}
+	if err != nil {
+		log.Errorln("compare-and-write/compare failed: error:", err)
+		return cmd.MediumError(), nil
+	}
+	if i := mismatch(compare, current); i >= 0 {
+		return miscompare(cmd, i), nil
+	}
+	n, err = rw.WriteAt(data, int64(offset))
+	if n < length {
+		log.Errorln("compare-and-write/write failed: unable to copy enough")
+		return cmd.MediumError(), nil
+	}
+	if err != nil {
+		log.Errorln("compare-and-write/write failed: error:", err)
+		return cmd.MediumError(), nil
+	}
+	return finishWrite(cmd, rw, length)
+}
+
+// EmulateWriteVerify handles WRITE AND VERIFY. The data is written as with
+// EmulateWrite and the backend flushed; if BYTCHK is set, the blocks are read back
+// and compared against what was written.
+func EmulateWriteVerify(cmd *SCSICmd, rw ReadWriterAt) (SCSIResponse, error) {
+	resp, err := EmulateWrite(cmd, rw)
+	if err != nil || resp.status != scsi.SamStatGood {
+		return resp, err
+	}
+	if err := flushBackend(rw); err != nil {
+		log.Errorln("write-verify/flush failed: error:", err)
+		return cmd.MediumError(), nil
+	}
+	if cmd.GetCDB(1)&0x02 == 0 {
+		return resp, nil
+	}
+	lba, blocks, err := lbaXferLen(cmd)
+	if err != nil {
+		return cmd.IllegalRequest(), nil
+	}
+	offset := lba * uint64(cmd.Device().Sizes().BlockSize)
+	length := int(blocks * uint32(cmd.Device().Sizes().BlockSize))
+	current := make([]byte, length)
+	n, err := rw.ReadAt(current, int64(offset))
+	if n < length {
+		log.Errorln("write-verify/verify failed: unable to copy enough")
+		return cmd.MediumError(), nil
+	}
+	if err != nil {
+		log.Errorln("write-verify/verify failed: error:", err)
+		return cmd.MediumError(), nil
+	}
+	// The data buffer is only filled if EmulateWrite didn't pass the command's
+	// buffers to WriteAtv, so compare against those.
+	written, err := trimVecs(cmd.vecs, length)
+	if err != nil {
+		log.Errorln("write-verify/verify failed: error:", err)
+		return cmd.MediumError(), nil
+	}
+	if i := mismatch(bytes.Join(written, nil), current); i >= 0 {
+		return miscompare(cmd, i), nil
+	}
+	return resp, nil
+}
+
+// verifyChunkBytes bounds the memory EmulateVerify uses for a single backend read.
+const verifyChunkBytes = 1024 * 1024
+
+// EmulateVerify handles VERIFY. With BYTCHK 0 the requested blocks are read from
+// the backend to check they are readable; with BYTCHK 1 they are also compared to
+// the data-out buffer, and with BYTCHK 3 each block is compared to the single block
+// in the data-out buffer.
+func EmulateVerify(cmd *SCSICmd, r io.ReaderAt) (SCSIResponse, error) {
+	bs := cmd.Device().Sizes().BlockSize
+	lba, blocks, err := lbaXferLen(cmd)
+	if err != nil {
+		return cmd.IllegalRequest(), nil
+	}
+	if !lbaInRange(cmd, lba, uint64(blocks)) {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscLBAOutOfRange), nil
+	}
+	offset := int64(lba) * bs
+	length := int64(blocks) * bs
+	bytchk := (cmd.GetCDB(1) >> 1) & 0x03
+	if bytchk == 0x02 {
+		return cmd.IllegalRequest(), nil
+	}
+	chunk := verifyChunkBytes / bs * bs
+	if chunk == 0 {
+		chunk = bs
+	}
+	current := make([]byte, chunk)
+	var want []byte
+	switch bytchk {
+	case 0x01:
+		want = make([]byte, chunk)
+	case 0x03:
+		want = make([]byte, bs)
+		if n, err := cmd.Read(want); n < len(want) || err != nil {
+			log.Errorln("verify/read failed: unable to copy enough")
+			return cmd.MediumError(), nil
+		}
+	}
+	for done := int64(0); done < length; done += chunk {
+		if length-done < chunk {
+			chunk = length - done
+		}
+		got := current[:chunk]
+		n, err := r.ReadAt(got, offset+done)
+		if n < len(got) {
+			log.Errorln("verify/verify failed: unable to copy enough")
+			return cmd.MediumError(), nil
+		}
+		if err != nil {
+			log.Errorln("verify/verify failed: error:", err)
+			return cmd.MediumError(), nil
+		}
+		switch bytchk {
+		case 0x01:
+			if n, err := cmd.Read(want[:chunk]); n < int(chunk) || err != nil {
+				log.Errorln("verify/read failed: unable to copy enough")
+				return cmd.MediumError(), nil
+			}
+			if i := mismatch(want[:chunk], got); i >= 0 {
+				return miscompare(cmd, int(done)+i), nil
+			}
+		case 0x03:
+			for b := int64(0); b < chunk; b += bs {
+				if i := mismatch(want, got[b:b+bs]); i >= 0 {
+					return miscompare(cmd, int(done+b)+i), nil
+				}
+			}
+		}
+	}
 	return cmd.Ok(), nil
 }
+
+// mismatch returns the index of the first differing byte of a and b, or -1.
+func mismatch(a, b []byte) int {
+	for i := range a {
+		if i >= len(b) || a[i] != b[i] {
+			return i
+		}
+	}
+	return -1
+}
+
+// miscompare returns a MISCOMPARE check condition whose INFORMATION field holds
+// the byte offset of the first mismatch.
+func miscompare(cmd *SCSICmd, offset int) SCSIResponse {
+	return cmd.checkConditionInfo(scsi.SenseMiscompare, scsi.AscMiscompareDuringVerifyOperation, uint64(offset))
+}
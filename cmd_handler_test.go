@@ -0,0 +1,1596 @@
+package tcmu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-tcmu/scsi"
+)
+
+var testSizes = DataSizes{VolumeSize: 1024 * 1024, BlockSize: 512}
+
+// newTestDevice returns a Device that isn't connected to the kernel, suitable for
+// calling the Emulate functions directly.
+func newTestDevice() *Device {
+	return &Device{
+		scsi: &SCSIHandler{
+			VolumeName: "testvol",
+			DataSizes:  testSizes,
+			WWN:        GenerateTestWWN(),
+		},
+		uioFd:  -1,
+		stopFd: -1,
+	}
+}
+
+// newTestCmd returns a command for cdb on a new test device, with a single data
+// buffer of xferLen bytes. The buffer is returned so tests can fill in data-out
+// or inspect what was written to it.
+func newTestCmd(cdb []byte, xferLen int) (*SCSICmd, []byte) {
+	buf := make([]byte, xferLen)
+	return &SCSICmd{
+		cdb:    cdb,
+		vecs:   [][]byte{buf},
+		device: newTestDevice(),
+	}, buf
+}
+
+// senseKeyASC extracts the sense key and additional sense code from fixed format
+// sense data.
+func senseKeyASC(resp SCSIResponse) (byte, uint16) {
+	if len(resp.senseBuffer) < 14 {
+		return 0, 0
+	}
+	return resp.senseBuffer[2] & 0x0f, binary.BigEndian.Uint16(resp.senseBuffer[12:14])
+}
+
+func checkGood(t *testing.T, resp SCSIResponse, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.status != scsi.SamStatGood {
+		key, asc := senseKeyASC(resp)
+		t.Fatalf("status 0x%x, sense key 0x%x asc 0x%04x", resp.status, key, asc)
+	}
+}
+
+func checkSense(t *testing.T, resp SCSIResponse, key byte, asc uint16) {
+	t.Helper()
+	if resp.status != scsi.SamStatCheckCondition {
+		t.Fatalf("status 0x%x, want CHECK CONDITION", resp.status)
+	}
+	if k, a := senseKeyASC(resp); k != key || a != asc {
+		t.Fatalf("sense key 0x%x asc 0x%04x, want 0x%x 0x%04x", k, a, key, asc)
+	}
+}
+
+func TestEmulateInquiry(t *testing.T) {
+	tests := []struct {
+		name  string
+		cdb   []byte
+		check func(t *testing.T, data []byte)
+	}{
+		{
+			name: "standard",
+			cdb:  []byte{scsi.Inquiry, 0, 0, 0, 96, 0},
+			check: func(t *testing.T, data []byte) {
+				if data[4] != 31 {
+					t.Errorf("additional length %d, want 31", data[4])
+				}
+				if got := string(data[8:16]); got != "go-tcmu " {
+					t.Errorf("vendor %q", got)
+				}
+				if got := string(data[16:32]); got != "TCMU Device     " {
+					t.Errorf("product %q", got)
+				}
+			},
+		},
+		{
+			name: "supported pages",
+			cdb:  []byte{scsi.Inquiry, 1, 0x00, 0, 96, 0},
+			check: func(t *testing.T, data []byte) {
+				n := int(data[3])
+				if !bytes.Equal(data[4:4+n], supportedVPDPages) {
+					t.Errorf("pages % x, want % x", data[4:4+n], supportedVPDPages)
+				}
+			},
+		},
+		{
+			name: "unit serial number",
+			cdb:  []byte{scsi.Inquiry, 1, 0x80, 0, 96, 0},
+			check: func(t *testing.T, data []byte) {
+				if data[1] != 0x80 || data[3] != serialNumberLength {
+					t.Errorf("header % x", data[:4])
+				}
+				serial := GenerateSerial("testvol")
+				if got := string(data[4 : 4+len(serial)]); got != serial {
+					t.Errorf("serial %q, want %q", got, serial)
+				}
+			},
+		},
+		{
+			name: "device identification",
+			cdb:  []byte{scsi.Inquiry, 1, 0x83, 0, 255, 0},
+			check: func(t *testing.T, data []byte) {
+				if data[1] != 0x83 {
+					t.Errorf("page 0x%x", data[1])
+				}
+				if data[4+1] != 1 {
+					t.Errorf("first designator type %d, want T10 vendor id", data[4+1])
+				}
+			},
+		},
+		{
+			name: "block limits",
+			cdb:  []byte{scsi.Inquiry, 1, 0xb0, 0, 64, 0},
+			check: func(t *testing.T, data []byte) {
+				if data[5] != 1 {
+					t.Errorf("max compare and write length %d, want 1", data[5])
+				}
+				want := uint32(defaultMaxTransferBytes / testSizes.BlockSize)
+				if got := binary.BigEndian.Uint32(data[8:12]); got != want {
+					t.Errorf("max transfer length %d, want %d", got, want)
+				}
+			},
+		},
+		{
+			name: "block device characteristics",
+			cdb:  []byte{scsi.Inquiry, 1, 0xb1, 0, 64, 0},
+			check: func(t *testing.T, data []byte) {
+				if got := binary.BigEndian.Uint16(data[4:6]); got != 1 {
+					t.Errorf("rotation rate %d, want 1", got)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, buf := newTestCmd(tt.cdb, int(tt.cdb[4]))
+			resp, err := EmulateInquiry(cmd, &defaultInquiry)
+			checkGood(t, resp, err)
+			tt.check(t, buf)
+		})
+	}
+}
+
+func TestRegisterVPD(t *testing.T) {
+	h := ReadWriterAtCmdHandler{RW: NewMemoryStore(testSizes.VolumeSize)}
+	h.RegisterVPD(0xc0, func(cmd *SCSICmd) []byte {
+		return []byte("replica-7")
+	})
+
+	cmd, buf := newTestCmd([]byte{scsi.Inquiry, 1, 0xc0, 0, 64, 0}, 64)
+	resp, err := h.HandleCommand(cmd)
+	checkGood(t, resp, err)
+	if n := int(binary.BigEndian.Uint16(buf[2:4])); buf[1] != 0xc0 || string(buf[4:4+n]) != "replica-7" {
+		t.Errorf("page % x", buf[:16])
+	}
+
+	cmd, buf = newTestCmd([]byte{scsi.Inquiry, 1, 0x00, 0, 64, 0}, 64)
+	resp, err = h.HandleCommand(cmd)
+	checkGood(t, resp, err)
+	want := append(append([]byte(nil), supportedVPDPages...), 0xc0)
+	if n := int(buf[3]); !bytes.Equal(buf[4:4+n], want) {
+		t.Errorf("pages % x, want % x", buf[4:4+n], want)
+	}
+}
+
+func TestEmulateInquiryUnknownPage(t *testing.T) {
+	cmd, _ := newTestCmd([]byte{scsi.Inquiry, 1, 0xfe, 0, 96, 0}, 96)
+	resp, _ := EmulateInquiry(cmd, &defaultInquiry)
+	checkSense(t, resp, scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb)
+}
+
+func TestEmulateStdInquiryTaggedQueuing(t *testing.T) {
+	cmd, buf := newTestCmd([]byte{scsi.Inquiry, 0, 0, 0, 36, 0}, 36)
+	resp, err := EmulateInquiry(cmd, &defaultInquiry)
+	checkGood(t, resp, err)
+	if buf[7]&0x02 == 0 {
+		t.Errorf("CmdQue clear by default: % x", buf[:8])
+	}
+
+	inq := defaultInquiry
+	inq.NoTaggedQueuing = true
+	cmd, buf = newTestCmd([]byte{scsi.Inquiry, 0, 0, 0, 36, 0}, 36)
+	resp, err = EmulateInquiry(cmd, &inq)
+	checkGood(t, resp, err)
+	if buf[7]&0x02 != 0 {
+		t.Errorf("CmdQue set with NoTaggedQueuing: % x", buf[:8])
+	}
+}
+
+func TestEmulateStdInquiryVersion(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		version byte
+		unmap   uint32
+		want    byte
+	}{
+		{"default", 0, 0, VersionSPC3},
+		{"thin provisioned", 0, 1024, VersionSPC4},
+		{"explicit", VersionSPC2, 0, VersionSPC2},
+		{"explicit thin provisioned", VersionSPC3, 1024, VersionSPC3},
+	} {
+		inq := defaultInquiry
+		inq.Version = tt.version
+		inq.MaxUnmapLBACount = tt.unmap
+		cmd, buf := newTestCmd([]byte{scsi.Inquiry, 0, 0, 0, 36, 0}, 36)
+		resp, err := EmulateInquiry(cmd, &inq)
+		checkGood(t, resp, err)
+		if buf[2] != tt.want || buf[3] != 0x02 {
+			t.Errorf("%s: version 0x%02x, format 0x%02x, want 0x%02x, 0x02", tt.name, buf[2], buf[3], tt.want)
+		}
+	}
+}
+
+func TestEmulateReadCapacity(t *testing.T) {
+	lastLBA := uint64(testSizes.VolumeSize/testSizes.BlockSize) - 1
+
+	cmd, buf := newTestCmd([]byte{scsi.ReadCapacity, 0, 0, 0, 0, 0, 0, 0, 0, 0}, 8)
+	resp, err := EmulateReadCapacity10(cmd)
+	checkGood(t, resp, err)
+	if got := binary.BigEndian.Uint32(buf[0:4]); uint64(got) != lastLBA {
+		t.Errorf("READ CAPACITY (10) last LBA %d, want %d", got, lastLBA)
+	}
+	if got := binary.BigEndian.Uint32(buf[4:8]); int64(got) != testSizes.BlockSize {
+		t.Errorf("READ CAPACITY (10) block size %d", got)
+	}
+
+	cdb := make([]byte, 16)
+	cdb[0], cdb[1], cdb[13] = scsi.ServiceActionIn16, scsi.SaiReadCapacity16, 32
+	cmd, buf = newTestCmd(cdb, 32)
+	resp, err = EmulateServiceActionIn(cmd)
+	checkGood(t, resp, err)
+	if got := binary.BigEndian.Uint64(buf[0:8]); got != lastLBA {
+		t.Errorf("READ CAPACITY (16) last LBA %d, want %d", got, lastLBA)
+	}
+	if got := binary.BigEndian.Uint32(buf[8:12]); int64(got) != testSizes.BlockSize {
+		t.Errorf("READ CAPACITY (16) block size %d", got)
+	}
+}
+
+func TestEmulateReadBlockLimits(t *testing.T) {
+	h := ReadWriterAtCmdHandler{RW: NewMemoryStore(testSizes.VolumeSize)}
+	cmd, buf := newTestCmd([]byte{scsi.ReadBlockLimits, 0, 0, 0, 0, 0}, 6)
+	resp, err := h.HandleCommand(cmd)
+	checkGood(t, resp, err)
+	if want := []byte{0, 0, 0x02, 0x00, 0x02, 0x00}; !bytes.Equal(buf, want) {
+		t.Errorf("block limits % x, want % x", buf, want)
+	}
+
+	cmd, _ = newTestCmd([]byte{scsi.ReadBlockLimits, 1, 0, 0, 0, 0}, 20)
+	resp, _ = h.HandleCommand(cmd)
+	checkSense(t, resp, scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb)
+}
+
+func TestEmulateReadCapacity16PhysicalBlocks(t *testing.T) {
+	cdb := make([]byte, 16)
+	cdb[0], cdb[1], cdb[13] = scsi.ServiceActionIn16, scsi.SaiReadCapacity16, 32
+	cmd, buf := newTestCmd(cdb, 32)
+	cmd.device.scsi.DataSizes.PhysicalBlockExponent = 3
+	cmd.device.scsi.DataSizes.LowestAlignedLBA = 1
+	resp, err := EmulateServiceActionIn(cmd)
+	checkGood(t, resp, err)
+	if buf[13] != 3 {
+		t.Errorf("physical block exponent %d, want 3", buf[13])
+	}
+	if got := binary.BigEndian.Uint16(buf[14:16]); got != 1 {
+		t.Errorf("lowest aligned LBA %d, want 1", got)
+	}
+
+	cmd, buf = newTestCmd([]byte{scsi.Inquiry, 1, 0xb0, 0, 64, 0}, 64)
+	cmd.device.scsi.DataSizes.PhysicalBlockExponent = 3
+	resp, err = EmulateInquiry(cmd, &defaultInquiry)
+	checkGood(t, resp, err)
+	if got := binary.BigEndian.Uint16(buf[6:8]); got != 8 {
+		t.Errorf("optimal transfer length granularity %d, want 8", got)
+	}
+}
+
+func TestOptimalIOSize(t *testing.T) {
+	cmd, buf := newTestCmd([]byte{scsi.Inquiry, 1, 0xb0, 0, 64, 0}, 64)
+	cmd.device.scsi.OptimalIOSize = 4 << 20
+	resp, err := EmulateInquiry(cmd, &defaultInquiry)
+	checkGood(t, resp, err)
+	want := uint32(4 << 20 / testSizes.BlockSize)
+	if got := binary.BigEndian.Uint32(buf[12:16]); got != want {
+		t.Errorf("optimal transfer length %d, want %d", got, want)
+	}
+
+	// InquiryInfo takes precedence.
+	inq := defaultInquiry
+	inq.OptimalTransferLength = 16
+	cmd, buf = newTestCmd([]byte{scsi.Inquiry, 1, 0xb0, 0, 64, 0}, 64)
+	cmd.device.scsi.OptimalIOSize = 4 << 20
+	resp, err = EmulateInquiry(cmd, &inq)
+	checkGood(t, resp, err)
+	if got := binary.BigEndian.Uint32(buf[12:16]); got != 16 {
+		t.Errorf("optimal transfer length %d, want 16", got)
+	}
+
+	for _, tt := range []struct {
+		size int64
+		ok   bool
+	}{
+		{0, true},
+		{4 << 20, true},
+		{testSizes.BlockSize + 1, false},
+		{-testSizes.BlockSize, false},
+	} {
+		h := &SCSIHandler{DataSizes: testSizes, OptimalIOSize: tt.size}
+		if err := h.validateOptimalIOSize(); (err == nil) != tt.ok {
+			t.Errorf("OptimalIOSize %d: %v", tt.size, err)
+		}
+	}
+}
+
+func TestEmulateModeSense(t *testing.T) {
+	tests := []struct {
+		name     string
+		cdb      []byte
+		wce      bool
+		readOnly bool
+		hdrLen   int
+		pages    []byte
+	}{
+		{"6 caching", []byte{scsi.ModeSense, 0, 0x08, 0, 255, 0}, true, false, 4, []byte{0x08}},
+		{"6 all", []byte{scsi.ModeSense, 0, 0x3f, 0, 255, 0}, false, false, 4, []byte{0x01, 0x08}},
+		{"10 all", []byte{scsi.ModeSense10, 0, 0x3f, 0, 0, 0, 0, 0, 255, 0}, false, false, 8, []byte{0x01, 0x08}},
+		{"10 error recovery", []byte{scsi.ModeSense10, 0, 0x01, 0, 0, 0, 0, 0, 255, 0}, false, false, 8, []byte{0x01}},
+		{"6 read-only", []byte{scsi.ModeSense, 0, 0x08, 0, 255, 0}, true, true, 4, []byte{0x08}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, buf := newTestCmd(tt.cdb, 255)
+			cmd.Device().scsi.ReadOnly = tt.readOnly
+			resp, err := EmulateModeSense(cmd, tt.wce)
+			checkGood(t, resp, err)
+
+			var dsp byte
+			var dataLen int
+			if tt.hdrLen == 4 {
+				dsp, dataLen = buf[2], int(buf[0])+1
+			} else {
+				dsp, dataLen = buf[3], int(binary.BigEndian.Uint16(buf[0:2]))+2
+			}
+			if wp := dsp&0x80 != 0; wp != tt.readOnly {
+				t.Errorf("WP %v, want %v", wp, tt.readOnly)
+			}
+			var pages []byte
+			for off := tt.hdrLen; off < dataLen; off += int(buf[off+1]) + 2 {
+				pages = append(pages, buf[off]&0x3f)
+				if buf[off] == 0x08 {
+					if wce := buf[off+2]&0x04 != 0; wce != (tt.wce && !tt.readOnly) {
+						t.Errorf("WCE %v", wce)
+					}
+				}
+			}
+			if !bytes.Equal(pages, tt.pages) {
+				t.Errorf("pages % x, want % x", pages, tt.pages)
+			}
+		})
+	}
+}
+
+func TestEmulateModeSelect(t *testing.T) {
+	caching := func(wce bool) []byte {
+		b := &bytes.Buffer{}
+		CachingModePage(b, wce)
+		return b.Bytes()
+	}
+	hdr6 := []byte{0, 0, 0, 0}
+	hdr10 := []byte{0, 0, 0, 0, 0, 0, 0, 0}
+	bd6 := []byte{0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0x02, 0}
+	changed := caching(true)
+	changed[3] = 0xff
+	tests := []struct {
+		name    string
+		ten     bool
+		param   []byte
+		wce     bool
+		ok      bool
+		wantASC uint16
+	}{
+		{"6 enable", false, append(hdr6, caching(true)...), true, true, 0},
+		{"6 disable", false, append(hdr6, caching(false)...), false, true, 0},
+		{"6 block descriptor", false, append(bd6, caching(true)...), true, true, 0},
+		{"10 enable", true, append(hdr10, caching(true)...), true, true, 0},
+		{"10 two pages", true, append(append(hdr10, caching(false)...), errorRecoveryModePage{}.Marshal()...), false, true, 0},
+		{"6 header only", false, hdr6[:2], false, false, scsi.AscParameterListLengthError},
+		{"10 truncated page", true, append(hdr10, caching(true)[:10]...), false, false, scsi.AscParameterListLengthError},
+		{"6 changed field", false, append(hdr6, changed...), false, false, scsi.AscInvalidFieldInParameterList},
+		{"10 unknown page", true, append(hdr10, 0x30, 0x02, 0, 0), false, false, scsi.AscInvalidFieldInParameterList},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cdb := []byte{scsi.ModeSelect, 0x10, 0, 0, byte(len(tt.param)), 0}
+			if tt.ten {
+				cdb = []byte{scsi.ModeSelect10, 0x10, 0, 0, 0, 0, 0, 0, byte(len(tt.param)), 0}
+			}
+			cmd, buf := newTestCmd(cdb, len(tt.param))
+			copy(buf, tt.param)
+			cmd.device.state.wce = !tt.wce
+			resp, err := EmulateModeSelect(cmd, !tt.wce)
+			if !tt.ok {
+				checkSense(t, resp, scsi.SenseIllegalRequest, tt.wantASC)
+				return
+			}
+			checkGood(t, resp, err)
+			if got := cmd.Device().WriteCacheEnabled(); got != tt.wce {
+				t.Errorf("WriteCacheEnabled() = %v, want %v", got, tt.wce)
+			}
+		})
+	}
+
+	// A parameter list length beyond the data sent.
+	cmd, _ := newTestCmd([]byte{scsi.ModeSelect, 0x10, 0, 0, 0xff, 0}, 4)
+	resp, _ := EmulateModeSelect(cmd, false)
+	checkSense(t, resp, scsi.SenseIllegalRequest, scsi.AscParameterListLengthError)
+}
+
+// testModePage is a vendor specific mode page with one changeable byte.
+type testModePage struct {
+	value *byte
+}
+
+func (testModePage) PageCode() byte {
+	return 0x20
+}
+
+func (p testModePage) Marshal() []byte {
+	return []byte{0x20, 0x02, *p.value, 0}
+}
+
+func (p testModePage) Unmarshal(data []byte) error {
+	if len(data) != 4 || data[3] != 0 {
+		return errors.New("bad page")
+	}
+	*p.value = data[2]
+	return nil
+}
+
+func TestRegisterModePage(t *testing.T) {
+	value := byte(0x5a)
+	cmd, buf := newTestCmd([]byte{scsi.ModeSense, 0, 0x3f, 0, 255, 0}, 255)
+	dev := cmd.Device()
+	dev.RegisterModePage(testModePage{&value})
+	resp, err := EmulateModeSense(cmd, false)
+	checkGood(t, resp, err)
+	var pages []byte
+	for off := 4; off < int(buf[0])+1; off += int(buf[off+1]) + 2 {
+		pages = append(pages, buf[off]&0x3f)
+	}
+	if want := []byte{0x01, 0x08, 0x20}; !bytes.Equal(pages, want) {
+		t.Errorf("pages % x, want % x", pages, want)
+	}
+
+	param := []byte{0, 0, 0, 0, 0x20, 0x02, 0xa5, 0}
+	cmd, buf = newTestCmd([]byte{scsi.ModeSelect, 0x10, 0, 0, byte(len(param)), 0}, len(param))
+	cmd.device = dev
+	copy(buf, param)
+	resp, err = EmulateModeSelect(cmd, false)
+	checkGood(t, resp, err)
+	if value != 0xa5 {
+		t.Errorf("page value 0x%02x, want 0xa5", value)
+	}
+
+	param[7] = 1
+	cmd, buf = newTestCmd([]byte{scsi.ModeSelect, 0x10, 0, 0, byte(len(param)), 0}, len(param))
+	cmd.device = dev
+	copy(buf, param)
+	resp, _ = EmulateModeSelect(cmd, false)
+	checkSense(t, resp, scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList)
+}
+
+func TestEmulateReadWrite(t *testing.T) {
+	store := NewMemoryStore(testSizes.VolumeSize)
+	bs := int(testSizes.BlockSize)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 2*bs/16)
+
+	cmd, buf := newTestCmd([]byte{scsi.Write10, 0, 0, 0, 0, 10, 0, 0, 2, 0}, 2*bs)
+	copy(buf, data)
+	resp, err := EmulateWrite(cmd, store)
+	checkGood(t, resp, err)
+
+	got := make([]byte, 2*bs)
+	if _, err := store.ReadAt(got, 10*int64(bs)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("backend doesn't hold the written data")
+	}
+
+	cmd, buf = newTestCmd([]byte{scsi.Read16, 0, 0, 0, 0, 0, 0, 0, 0, 11, 0, 0, 0, 1, 0, 0}, bs)
+	resp, err = EmulateRead(cmd, store)
+	checkGood(t, resp, err)
+	if !bytes.Equal(buf, data[bs:]) {
+		t.Fatal("read returned the wrong block")
+	}
+}
+
+func TestEmulateReadIOVecs(t *testing.T) {
+	bs := int(testSizes.BlockSize)
+	store := NewMemoryStore(testSizes.VolumeSize)
+	data := make([]byte, 3*bs)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	store.WriteAt(data, int64(bs))
+
+	for _, timeout := range []time.Duration{0, time.Minute} {
+		cmd, _ := newTestCmd([]byte{scsi.Read10, 0, 0, 0, 0, 1, 0, 0, 3, 0}, 0)
+		cmd.device.scsi.CommandTimeout = timeout
+		// Split the data-in buffer unevenly, as the kernel may.
+		cmd.vecs = [][]byte{make([]byte, bs/2), make([]byte, 2*bs), make([]byte, bs/2)}
+		resp, err := EmulateRead(cmd, store)
+		checkGood(t, resp, err)
+		if got := bytes.Join(cmd.IOVecs(), nil); !bytes.Equal(got, data) {
+			t.Errorf("timeout %s: read data doesn't match", timeout)
+		}
+	}
+}
+
+// vectoredStore is a MemoryStore that implements VectoredReadWriter, counting
+// the vectored calls.
+type vectoredStore struct {
+	*MemoryStore
+	calls int
+}
+
+func (v *vectoredStore) ReadAtv(vecs [][]byte, off int64) (int, error) {
+	v.calls++
+	total := 0
+	for _, b := range vecs {
+		n, err := v.ReadAt(b, off+int64(total))
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (v *vectoredStore) WriteAtv(vecs [][]byte, off int64) (int, error) {
+	v.calls++
+	total := 0
+	for _, b := range vecs {
+		n, err := v.WriteAt(b, off+int64(total))
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func TestEmulateReadWriteVectored(t *testing.T) {
+	bs := int(testSizes.BlockSize)
+	store := &vectoredStore{MemoryStore: NewMemoryStore(testSizes.VolumeSize)}
+	data := make([]byte, 2*bs)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	cmd, _ := newTestCmd([]byte{scsi.Write10, 0, 0, 0, 0, 2, 0, 0, 2, 0}, 0)
+	cmd.vecs = [][]byte{data[:bs/2], data[bs/2:]}
+	resp, err := EmulateWrite(cmd, store)
+	checkGood(t, resp, err)
+
+	cmd, _ = newTestCmd([]byte{scsi.Read10, 0, 0, 0, 0, 2, 0, 0, 2, 0}, 0)
+	cmd.vecs = [][]byte{make([]byte, bs), make([]byte, bs)}
+	resp, err = EmulateRead(cmd, store)
+	checkGood(t, resp, err)
+	if got := bytes.Join(cmd.vecs, nil); !bytes.Equal(got, data) {
+		t.Error("read data doesn't match")
+	}
+	if store.calls != 2 {
+		t.Errorf("%d vectored calls, want 2", store.calls)
+	}
+}
+
+func TestEmulateWriteVerifyVectored(t *testing.T) {
+	bs := int(testSizes.BlockSize)
+	store := &vectoredStore{MemoryStore: NewMemoryStore(testSizes.VolumeSize)}
+	data := make([]byte, bs)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	// BYTCHK compares the written data with what's read back.
+	cmd, _ := newTestCmd([]byte{scsi.WriteVerify, 0x02, 0, 0, 0, 3, 0, 0, 1, 0}, 0)
+	cmd.vecs = [][]byte{data[:bs/2], data[bs/2:]}
+	resp, err := EmulateWriteVerify(cmd, store)
+	checkGood(t, resp, err)
+	if store.calls != 1 {
+		t.Errorf("%d vectored calls, want 1", store.calls)
+	}
+	got := make([]byte, bs)
+	store.ReadAt(got, 3*int64(bs))
+	if !bytes.Equal(got, data) {
+		t.Error("written data doesn't match")
+	}
+}
+
+func TestEmulateReadWriteOutOfRange(t *testing.T) {
+	bs := int(testSizes.BlockSize)
+	last := uint32(testSizes.VolumeSize/testSizes.BlockSize) - 1
+	store := NewMemoryStore(testSizes.VolumeSize)
+	rw10 := func(op byte, lba uint32, blocks uint16) []byte {
+		cdb := []byte{op, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(cdb[2:6], lba)
+		binary.BigEndian.PutUint16(cdb[7:9], blocks)
+		return cdb
+	}
+
+	cmd, _ := newTestCmd(rw10(scsi.Write10, last, 1), bs)
+	resp, err := EmulateWrite(cmd, store)
+	checkGood(t, resp, err)
+	cmd, _ = newTestCmd(rw10(scsi.Read10, last, 1), bs)
+	resp, err = EmulateRead(cmd, store)
+	checkGood(t, resp, err)
+
+	for _, tt := range []struct {
+		lba    uint32
+		blocks uint16
+	}{{last + 1, 1}, {last, 2}, {0xffffffff, 1}} {
+		cmd, _ = newTestCmd(rw10(scsi.Write10, tt.lba, tt.blocks), int(tt.blocks)*bs)
+		resp, _ = EmulateWrite(cmd, store)
+		checkSense(t, resp, scsi.SenseIllegalRequest, scsi.AscLBAOutOfRange)
+		cmd, _ = newTestCmd(rw10(scsi.Read10, tt.lba, tt.blocks), int(tt.blocks)*bs)
+		resp, _ = EmulateRead(cmd, store)
+		checkSense(t, resp, scsi.SenseIllegalRequest, scsi.AscLBAOutOfRange)
+	}
+}
+
+func TestHandleCommandMaxTransferLength(t *testing.T) {
+	bs := int(testSizes.BlockSize)
+	h := ReadWriterAtCmdHandler{
+		RW:  NewMemoryStore(testSizes.VolumeSize),
+		Inq: &InquiryInfo{MaxTransferLength: 8},
+	}
+	cmd, _ := newTestCmd([]byte{scsi.Read10, 0, 0, 0, 0, 0, 0, 0, 8, 0}, 8*bs)
+	resp, err := h.HandleCommand(cmd)
+	checkGood(t, resp, err)
+
+	cmd, _ = newTestCmd([]byte{scsi.Read10, 0, 0, 0, 0, 0, 0, 0, 9, 0}, 9*bs)
+	resp, _ = h.HandleCommand(cmd)
+	checkSense(t, resp, scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb)
+	if cmd.Buf != nil {
+		t.Errorf("allocated %d bytes for a rejected transfer", len(cmd.Buf))
+	}
+}
+
+func TestHandleCommandReadOnly(t *testing.T) {
+	h := ReadWriterAtCmdHandler{RW: NewMemoryStore(testSizes.VolumeSize)}
+	cmd, _ := newTestCmd([]byte{scsi.Write10, 0, 0, 0, 0, 0, 0, 0, 1, 0}, int(testSizes.BlockSize))
+	cmd.Device().scsi.ReadOnly = true
+	resp, _ := h.HandleCommand(cmd)
+	checkSense(t, resp, scsi.SenseDataProtect, scsi.AscWriteProtected)
+}
+
+// readerOnly hides everything but ReadAt of the MemoryStore behind it.
+type readerOnly struct {
+	r io.ReaderAt
+}
+
+func (r readerOnly) ReadAt(p []byte, off int64) (int, error) {
+	return r.r.ReadAt(p, off)
+}
+
+func TestReadOnlyBackend(t *testing.T) {
+	store := NewMemoryStore(testSizes.VolumeSize)
+	store.WriteAt([]byte("hello"), 0)
+	bs := int(testSizes.BlockSize)
+
+	h := BasicReadOnlyHandler(readerOnly{store})
+	d := newTestDevice()
+	d.scsi.Backend = h.Backend
+	if !d.readOnly() {
+		t.Fatal("an io.ReaderAt backend isn't read-only")
+	}
+	rw := ReadWriterAtCmdHandler{RW: readOnlyBackend{readerOnly{store}}}
+
+	cmd, _ := newTestCmd([]byte{scsi.Write10, 0, 0, 0, 0, 0, 0, 0, 1, 0}, bs)
+	cmd.device = d
+	resp, _ := rw.HandleCommand(cmd)
+	checkSense(t, resp, scsi.SenseDataProtect, scsi.AscWriteProtected)
+
+	cmd, buf := newTestCmd([]byte{scsi.Read10, 0, 0, 0, 0, 0, 0, 0, 1, 0}, bs)
+	cmd.device = d
+	resp, err := rw.HandleCommand(cmd)
+	checkGood(t, resp, err)
+	if string(buf[:5]) != "hello" {
+		t.Errorf("read %q", buf[:5])
+	}
+
+	cmd, buf = newTestCmd([]byte{scsi.ModeSense, 0, 0x3f, 0, 255, 0}, 255)
+	cmd.device = d
+	resp, err = EmulateModeSense(cmd, false)
+	checkGood(t, resp, err)
+	if buf[2]&0x80 == 0 {
+		t.Error("MODE SENSE doesn't report write protection")
+	}
+
+	d.scsi.Backend = store
+	if d.readOnly() {
+		t.Error("a writable backend is read-only")
+	}
+}
+
+func TestHandleCommandUnknown(t *testing.T) {
+	h := ReadWriterAtCmdHandler{RW: NewMemoryStore(testSizes.VolumeSize)}
+	cmd, _ := newTestCmd([]byte{0xc5, 0, 0, 0, 0, 0, 0, 0, 0, 0}, 0)
+	resp, _ := h.HandleCommand(cmd)
+	checkSense(t, resp, scsi.SenseIllegalRequest, scsi.AscInvalidCommandOperationCode)
+	if !resp.unknownOp {
+		t.Error("unknown opcode not flagged to the kernel")
+	}
+}
+
+func TestEmulateReadDefectData(t *testing.T) {
+	tests := []struct {
+		name string
+		cdb  []byte
+		want []byte
+	}{
+		{
+			"10 byte, both lists, long block",
+			[]byte{scsi.ReadDefectData, 0, 0x1b, 0, 0, 0, 0, 0, 0xff, 0},
+			[]byte{0, 0x1b, 0, 0},
+		},
+		{
+			"12 byte, grown list, physical sector",
+			[]byte{scsi.ReadDefectData12, 0x0d, 0, 0, 0, 0, 0, 0, 0, 0xff, 0, 0},
+			[]byte{0, 0x0d, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			"allocation length",
+			[]byte{scsi.ReadDefectData, 0, 0x18, 0, 0, 0, 0, 0, 2, 0},
+			[]byte{0, 0x18},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, buf := newTestCmd(tt.cdb, 16)
+			resp, err := EmulateReadDefectData(cmd)
+			checkGood(t, resp, err)
+			if got := buf[:len(tt.want)]; !bytes.Equal(got, tt.want) {
+				t.Errorf("got % x, want % x", got, tt.want)
+			}
+			if buf[len(tt.want)] != 0 {
+				t.Error("wrote past the allocation length")
+			}
+		})
+	}
+
+	cmd, _ := newTestCmd([]byte{scsi.ReadDefectData, 0, 0x07, 0, 0, 0, 0, 0, 0xff, 0}, 16)
+	resp, _ := EmulateReadDefectData(cmd)
+	checkSense(t, resp, scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb)
+}
+
+func TestTargetPortGroups(t *testing.T) {
+	h := ReadWriterAtCmdHandler{RW: NewMemoryStore(testSizes.VolumeSize)}
+	rtpg := []byte{scsi.MaintenanceIn, scsi.MiReportTargetPgs, 0, 0, 0, 0, 0, 0, 0, 64, 0, 0}
+	cmd, buf := newTestCmd(rtpg, 64)
+	d := cmd.Device()
+	resp, err := h.HandleCommand(cmd)
+	checkGood(t, resp, err)
+	want := []byte{0, 0, 0, 12, byte(ALUAActiveOptimized), aluaSupportedStates, 0, 1, 0, 0, 0, 1, 0, 0, 0, aluaRelativePort}
+	if !bytes.Equal(buf[:len(want)], want) {
+		t.Errorf("REPORT TARGET PORT GROUPS: % x, want % x", buf[:len(want)], want)
+	}
+
+	// Move the group to standby; medium access is then refused.
+	stpg := []byte{scsi.MaintenanceOut, scsi.MoSetTargetPgs, 0, 0, 0, 0, 0, 0, 0, 8, 0, 0}
+	cmd, buf = newTestCmd(stpg, 8)
+	cmd.device = d
+	copy(buf, []byte{0, 0, 0, 0, byte(ALUAStandby), 0, 0, 1})
+	resp, err = h.HandleCommand(cmd)
+	checkGood(t, resp, err)
+	if s := d.AccessState(); s != ALUAStandby {
+		t.Fatalf("access state %x after SET TARGET PORT GROUPS", s)
+	}
+	cmd, buf = newTestCmd(rtpg, 64)
+	cmd.device = d
+	resp, err = h.HandleCommand(cmd)
+	checkGood(t, resp, err)
+	if buf[4]&0x0f != byte(ALUAStandby) {
+		t.Errorf("reported state %x, want standby", buf[4])
+	}
+	cmd, _ = newTestCmd([]byte{scsi.Read10, 0, 0, 0, 0, 0, 0, 0, 1, 0}, int(testSizes.BlockSize))
+	cmd.device = d
+	resp, _ = h.HandleCommand(cmd)
+	checkSense(t, resp, scsi.SenseNotReady, scsi.AscTargetPortStandby)
+
+	d.SetAccessState(ALUAActiveNonOptimized)
+	cmd, _ = newTestCmd([]byte{scsi.Read10, 0, 0, 0, 0, 0, 0, 0, 1, 0}, int(testSizes.BlockSize))
+	cmd.device = d
+	resp, err = h.HandleCommand(cmd)
+	checkGood(t, resp, err)
+
+	// Offline can't be requested, nor can another group be changed.
+	for _, params := range [][]byte{
+		{0, 0, 0, 0, byte(ALUAOffline), 0, 0, 1},
+		{0, 0, 0, 0, byte(ALUAStandby), 0, 0, 2},
+	} {
+		cmd, buf = newTestCmd(stpg, 8)
+		cmd.device = d
+		copy(buf, params)
+		resp, _ = h.HandleCommand(cmd)
+		checkSense(t, resp, scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList)
+	}
+	// A parameter list length beyond the data sent is refused up front.
+	cmd, buf = newTestCmd([]byte{scsi.MaintenanceOut, scsi.MoSetTargetPgs, 0, 0, 0, 0, 0x7f, 0xff, 0xff, 0xfc, 0, 0}, 8)
+	cmd.device = d
+	copy(buf, []byte{0, 0, 0, 0, byte(ALUAStandby), 0, 0, 1})
+	resp, _ = EmulateSetTargetPortGroups(cmd)
+	checkSense(t, resp, scsi.SenseIllegalRequest, scsi.AscParameterListLengthError)
+	if s := d.AccessState(); s != ALUAActiveNonOptimized {
+		t.Errorf("access state %x after rejected SET TARGET PORT GROUPS", s)
+	}
+}
+
+func TestEmulatePersistentReserveIn(t *testing.T) {
+	readKeys := []byte{scsi.PersistentReserveIn, scsi.PriReadKeys, 0, 0, 0, 0, 0, 0, 64, 0}
+	readRes := []byte{scsi.PersistentReserveIn, scsi.PriReadReservation, 0, 0, 0, 0, 0, 0, 64, 0}
+
+	cmd, buf := newTestCmd(readKeys, 64)
+	d := cmd.Device()
+	resp, err := EmulatePersistentReserveIn(cmd)
+	checkGood(t, resp, err)
+	if !bytes.Equal(buf[:8], make([]byte, 8)) {
+		t.Errorf("READ KEYS with no registrations: % x", buf[:8])
+	}
+
+	d.state.pr = reservations{
+		generation: 3,
+		keys:       map[string]uint64{"b": 0x2222, "a": 0x1111},
+		reserved:   true,
+		holder:     "b",
+		resType:    prWriteExclusive,
+	}
+	cmd, buf = newTestCmd(readKeys, 64)
+	cmd.device = d
+	resp, err = EmulatePersistentReserveIn(cmd)
+	checkGood(t, resp, err)
+	want := []byte{0, 0, 0, 3, 0, 0, 0, 16, 0, 0, 0, 0, 0, 0, 0x11, 0x11, 0, 0, 0, 0, 0, 0, 0x22, 0x22}
+	if !bytes.Equal(buf[:len(want)], want) {
+		t.Errorf("READ KEYS: % x, want % x", buf[:len(want)], want)
+	}
+
+	cmd, buf = newTestCmd(readRes, 64)
+	cmd.device = d
+	resp, err = EmulatePersistentReserveIn(cmd)
+	checkGood(t, resp, err)
+	want = []byte{0, 0, 0, 3, 0, 0, 0, 16, 0, 0, 0, 0, 0, 0, 0x22, 0x22, 0, 0, 0, 0, 0, prWriteExclusive, 0, 0}
+	if !bytes.Equal(buf[:len(want)], want) {
+		t.Errorf("READ RESERVATION: % x, want % x", buf[:len(want)], want)
+	}
+
+	cmd, _ = newTestCmd([]byte{scsi.PersistentReserveIn, scsi.PriReadFullStatus, 0, 0, 0, 0, 0, 0, 64, 0}, 64)
+	resp, _ = EmulatePersistentReserveIn(cmd)
+	checkSense(t, resp, scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb)
+}
+
+func TestEmulatePersistentReserveOut(t *testing.T) {
+	h := ReadWriterAtCmdHandler{RW: NewMemoryStore(testSizes.VolumeSize)}
+	d := newTestDevice()
+	run := func(nexus string, cdb []byte, data []byte) SCSIResponse {
+		t.Helper()
+		cmd, buf := newTestCmd(cdb, len(data))
+		cmd.device, cmd.initiator = d, nexus
+		copy(buf, data)
+		resp, err := h.HandleCommand(cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	prOut := func(nexus string, sa, resType byte, key, saKey uint64) SCSIResponse {
+		t.Helper()
+		params := make([]byte, prOutParamLen)
+		binary.BigEndian.PutUint64(params[0:8], key)
+		binary.BigEndian.PutUint64(params[8:16], saKey)
+		return run(nexus, []byte{scsi.PersistentReserveOut, sa, resType, 0, 0, 0, 0, 0, prOutParamLen, 0}, params)
+	}
+	write := []byte{scsi.Write10, 0, 0, 0, 0, 0, 0, 0, 1, 0}
+	read := []byte{scsi.Read10, 0, 0, 0, 0, 0, 0, 0, 1, 0}
+	block := make([]byte, testSizes.BlockSize)
+	checkStatus := func(resp SCSIResponse, status byte) {
+		t.Helper()
+		if resp.status != status {
+			t.Errorf("status 0x%x, want 0x%x", resp.status, status)
+		}
+	}
+
+	// The parameter list must all be sent.
+	resp := run("a", []byte{scsi.PersistentReserveOut, scsi.ProRegister, 0, 0, 0, 0, 0, 0, prOutParamLen, 0}, make([]byte, 8))
+	checkSense(t, resp, scsi.SenseIllegalRequest, scsi.AscParameterListLengthError)
+
+	checkStatus(prOut("a", scsi.ProRegister, 0, 0, 0xa), scsi.SamStatGood)
+	checkStatus(prOut("b", scsi.ProRegister, 0, 0, 0xb), scsi.SamStatGood)
+	// Reserving needs the registered key.
+	checkStatus(prOut("a", scsi.ProReserve, prWriteExclusive, 0xb, 0), scsi.SamStatReservationConflict)
+	checkStatus(prOut("a", scsi.ProReserve, prWriteExclusive, 0xa, 0), scsi.SamStatGood)
+
+	// Only the holder may write, but anyone may read.
+	checkStatus(run("a", write, block), scsi.SamStatGood)
+	checkStatus(run("b", write, block), scsi.SamStatReservationConflict)
+	checkStatus(run("b", read, block), scsi.SamStatGood)
+	checkStatus(prOut("b", scsi.ProReserve, prWriteExclusive, 0xb, 0), scsi.SamStatReservationConflict)
+
+	// b preempts a, taking over the reservation.
+	checkStatus(prOut("b", scsi.ProPreempt, prExclusiveAccess, 0xb, 0xa), scsi.SamStatGood)
+	checkStatus(run("a", read, block), scsi.SamStatReservationConflict)
+	if _, ok := d.state.pr.keys["a"]; ok || d.state.pr.holder != "b" || d.state.pr.resType != prExclusiveAccess {
+		t.Errorf("after PREEMPT: %+v", d.state.pr)
+	}
+	checkSense(t, prOut("b", scsi.ProRelease, prWriteExclusive, 0xb, 0), scsi.SenseIllegalRequest, scsi.AscInvalidReleaseOfReservation)
+	checkStatus(prOut("b", scsi.ProRelease, prExclusiveAccess, 0xb, 0), scsi.SamStatGood)
+	checkStatus(run("a", write, block), scsi.SamStatGood)
+
+	// Unregistering by registering key zero, then CLEAR.
+	checkStatus(prOut("b", scsi.ProRegisterAndIgnoreExistingKey, 0, 0, 0), scsi.SamStatGood)
+	checkStatus(prOut("b", scsi.ProClear, 0, 0, 0), scsi.SamStatReservationConflict)
+	checkStatus(prOut("a", scsi.ProRegister, 0, 0, 0xa), scsi.SamStatGood)
+	checkStatus(prOut("a", scsi.ProClear, 0, 0xa, 0), scsi.SamStatGood)
+	if len(d.state.pr.keys) != 0 || d.state.pr.reserved {
+		t.Errorf("after CLEAR: %+v", d.state.pr)
+	}
+	// Registered a, b; preempted a; unregistered b; registered a; cleared.
+	if d.state.pr.generation != 6 {
+		t.Errorf("generation %d, want 6", d.state.pr.generation)
+	}
+}
+
+// TestPersistentReserveConcurrent reserves and releases from several nexuses at
+// once, as MultiThreadedDevReady's handlers would; run it with -race.
+func TestPersistentReserveConcurrent(t *testing.T) {
+	h := ReadWriterAtCmdHandler{RW: NewMemoryStore(testSizes.VolumeSize)}
+	d := newTestDevice()
+	run := func(nexus string, cdb []byte, data []byte) SCSIResponse {
+		cmd, buf := newTestCmd(cdb, len(data))
+		cmd.device, cmd.initiator = d, nexus
+		copy(buf, data)
+		resp, err := h.HandleCommand(cmd)
+		if err != nil {
+			t.Error(err)
+		}
+		return resp
+	}
+	prOut := func(nexus string, sa byte, key, saKey uint64) SCSIResponse {
+		params := make([]byte, prOutParamLen)
+		binary.BigEndian.PutUint64(params[0:8], key)
+		binary.BigEndian.PutUint64(params[8:16], saKey)
+		return run(nexus, []byte{scsi.PersistentReserveOut, sa, prWriteExclusive, 0, 0, 0, 0, 0, prOutParamLen, 0}, params)
+	}
+	write := []byte{scsi.Write10, 0, 0, 0, 0, 0, 0, 0, 1, 0}
+	readRes := []byte{scsi.PersistentReserveIn, scsi.PriReadReservation, 0, 0, 0, 0, 0, 0, 64, 0}
+	block := make([]byte, testSizes.BlockSize)
+
+	const nexuses = 4
+	var wg sync.WaitGroup
+	for i := 0; i < nexuses; i++ {
+		wg.Add(1)
+		go func(nexus string, key uint64) {
+			defer wg.Done()
+			if resp := prOut(nexus, scsi.ProRegister, 0, key); resp.status != scsi.SamStatGood {
+				t.Errorf("%s: REGISTER status 0x%x", nexus, resp.status)
+				return
+			}
+			for j := 0; j < 100; j++ {
+				reserved := prOut(nexus, scsi.ProReserve, key, 0).status == scsi.SamStatGood
+				resp := run(nexus, write, block)
+				if reserved && resp.status != scsi.SamStatGood {
+					t.Errorf("%s: write while holding the reservation: status 0x%x", nexus, resp.status)
+				}
+				run(nexus, readRes, make([]byte, 64))
+				d.SetAccessState(ALUAActiveOptimized)
+				d.WriteCacheEnabled()
+				if reserved {
+					if resp := prOut(nexus, scsi.ProRelease, key, 0); resp.status != scsi.SamStatGood {
+						t.Errorf("%s: RELEASE status 0x%x", nexus, resp.status)
+					}
+				}
+			}
+		}(fmt.Sprintf("nexus%d", i), uint64(i+1))
+	}
+	wg.Wait()
+
+	if d.state.pr.reserved || len(d.state.pr.keys) != nexuses {
+		t.Errorf("after releasing: %+v", d.state.pr)
+	}
+}
+
+// satStore is a MemoryStore standing in for a backend with a real ATA device.
+type satStore struct {
+	*MemoryStore
+}
+
+func (satStore) AtaPassThrough(cmd *SCSICmd) (SCSIResponse, error) {
+	return cmd.Ok(), nil
+}
+
+func TestHandleCommandAtaPassThrough(t *testing.T) {
+	cdb := []byte{scsi.AtaPassThrough16, 0x08, 0x0e, 0, 0, 0, 0x01, 0, 0, 0, 0, 0, 0, 0, 0xec, 0}
+	h := ReadWriterAtCmdHandler{RW: NewMemoryStore(testSizes.VolumeSize)}
+	cmd, _ := newTestCmd(cdb, 512)
+	resp, _ := h.HandleCommand(cmd)
+	checkSense(t, resp, scsi.SenseIllegalRequest, scsi.AscInvalidCommandOperationCode)
+	if resp.unknownOp {
+		t.Error("ATA PASS-THROUGH left to the kernel")
+	}
+
+	h.RW = satStore{NewMemoryStore(testSizes.VolumeSize)}
+	cmd, _ = newTestCmd(cdb, 512)
+	resp, err := h.HandleCommand(cmd)
+	checkGood(t, resp, err)
+}
+
+// plainStore is a MemoryStore with only the ReadWriterAt methods, none of the
+// optional backend interfaces.
+type plainStore struct {
+	ReadWriterAt
+}
+
+func TestHandledCommands(t *testing.T) {
+	for i, c := range handledCommands {
+		if i > 0 && c.op < handledCommands[i-1].op {
+			t.Errorf("0x%02x listed after 0x%02x", c.op, handledCommands[i-1].op)
+		}
+		if found := findCommand(c.op, c.sa); found != &handledCommands[i] {
+			t.Errorf("0x%02x/0x%02x dispatched to %+v", c.op, c.sa, found)
+		}
+	}
+
+	// PRE-FETCH and GET LBA STATUS work on any backend; ATA PASS-THROUGH
+	// needs a SatHandler, and isn't reported without one.
+	h := ReadWriterAtCmdHandler{RW: plainStore{NewMemoryStore(testSizes.VolumeSize)}}
+	cmd, _ := newTestCmd([]byte{scsi.PreFetch, 0, 0, 0, 0, 0, 0, 0, 1, 0}, 0)
+	resp, err := h.HandleCommand(cmd)
+	checkGood(t, resp, err)
+
+	cdb := make([]byte, 16)
+	cdb[0], cdb[1], cdb[13] = scsi.ServiceActionIn16, scsi.SaiGetLbaStatus, 64
+	cmd, buf := newTestCmd(cdb, 64)
+	resp, err = h.HandleCommand(cmd)
+	checkGood(t, resp, err)
+	blocks := uint32(testSizes.VolumeSize / testSizes.BlockSize)
+	if n := binary.BigEndian.Uint32(buf[0:4]); n != 4+16 {
+		t.Errorf("parameter data length %d, want one descriptor", n)
+	}
+	if lba, n := binary.BigEndian.Uint64(buf[8:16]), binary.BigEndian.Uint32(buf[16:20]); lba != 0 || n != blocks || buf[20] != 0 {
+		t.Errorf("descriptor lba %d blocks %d status %d, want all %d blocks mapped", lba, n, buf[20], blocks)
+	}
+
+	cmd, _ = newTestCmd([]byte{scsi.AtaPassThrough12, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, 0)
+	resp, _ = h.HandleCommand(cmd)
+	checkSense(t, resp, scsi.SenseIllegalRequest, scsi.AscInvalidCommandOperationCode)
+
+	cmd, buf = newTestCmd([]byte{scsi.MaintenanceIn, scsi.MiReportSupportedOperationCodes, 0, 0, 0, 0, 0, 0, 0x10, 0, 0, 0}, 0x1000)
+	resp, err = h.HandleCommand(cmd)
+	checkGood(t, resp, err)
+	listed := map[byte]bool{}
+	n := int(binary.BigEndian.Uint32(buf[0:4]))
+	for off := 4; off < 4+n; off += 8 {
+		listed[buf[off]] = true
+	}
+	for op, want := range map[byte]bool{scsi.PreFetch: true, scsi.PreFetch16: true, scsi.ServiceActionIn16: true, scsi.AtaPassThrough12: false} {
+		if listed[op] != want {
+			t.Errorf("0x%02x listed %v, want %v", op, listed[op], want)
+		}
+	}
+}
+
+func TestEmulateCompareAndWrite(t *testing.T) {
+	bs := int(testSizes.BlockSize)
+	store := NewMemoryStore(testSizes.VolumeSize)
+	cdb := make([]byte, 16)
+	cdb[0], cdb[9], cdb[13] = scsi.CompareAndWrite, 4, 1
+
+	// The backend is zeroed, so a zero compare block matches.
+	cmd, buf := newTestCmd(cdb, 2*bs)
+	for i := bs; i < 2*bs; i++ {
+		buf[i] = 0xaa
+	}
+	resp, err := EmulateCompareAndWrite(cmd, store)
+	checkGood(t, resp, err)
+	got := make([]byte, bs)
+	store.ReadAt(got, 4*int64(bs))
+	if !bytes.Equal(got, buf[bs:]) {
+		t.Fatal("block not written after a successful compare")
+	}
+
+	if n := cmd.Device().Stats().BytesWritten; n != uint64(bs) {
+		t.Errorf("%d bytes written, want %d", n, bs)
+	}
+
+	// Now it holds 0xaa, so comparing against zeros again fails.
+	cmd, buf = newTestCmd(cdb, 2*bs)
+	resp, _ = EmulateCompareAndWrite(cmd, store)
+	checkSense(t, resp, scsi.SenseMiscompare, scsi.AscMiscompareDuringVerifyOperation)
+
+	// FUA flushes the backend after the write.
+	flusher := &flushCounter{MemoryStore: NewMemoryStore(testSizes.VolumeSize)}
+	fua := append([]byte(nil), cdb...)
+	fua[1] = 0x08
+	cmd, _ = newTestCmd(fua, 2*bs)
+	resp, err = EmulateCompareAndWrite(cmd, flusher)
+	checkGood(t, resp, err)
+	if flusher.flushes != 1 {
+		t.Errorf("%d flushes with FUA, want 1", flusher.flushes)
+	}
+
+	// Only as many blocks as the Block Limits VPD page advertises.
+	long := append([]byte(nil), cdb...)
+	long[13] = maxCompareAndWriteBlocks + 1
+	cmd, _ = newTestCmd(long, 2*(maxCompareAndWriteBlocks+1)*bs)
+	resp, _ = EmulateCompareAndWrite(cmd, store)
+	checkSense(t, resp, scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb)
+}
+
+func TestEmulateReportLuns(t *testing.T) {
+	cmd, buf := newTestCmd([]byte{scsi.ReportLuns, 0, 0, 0, 0, 0, 0, 0, 0, 64, 0, 0}, 64)
+	cmd.Device().scsi.LUN = 3
+	resp, err := EmulateReportLuns(cmd)
+	checkGood(t, resp, err)
+	if got := binary.BigEndian.Uint32(buf[0:4]); got != 8 {
+		t.Errorf("LUN list length %d, want 8", got)
+	}
+	if buf[9] != 3 {
+		t.Errorf("LUN %d, want 3", buf[9])
+	}
+}
+
+func TestEmulateRequestSense(t *testing.T) {
+	cmd, buf := newTestCmd([]byte{scsi.RequestSense, 0, 0, 0, 18, 0}, 18)
+	resp, err := EmulateRequestSense(cmd)
+	checkGood(t, resp, err)
+	if buf[0] != 0x70 || buf[2] != scsi.SenseNoSense {
+		t.Errorf("no pending sense: got % x", buf[:14])
+	}
+
+	failed := cmd.MediumError()
+	dev := cmd.Device()
+	dev.setLastSense(failed.senseBuffer)
+	cmd, buf = newTestCmd([]byte{scsi.RequestSense, 0, 0, 0, 18, 0}, 18)
+	cmd.device = dev
+	resp, err = EmulateRequestSense(cmd)
+	checkGood(t, resp, err)
+	if !bytes.Equal(buf, failed.senseBuffer[:18]) {
+		t.Errorf("pending sense % x, want % x", buf, failed.senseBuffer[:18])
+	}
+}
+
+func TestReportPowerOn(t *testing.T) {
+	h := ReadWriterAtCmdHandler{RW: NewMemoryStore(testSizes.VolumeSize)}
+	cmd, _ := newTestCmd([]byte{scsi.Inquiry, 0, 0, 0, 96, 0}, 96)
+	dev := cmd.Device()
+	dev.state.unitAttention = true
+	resp, err := h.HandleCommand(cmd)
+	checkGood(t, resp, err)
+
+	cmd, _ = newTestCmd([]byte{scsi.TestUnitReady, 0, 0, 0, 0, 0}, 0)
+	cmd.device = dev
+	resp, _ = h.HandleCommand(cmd)
+	checkSense(t, resp, scsi.SenseUnitAttention, scsi.AscPowerOnReset)
+
+	cmd, _ = newTestCmd([]byte{scsi.TestUnitReady, 0, 0, 0, 0, 0}, 0)
+	cmd.device = dev
+	resp, err = h.HandleCommand(cmd)
+	checkGood(t, resp, err)
+
+	dev.state.unitAttention = true
+	cmd, buf := newTestCmd([]byte{scsi.RequestSense, 0, 0, 0, 18, 0}, 18)
+	cmd.device = dev
+	resp, err = h.HandleCommand(cmd)
+	checkGood(t, resp, err)
+	if key, asc := buf[2]&0x0f, binary.BigEndian.Uint16(buf[12:14]); key != scsi.SenseUnitAttention || asc != scsi.AscPowerOnReset {
+		t.Errorf("sense key 0x%x asc 0x%04x, want UNIT ATTENTION power on", key, asc)
+	}
+	if dev.takeUnitAttention() {
+		t.Error("REQUEST SENSE didn't clear the unit attention")
+	}
+}
+
+func TestEmulateLogSense(t *testing.T) {
+	cmd, buf := newTestCmd([]byte{scsi.LogSense, 0, 0x40, 0, 0, 0, 0, 0, 64, 0}, 64)
+	resp, err := EmulateLogSense(cmd)
+	checkGood(t, resp, err)
+	n := int(binary.BigEndian.Uint16(buf[2:4]))
+	if !bytes.Equal(buf[4:4+n], supportedLogPages) {
+		t.Errorf("pages % x, want % x", buf[4:4+n], supportedLogPages)
+	}
+
+	cmd, _ = newTestCmd([]byte{scsi.LogSense, 0, 0x40 | 0x0d, 0, 0, 0, 0, 0, 64, 0}, 64)
+	resp, _ = EmulateLogSense(cmd)
+	checkSense(t, resp, scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb)
+
+	// Default cumulative values are the same; there are no threshold values.
+	cmd, buf = newTestCmd([]byte{scsi.LogSense, 0, 0xc0 | 0x2f, 0, 0, 0, 0, 0, 64, 0}, 64)
+	resp, err = EmulateLogSense(cmd)
+	checkGood(t, resp, err)
+	if buf[0] != 0x2f {
+		t.Errorf("default cumulative page 0x%x, want 0x2f", buf[0])
+	}
+	for _, pc := range []byte{0x00, 0x80} {
+		cmd, _ = newTestCmd([]byte{scsi.LogSense, 0, pc | 0x2f, 0, 0, 0, 0, 0, 64, 0}, 64)
+		resp, _ = EmulateLogSense(cmd)
+		checkSense(t, resp, scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb)
+	}
+}
+
+func TestEmulateSendDiagnostic(t *testing.T) {
+	cmd, _ := newTestCmd([]byte{scsi.SendDiagnostic, 0x04, 0, 0, 0, 0}, 0)
+	resp, err := EmulateSendDiagnostic(cmd)
+	checkGood(t, resp, err)
+
+	cmd, _ = newTestCmd([]byte{scsi.SendDiagnostic, 0x02 << 5, 0, 0, 0, 0}, 0)
+	resp, err = EmulateSendDiagnostic(cmd)
+	checkGood(t, resp, err)
+
+	cmd, _ = newTestCmd([]byte{scsi.SendDiagnostic, 0x03 << 5, 0, 0, 0, 0}, 0)
+	resp, _ = EmulateSendDiagnostic(cmd)
+	checkSense(t, resp, scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb)
+
+	cmd, buf := newTestCmd([]byte{scsi.SendDiagnostic, 0x10, 0, 0, 4, 0}, 4)
+	copy(buf, []byte{0x00, 0, 0, 0})
+	resp, err = EmulateSendDiagnostic(cmd)
+	checkGood(t, resp, err)
+
+	cmd, buf = newTestCmd([]byte{scsi.SendDiagnostic, 0x10, 0, 0, 4, 0}, 4)
+	copy(buf, []byte{0x3f, 0, 0, 0})
+	resp, _ = EmulateSendDiagnostic(cmd)
+	checkSense(t, resp, scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList)
+
+	// Less data than the parameter list length.
+	cmd, _ = newTestCmd([]byte{scsi.SendDiagnostic, 0x10, 0, 0xff, 0xff, 0}, 4)
+	resp, err = EmulateSendDiagnostic(cmd)
+	if err != nil {
+		t.Fatalf("short parameter list: %v", err)
+	}
+	checkSense(t, resp, scsi.SenseIllegalRequest, scsi.AscParameterListLengthError)
+}
+
+func TestEmulateReceiveDiagnostic(t *testing.T) {
+	cmd, buf := newTestCmd([]byte{scsi.ReceiveDiagnostic, 0x01, 0x00, 0, 64, 0}, 64)
+	resp, err := EmulateReceiveDiagnostic(cmd)
+	checkGood(t, resp, err)
+	n := int(binary.BigEndian.Uint16(buf[2:4]))
+	if !bytes.Equal(buf[4:4+n], supportedDiagnosticPages) {
+		t.Errorf("pages % x, want % x", buf[4:4+n], supportedDiagnosticPages)
+	}
+
+	cmd, buf = newTestCmd([]byte{scsi.ReceiveDiagnostic, 0x01, 0x40, 0, 64, 0}, 64)
+	resp, err = EmulateReceiveDiagnostic(cmd)
+	checkGood(t, resp, err)
+	if buf[0] != 0x40 {
+		t.Errorf("page code 0x%02x, want 0x40", buf[0])
+	}
+
+	cmd, _ = newTestCmd([]byte{scsi.ReceiveDiagnostic, 0x01, 0x01, 0, 64, 0}, 64)
+	resp, _ = EmulateReceiveDiagnostic(cmd)
+	checkSense(t, resp, scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb)
+}
+
+func TestEmulateGetLbaStatus(t *testing.T) {
+	bs := testSizes.BlockSize
+	store := NewMemoryStore(testSizes.VolumeSize)
+	// Map the second chunk only.
+	store.WriteAt([]byte{1}, memoryChunkSize)
+
+	cdb := make([]byte, 16)
+	cdb[0], cdb[1], cdb[13] = scsi.ServiceActionIn16, scsi.SaiGetLbaStatus, 64
+	cmd, buf := newTestCmd(cdb, 64)
+	resp, err := EmulateGetLbaStatus(cmd, store)
+	checkGood(t, resp, err)
+
+	want := []struct {
+		lba, blocks uint64
+		status      byte
+	}{
+		{0, memoryChunkSize / uint64(bs), 1},
+		{memoryChunkSize / uint64(bs), memoryChunkSize / uint64(bs), 0},
+		{2 * memoryChunkSize / uint64(bs), uint64(testSizes.VolumeSize-2*memoryChunkSize) / uint64(bs), 1},
+	}
+	if got := binary.BigEndian.Uint32(buf[0:4]); got != uint32(4+16*len(want)) {
+		t.Fatalf("parameter data length %d", got)
+	}
+	for i, w := range want {
+		d := buf[8+16*i:]
+		lba, blocks := binary.BigEndian.Uint64(d[0:8]), uint64(binary.BigEndian.Uint32(d[8:12]))
+		if lba != w.lba || blocks != w.blocks || d[12] != w.status {
+			t.Errorf("descriptor %d: lba %d blocks %d status %d, want %+v", i, lba, blocks, d[12], w)
+		}
+	}
+
+	// An allocation length past the data buffer is bounded by it.
+	cdb[10], cdb[11], cdb[12], cdb[13] = 0xff, 0xff, 0xff, 0xff
+	cmd, buf = newTestCmd(cdb, 24)
+	resp, err = EmulateGetLbaStatus(cmd, store)
+	checkGood(t, resp, err)
+	if got := binary.BigEndian.Uint32(buf[0:4]); got != 4+16 {
+		t.Errorf("parameter data length %d, want one descriptor", got)
+	}
+}
+
+func TestEmulateFormatUnit(t *testing.T) {
+	store := NewMemoryStore(testSizes.VolumeSize)
+	store.WriteAt([]byte{0xff}, 4096)
+
+	// FMTDATA with a short parameter list header, IMMED clear.
+	cmd, _ := newTestCmd([]byte{scsi.FormatUnit, 0x10, 0, 0, 0, 0}, 4)
+	resp, err := EmulateFormatUnit(cmd, store)
+	checkGood(t, resp, err)
+	b := make([]byte, 1)
+	store.ReadAt(b, 4096)
+	if b[0] != 0 {
+		t.Error("device not zeroed by FORMAT UNIT")
+	}
+	if _, running := cmd.Device().taskState(); running {
+		t.Error("format still in progress after completion")
+	}
+}
+
+func TestFormatProgress(t *testing.T) {
+	const huge = 1 << 62
+	tests := []struct {
+		done, size int64
+		want       uint16
+	}{
+		{0, 4096, 0},
+		{2048, 4096, 0x7fff},
+		{4096, 4096, 0xffff},
+		{huge / 2, huge, 0x7fff},
+		{huge, huge, 0xffff},
+	}
+	for _, tt := range tests {
+		if got := formatProgress(tt.done, tt.size); got != tt.want {
+			t.Errorf("formatProgress(%d, %d) = 0x%04x, want 0x%04x", tt.done, tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestFormatInProgress(t *testing.T) {
+	h := ReadWriterAtCmdHandler{RW: NewMemoryStore(testSizes.VolumeSize)}
+	cmd, _ := newTestCmd([]byte{scsi.TestUnitReady, 0, 0, 0, 0, 0}, 0)
+	d := cmd.Device()
+	d.state.task = &backgroundTask{key: scsi.SenseNotReady, asc: scsi.AscFormatInProgress, progress: 0x8000}
+
+	resp, _ := h.HandleCommand(cmd)
+	checkSense(t, resp, scsi.SenseNotReady, scsi.AscFormatInProgress)
+	if sks := resp.senseBuffer[15:18]; sks[0] != 0x80 || binary.BigEndian.Uint16(sks[1:]) != 0x8000 {
+		t.Errorf("progress indication % x", sks)
+	}
+
+	cmd, buf := newTestCmd([]byte{scsi.RequestSense, 0, 0, 0, 18, 0}, 18)
+	cmd.device = d
+	resp, err := h.HandleCommand(cmd)
+	checkGood(t, resp, err)
+	if buf[2] != scsi.SenseNotReady || binary.BigEndian.Uint16(buf[16:18]) != 0x8000 {
+		t.Errorf("REQUEST SENSE during format: % x", buf)
+	}
+}
+
+// blockingFlusher is a MemoryStore whose Flush waits for release to be closed.
+type blockingFlusher struct {
+	*MemoryStore
+	release chan struct{}
+}
+
+func (f blockingFlusher) Flush() error {
+	<-f.release
+	return nil
+}
+
+func TestSynchronizeCacheImmed(t *testing.T) {
+	store := blockingFlusher{NewMemoryStore(testSizes.VolumeSize), make(chan struct{})}
+	h := ReadWriterAtCmdHandler{RW: store}
+	sync := []byte{scsi.SynchronizeCache, 0x02, 0, 0, 0, 0, 0, 0, 0, 0}
+	cmd, _ := newTestCmd(sync, 0)
+	d := cmd.Device()
+	resp, err := h.HandleCommand(cmd)
+	checkGood(t, resp, err)
+
+	// The flush doesn't make the unit NOT READY.
+	cmd, _ = newTestCmd([]byte{scsi.TestUnitReady, 0, 0, 0, 0, 0}, 0)
+	cmd.device = d
+	resp, err = h.HandleCommand(cmd)
+	checkGood(t, resp, err)
+
+	cmd, buf := newTestCmd([]byte{scsi.RequestSense, 0, 0, 0, 18, 0}, 18)
+	cmd.device = d
+	resp, err = h.HandleCommand(cmd)
+	checkGood(t, resp, err)
+	if buf[2] != scsi.SenseNoSense || binary.BigEndian.Uint16(buf[12:14]) != scsi.AscOperationInProgress || buf[15] != 0x80 {
+		t.Errorf("REQUEST SENSE during flush: % x", buf)
+	}
+
+	// Only one background task runs at a time.
+	cmd, _ = newTestCmd(sync, 0)
+	cmd.device = d
+	resp, _ = h.HandleCommand(cmd)
+	checkSense(t, resp, scsi.SenseNotReady, scsi.AscNotReadyOperationInProgress)
+
+	close(store.release)
+	for i := 0; ; i++ {
+		if _, running := d.taskState(); !running {
+			break
+		}
+		if i == 100 {
+			t.Fatal("flush still in progress after release")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// flushCounter is a MemoryStore that counts calls to Flush.
+type flushCounter struct {
+	*MemoryStore
+	flushes int
+}
+
+func (f *flushCounter) Flush() error {
+	f.flushes++
+	return nil
+}
+
+func TestEmulateReadWriteFUA(t *testing.T) {
+	bs := int(testSizes.BlockSize)
+	tests := []struct {
+		name    string
+		cdb     []byte
+		flushes int
+	}{
+		{"write10", []byte{scsi.Write10, 0, 0, 0, 0, 0, 0, 0, 1, 0}, 0},
+		{"write10 fua", []byte{scsi.Write10, 0x08, 0, 0, 0, 0, 0, 0, 1, 0}, 1},
+		{"write10 dpo", []byte{scsi.Write10, 0x10, 0, 0, 0, 0, 0, 0, 1, 0}, 0},
+		{"write16 fua", []byte{scsi.Write16, 0x08, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0}, 1},
+		// In the 6-byte form, byte 1 is part of the LBA.
+		{"write6", []byte{scsi.Write6, 0x08, 0, 0, 1, 0}, 0},
+		{"read10", []byte{scsi.Read10, 0, 0, 0, 0, 0, 0, 0, 1, 0}, 0},
+		{"read10 fua", []byte{scsi.Read10, 0x08, 0, 0, 0, 0, 0, 0, 1, 0}, 1},
+	}
+	h := ReadWriterAtCmdHandler{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &flushCounter{MemoryStore: NewMemoryStore(testSizes.VolumeSize)}
+			h.RW = store
+			cmd, _ := newTestCmd(tt.cdb, bs)
+			resp, err := h.HandleCommand(cmd)
+			checkGood(t, resp, err)
+			if store.flushes != tt.flushes {
+				t.Errorf("%d flushes, want %d", store.flushes, tt.flushes)
+			}
+		})
+	}
+}
+
+func TestNullHandler(t *testing.T) {
+	bs := int(testSizes.BlockSize)
+	cmd, buf := newTestCmd([]byte{scsi.Read10, 0, 0, 0, 0, 4, 0, 0, 2, 0}, 2*bs)
+	for i := range buf {
+		buf[i] = 0xff
+	}
+	resp, err := NullHandler{}.HandleCommand(cmd)
+	checkGood(t, resp, err)
+	if !bytes.Equal(buf, make([]byte, 2*bs)) {
+		t.Error("read returned non-zero data")
+	}
+
+	cmd, _ = newTestCmd([]byte{scsi.Write10, 0, 0, 0, 0, 4, 0, 0, 2, 0}, 2*bs)
+	resp, err = NullHandler{}.HandleCommand(cmd)
+	checkGood(t, resp, err)
+
+	cmd, buf = newTestCmd([]byte{scsi.ReadCapacity, 0, 0, 0, 0, 0, 0, 0, 0, 0}, 8)
+	resp, err = NullHandler{}.HandleCommand(cmd)
+	checkGood(t, resp, err)
+	if got := binary.BigEndian.Uint32(buf[4:8]); got != uint32(bs) {
+		t.Errorf("block size %d, want %d", got, bs)
+	}
+}
+
+func TestEmulatePreventAllowMediumRemoval(t *testing.T) {
+	cmd, _ := newTestCmd([]byte{scsi.AllowMediumRemoval, 0, 0, 0, 1, 0}, 0)
+	d := cmd.Device()
+	resp, err := EmulatePreventAllowMediumRemoval(cmd)
+	checkGood(t, resp, err)
+	if !d.MediumLocked() {
+		t.Fatal("medium not locked")
+	}
+
+	eject := &SCSICmd{cdb: []byte{scsi.StartStop, 0, 0, 0, 0x02, 0}, device: d}
+	resp, err = EmulateStartStop(eject)
+	checkSense(t, resp, scsi.SenseIllegalRequest, scsi.AscMediumRemovalPrevented)
+	if d.Stopped() {
+		t.Error("unit stopped by a refused eject")
+	}
+	// Stopping without ejecting is still allowed.
+	stop := &SCSICmd{cdb: []byte{scsi.StartStop, 0, 0, 0, 0, 0}, device: d}
+	resp, err = EmulateStartStop(stop)
+	checkGood(t, resp, err)
+
+	allow := &SCSICmd{cdb: []byte{scsi.AllowMediumRemoval, 0, 0, 0, 0, 0}, device: d}
+	resp, err = EmulatePreventAllowMediumRemoval(allow)
+	checkGood(t, resp, err)
+	resp, err = EmulateStartStop(eject)
+	checkGood(t, resp, err)
+
+	changer := &SCSICmd{cdb: []byte{scsi.AllowMediumRemoval, 0, 0, 0, 2, 0}, device: d}
+	resp, err = EmulatePreventAllowMediumRemoval(changer)
+	checkSense(t, resp, scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb)
+}
+
+// newVecsCmd returns a command for cdb with length bytes of data buffers, split
+// into iovecs of vecLen bytes, as the kernel hands out runs of its data area.
+func newVecsCmd(cdb []byte, length, vecLen int) *SCSICmd {
+	cmd, buf := newTestCmd(cdb, length)
+	cmd.vecs = nil
+	for len(buf) > 0 {
+		n := vecLen
+		if n > len(buf) {
+			n = len(buf)
+		}
+		cmd.vecs = append(cmd.vecs, buf[:n])
+		buf = buf[n:]
+	}
+	return cmd
+}
+
+// benchLayouts are the transfer sizes and iovec layouts the read and write
+// benchmarks run with.
+var benchLayouts = []struct {
+	name           string
+	length, vecLen int
+}{
+	{"4K", 4 << 10, 4 << 10},
+	{"128K/1vec", 128 << 10, 128 << 10},
+	{"128K/32vecs", 128 << 10, 4 << 10},
+	{"1M/256vecs", 1 << 20, 4 << 10},
+}
+
+func benchmarkEmulate(b *testing.B, op byte, rw ReadWriterAt) {
+	for _, l := range benchLayouts {
+		b.Run(l.name, func(b *testing.B) {
+			blocks := l.length / int(testSizes.BlockSize)
+			cmd := newVecsCmd([]byte{op, 0, 0, 0, 0, 0, 0, byte(blocks >> 8), byte(blocks), 0}, l.length, l.vecLen)
+			b.SetBytes(int64(l.length))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var resp SCSIResponse
+				if op == scsi.Read10 {
+					resp, _ = EmulateRead(cmd, rw)
+				} else {
+					resp, _ = EmulateWrite(cmd, rw)
+				}
+				if resp.status != scsi.SamStatGood {
+					b.Fatalf("status 0x%x", resp.status)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkEmulateRead(b *testing.B) {
+	benchmarkEmulate(b, scsi.Read10, NewMemoryStore(testSizes.VolumeSize))
+}
+
+func BenchmarkEmulateWrite(b *testing.B) {
+	benchmarkEmulate(b, scsi.Write10, NewMemoryStore(testSizes.VolumeSize))
+}
+
+func BenchmarkEmulateReadVectored(b *testing.B) {
+	benchmarkEmulate(b, scsi.Read10, &vectoredStore{MemoryStore: NewMemoryStore(testSizes.VolumeSize)})
+}
+
+func BenchmarkEmulateWriteVectored(b *testing.B) {
+	benchmarkEmulate(b, scsi.Write10, &vectoredStore{MemoryStore: NewMemoryStore(testSizes.VolumeSize)})
+}
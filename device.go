@@ -3,13 +3,18 @@
 package tcmu
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -20,23 +25,157 @@ import (
 )
 
 const (
+	coreDir      = "/sys/kernel/config/target/core"
 	configDirFmt = "/sys/kernel/config/target/core/user_%d"
 	scsiDir      = "/sys/kernel/config/target/loopback"
+	uioDir       = "/sys/class/uio"
+
+	// uioWaitTimeout bounds how long findDevice waits for the kernel to create
+	// the uio device after the backstore is enabled.
+	uioWaitTimeout = 10 * time.Second
+	// defaultDevEntryTimeout is used when SCSIHandler.DevEntryTimeout is zero.
+	defaultDevEntryTimeout = 30 * time.Second
+	// defaultQueueDepth is used when SCSIHandler.QueueDepth is zero.
+	defaultQueueDepth = 5
+	// defaultDevMode is used when SCSIHandler.DevMode is zero.
+	defaultDevMode os.FileMode = 0600
+	// removeTimeout bounds how long teardown retries configfs entries that are busy.
+	removeTimeout = 30 * time.Second
+
+	// supportedMailboxVersion is the TCMU mailbox layout struct_access.go decodes.
+	supportedMailboxVersion = 2
+	// mailboxSize covers the mailbox fields up to and including cmd_tail.
+	mailboxSize = 68
+)
+
+var (
+	// ErrDeviceExists is returned by OpenTCMUDevice when the device node it
+	// would create already exists, perhaps left behind by an earlier process.
+	// AttachTCMUDevice may be able to take the device over instead.
+	ErrDeviceExists = errors.New("Device already exists, can not create")
+	// ErrDeviceNotFound is returned by OpenTCMUDevice when the kernel doesn't
+	// create a block device for the LUN in time.
+	ErrDeviceNotFound = errors.New("Failed to find a block device")
+	// ErrTooManyDevices is returned by OpenTCMUDevice when more than one block
+	// device matches the LUN.
+	ErrTooManyDevices = errors.New("Too many block devices")
+	// ErrTCMUUnavailable is returned by CheckEnvironment, and so OpenTCMUDevice,
+	// when configfs or the TCMU kernel module is missing.
+	ErrTCMUUnavailable = errors.New("TCMU is not available")
 )
 
+// moduleDir is where the kernel lists the modules that are loaded.
+const moduleDir = "/sys/module"
+
+// CheckEnvironment reports whether the system can create TCMU devices: configfs
+// must be mounted with the target core loaded, and the target_core_user module
+// loaded. It touches nothing, so it can be called before deciding to create a
+// device. The errors wrap ErrTCMUUnavailable and say how to fix the problem.
+func CheckEnvironment() error {
+	if _, err := os.Stat(coreDir); err != nil {
+		return fmt.Errorf("%w: %s not found; mount configfs on /sys/kernel/config and run modprobe target_core_mod: %v", ErrTCMUUnavailable, coreDir, err)
+	}
+	if _, err := os.Stat(path.Join(moduleDir, "target_core_user")); err != nil {
+		return fmt.Errorf("%w: the target_core_user module is not loaded; run modprobe target_core_user: %v", ErrTCMUUnavailable, err)
+	}
+	return nil
+}
+
 type Device struct {
+	stats deviceStats
+
 	scsi    *SCSIHandler
 	devPath string
 
 	hbaDir     string
 	deviceName string
+	// toClean lists the paths OpenTCMUDevice created, in order, for rollback
+	// to remove if it fails partway.
+	toClean []string
+	// kernelName is the kernel's name for the block device, such as sdb; see
+	// KernelDeviceName.
+	kernelName string
 
 	uioFd    int
 	mapsize  uint64
 	mmap     []byte
 	cmdChan  chan *SCSICmd
 	respChan chan SCSIResponse
+	errChan  chan error
 	cmdTail  uint32
+
+	poller *Poller
+	kick   chan struct{}
+	// stopFd wakes waitUio when a device without a Poller is detached.
+	stopFd int
+
+	running  int32
+	done     chan struct{}
+	doneOnce sync.Once
+	// backendOnce makes sure Close flushes and closes the backend only once.
+	backendOnce sync.Once
+	// background tracks the work IMMED commands leave running after they
+	// complete, which Close waits for before closing the backend.
+	background sync.WaitGroup
+
+	// ctx is canceled by Close, and with it the contexts of the commands in
+	// flight, whose cancel functions are held by id; see SCSICmd.Context.
+	ctx       context.Context
+	cancelCtx context.CancelFunc
+	cmdMu     sync.Mutex
+	cancels   map[uint16]context.CancelFunc
+
+	// inFlight holds a token for each command dispatched and not yet
+	// completed, if SCSIHandler.MaxInFlight is set.
+	inFlight chan struct{}
+
+	atsLock lbaRangeLock
+
+	senseMu   sync.Mutex
+	lastSense []byte
+
+	// sizeMu guards scsi.DataSizes, which Resize may change while commands are in flight.
+	sizeMu sync.RWMutex
+
+	// state is what commands change about the logical unit, shared by the
+	// handlers MultiThreadedDevReady runs concurrently.
+	state deviceState
+
+	// modePages are the pages MODE SENSE and MODE SELECT work on, in page code
+	// order; see RegisterModePage.
+	modePagesMu sync.Mutex
+	modePages   []ModePageHandler
+}
+
+// deviceState is the logical unit state set by commands. Its fields are only
+// accessed holding mu, through Device's methods, or by the emulation of the
+// commands that own them.
+type deviceState struct {
+	mu sync.RWMutex
+
+	// Power and medium state, set by START STOP UNIT, and whether removal of
+	// the medium is prevented by PREVENT ALLOW MEDIUM REMOVAL.
+	stopped bool
+	ejected bool
+	locked  bool
+
+	// wce is the current write cache setting.
+	wce bool
+
+	// unitAttention is a pending power on UNIT ATTENTION; see
+	// SCSIHandler.ReportPowerOn.
+	unitAttention bool
+
+	// alua is the access state of the target port group; see SetAccessState.
+	alua ALUAState
+
+	// task is the background operation in progress, if any, and deferred the
+	// error of one that failed, still to be reported; see runTask.
+	task     *backgroundTask
+	deferred *Sense
+
+	// pr is the persistent reservation state; see EmulatePersistentReserveIn.
+	pr reservations
 }
 
 // WWN provides two WWNs, one for the device itself and one for the loopback
@@ -46,48 +185,479 @@ type WWN interface {
 	NexusID() string
 }
 
+// validateWWN checks the handler's WWN, if it knows how to check itself, so that
+// a misconfigured one is reported before anything is created.
+func validateWWN(w WWN) error {
+	if w == nil {
+		return errors.New("No WWN configured")
+	}
+	if v, ok := w.(interface {
+		Validate() error
+	}); ok {
+		return v.Validate()
+	}
+	return nil
+}
+
+// setLastSense records the sense data of the most recently failed command, so
+// a following REQUEST SENSE can report it.
+func (d *Device) setLastSense(sense []byte) {
+	d.senseMu.Lock()
+	defer d.senseMu.Unlock()
+	d.lastSense = sense
+}
+
+// takeLastSense returns and clears the recorded sense data, if any.
+func (d *Device) takeLastSense() []byte {
+	d.senseMu.Lock()
+	defer d.senseMu.Unlock()
+	s := d.lastSense
+	d.lastSense = nil
+	return s
+}
+
+// Stopped reports whether the logical unit has been stopped by START STOP UNIT.
+func (d *Device) Stopped() bool {
+	d.state.mu.RLock()
+	defer d.state.mu.RUnlock()
+	return d.state.stopped
+}
+
+// startStop starts or stops the logical unit, and with loej loads or ejects the
+// medium. It returns false without changing anything if the medium can't be
+// ejected because its removal is prevented.
+func (d *Device) startStop(start, loej bool) bool {
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+	if loej && !start && d.state.locked {
+		return false
+	}
+	d.state.stopped = !start
+	if loej {
+		d.state.ejected = !start
+	}
+	return true
+}
+
+// MediumLocked reports whether an initiator has prevented removal of the medium
+// with PREVENT ALLOW MEDIUM REMOVAL.
+func (d *Device) MediumLocked() bool {
+	d.state.mu.RLock()
+	defer d.state.mu.RUnlock()
+	return d.state.locked
+}
+
+func (d *Device) setMediumLocked(locked bool) {
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+	d.state.locked = locked
+}
+
+// readOnly reports whether the device is write protected: set ReadOnly, or a
+// Backend that can't be written.
+func (d *Device) readOnly() bool {
+	if d.scsi.ReadOnly {
+		return true
+	}
+	if d.scsi.Backend == nil {
+		return false
+	}
+	_, reader := d.scsi.Backend.(io.ReaderAt)
+	_, writer := d.scsi.Backend.(io.WriterAt)
+	return reader && !writer
+}
+
+// WriteCacheEnabled reports whether the write cache is currently enabled, as
+// reported by MODE SENSE and set by MODE SELECT.
+func (d *Device) WriteCacheEnabled() bool {
+	d.state.mu.RLock()
+	defer d.state.mu.RUnlock()
+	return d.state.wce
+}
+
+// takeUnitAttention returns and clears the pending UNIT ATTENTION condition.
+func (d *Device) takeUnitAttention() bool {
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+	ua := d.state.unitAttention
+	d.state.unitAttention = false
+	return ua
+}
+
+func (d *Device) setWriteCacheEnabled(wce bool) {
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+	d.state.wce = wce
+}
+
 func (d *Device) GetDevConfig() string {
 	return fmt.Sprintf("go-tcmu//%s", d.scsi.VolumeName)
 }
 
 func (d *Device) Sizes() DataSizes {
+	d.sizeMu.RLock()
+	defer d.sizeMu.RUnlock()
 	return d.scsi.DataSizes
 }
 
+// Resize grows the device to newSize bytes while it is open. The kernel is told the
+// new size through configfs and the SCSI device is rescanned, so the OS sees the
+// new capacity. Shrinking is not supported.
+func (d *Device) Resize(newSize int64) error {
+	sizes := d.Sizes()
+	if newSize < sizes.VolumeSize {
+		return fmt.Errorf("Cannot shrink %s from %d to %d bytes", d.scsi.VolumeName, sizes.VolumeSize, newSize)
+	}
+	if newSize%sizes.BlockSize != 0 {
+		return fmt.Errorf("New size %d is not a multiple of the block size %d", newSize, sizes.BlockSize)
+	}
+	err := writeLines(path.Join(d.hbaDir, d.scsi.VolumeName, "control"), []string{
+		fmt.Sprintf("dev_size=%d", newSize),
+	})
+	if err != nil {
+		return err
+	}
+	d.sizeMu.Lock()
+	d.scsi.DataSizes.VolumeSize = newSize
+	d.sizeMu.Unlock()
+	return d.rescan()
+}
+
+// rescan asks the kernel SCSI layer to re-read the device's capacity. Remote
+// initiators must rescan for themselves.
+func (d *Device) rescan() error {
+	if !d.fabric().Local() {
+		return nil
+	}
+	address, err := ioutil.ReadFile(path.Join(d.fabric().TPGPath(d.scsi), "address"))
+	if err != nil {
+		return err
+	}
+	// The loopback address is host:channel:target; the device adds the LUN.
+	rescan := fmt.Sprintf("/sys/bus/scsi/devices/%s:%d/rescan", strings.TrimSpace(string(address)), d.scsi.LUN)
+	logrus.Debugf("Rescanning %s", rescan)
+	return ioutil.WriteFile(rescan, []byte("1\n"), 0200)
+}
+
 // OpenTCMUDevice creates the virtual device based on the details in the SCSIHandler, eventually creating a device under devPath (eg, "/dev") with the file name scsi.VolumeName.
 // The returned Device represents the open device connection to the kernel, and must be closed.
+// If scsi.HBA is zero, an unused HBA number is chosen with AllocateHBA and stored back in scsi.HBA.
+// CheckEnvironment and scsi.Validate are checked first, so that a missing kernel module or a
+// misconfigured handler is reported before any configfs state is created. If creating the
+// device fails partway, what was created is removed again, so the call can be retried.
 func OpenTCMUDevice(devPath string, scsi *SCSIHandler) (*Device, error) {
+	return OpenTCMUDeviceContext(context.Background(), devPath, scsi)
+}
+
+// OpenTCMUDeviceContext is like OpenTCMUDevice, but stops waiting for the block
+// device to appear if ctx is canceled.
+func OpenTCMUDeviceContext(ctx context.Context, devPath string, scsi *SCSIHandler) (*Device, error) {
+	if err := CheckEnvironment(); err != nil {
+		return nil, err
+	}
+	if err := scsi.Validate(); err != nil {
+		return nil, err
+	}
+	if scsi.HBA == 0 {
+		hba, err := AllocateHBA()
+		if err != nil {
+			return nil, err
+		}
+		scsi.HBA = hba
+	}
 	d := &Device{
 		scsi:    scsi,
 		devPath: devPath,
 		uioFd:   -1,
+		stopFd:  -1,
 		hbaDir:  fmt.Sprintf(configDirFmt, scsi.HBA),
+		poller:  scsi.Poller,
+		state: deviceState{
+			wce:           scsi.WriteCacheEnabled,
+			unitAttention: scsi.ReportPowerOn,
+		},
 	}
 	err := d.Close()
 	if err != nil {
 		return nil, err
 	}
-	if err := d.preEnableTcmu(); err != nil {
+	if err := d.create(ctx); err != nil {
+		if rerr := d.rollback(); rerr != nil {
+			return nil, fmt.Errorf("%w (rolling back: %v)", err, rerr)
+		}
+		return nil, err
+	}
+	return d, nil
+}
+
+// create sets up the backstore, starts serving it and exports it, recording what
+// it creates in toClean for rollback.
+func (d *Device) create(ctx context.Context) error {
+	backstore := missing(d.hbaDir, path.Join(d.hbaDir, d.scsi.VolumeName))
+	err := d.preEnableTcmu()
+	d.recordCreated(backstore)
+	if err != nil {
+		return err
+	}
+	if err := d.start(); err != nil {
+		return err
+	}
+	return d.postEnableTcmu(ctx)
+}
+
+// missing returns those of paths that don't exist, to be passed to
+// recordCreated once the step that may create them has run.
+func missing(paths ...string) []string {
+	var out []string
+	for _, p := range paths {
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// recordCreated adds those of paths that now exist to toClean, in order.
+func (d *Device) recordCreated(paths []string) {
+	for _, p := range paths {
+		if _, err := os.Lstat(p); err == nil {
+			d.toClean = append(d.toClean, p)
+		}
+	}
+}
+
+// rollback undoes a failed OpenTCMUDevice: it stops serving the device and
+// removes what create made, newest first, leaving anything that was already
+// there, such as a target shared with other devices or a device node left by
+// another process, in place.
+func (d *Device) rollback() error {
+	if d.poller != nil && d.uioFd != -1 {
+		d.poller.remove(d)
+	}
+	deadline := time.Now().Add(removeTimeout)
+	var failed []string
+	for i := len(d.toClean) - 1; i >= 0; i-- {
+		if err := remove(d.toClean[i], deadline); err != nil {
+			failed = append(failed, fmt.Sprintf("%s (%v)", d.toClean[i], err))
+		}
+	}
+	d.toClean = nil
+	if d.uioFd != -1 {
+		unix.Close(d.uioFd)
+		d.uioFd = -1
+	}
+	if d.stopFd != -1 {
+		unix.Close(d.stopFd)
+		d.stopFd = -1
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Unable to remove %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// AttachTCMUDevice resumes serving a device previously created by OpenTCMUDevice
+// and left in place by Detach, or by a process that exited without closing it.
+// The configfs backstore, uio device and block device are reused as they are, and
+// commands the kernel queued in the meantime are picked up from the ring. If
+// scsi.HBA is zero, the HBA holding scsi.VolumeName is looked up and stored back
+// in scsi.HBA.
+func AttachTCMUDevice(devPath string, scsi *SCSIHandler) (*Device, error) {
+	if err := scsi.Validate(); err != nil {
+		return nil, err
+	}
+	if scsi.HBA == 0 {
+		hba, err := findHBA(scsi.VolumeName)
+		if err != nil {
+			return nil, err
+		}
+		scsi.HBA = hba
+	}
+	d := &Device{
+		scsi:    scsi,
+		devPath: devPath,
+		uioFd:   -1,
+		stopFd:  -1,
+		hbaDir:  fmt.Sprintf(configDirFmt, scsi.HBA),
+		poller:  scsi.Poller,
+		state:   deviceState{wce: scsi.WriteCacheEnabled},
+	}
+	if _, err := os.Stat(path.Join(d.hbaDir, scsi.VolumeName)); err != nil {
 		return nil, err
 	}
 	if err := d.start(); err != nil {
 		return nil, err
 	}
+	return d, nil
+}
 
-	return d, d.postEnableTcmu()
+// findHBA returns the user HBA number whose configfs directory holds the backstore vol.
+func findHBA(vol string) (int, error) {
+	matches, err := filepath.Glob(path.Join(coreDir, "user_*", vol))
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range matches {
+		n, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(filepath.Dir(m)), "user_"))
+		if err == nil {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("Failed to find a user backstore named %s", vol)
+}
+
+// AllocateHBA returns the lowest user HBA number, starting from 1, that has no
+// user_N directory in configfs.
+func AllocateHBA() (int, error) {
+	entries, err := ioutil.ReadDir(coreDir)
+	if err != nil {
+		return 0, err
+	}
+	used := make(map[int]bool)
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), "user_") {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(e.Name(), "user_"))
+		if err != nil {
+			continue
+		}
+		used[n] = true
+	}
+	hba := 1
+	for used[hba] {
+		hba++
+	}
+	return hba, nil
+}
+
+// Err returns a channel that receives the error that stopped the device's polling
+// goroutines, if they stop on their own rather than through Close. The device no
+// longer processes commands after an error is delivered, but must still be closed.
+func (d *Device) Err() <-chan error {
+	return d.errChan
+}
+
+// fail reports a terminal error from one of the polling goroutines.
+func (d *Device) fail(err error) {
+	select {
+	case d.errChan <- err:
+	default:
+	}
+}
+
+// Done returns a channel that is closed once the device's polling goroutines have
+// exited, whether because of an error or because the device was closed.
+func (d *Device) Done() <-chan struct{} {
+	return d.done
+}
+
+// Wait blocks until the device's polling goroutines have exited.
+func (d *Device) Wait() {
+	<-d.done
 }
 
+// pollerExited is called as each polling goroutine returns.
+func (d *Device) pollerExited() {
+	if atomic.AddInt32(&d.running, -1) == 0 {
+		d.doneOnce.Do(func() { close(d.done) })
+	}
+}
+
+// Close stops serving the device and removes it. The contexts of commands already
+// handed to the handler are canceled and the commands waited for, along with the
+// work IMMED commands such as FORMAT UNIT left running, and then
+// SCSIHandler.Backend is flushed and closed before the device is torn down. An
+// error flushing or closing the backend is returned once the device is gone.
 func (d *Device) Close() error {
+	if d.cancelCtx != nil {
+		d.cancelCtx()
+	}
+	d.stopPolling()
+	if d.poller != nil {
+		d.poller.remove(d)
+	}
+	d.background.Wait()
+	var berr error
+	if d.done != nil {
+		d.backendOnce.Do(func() { berr = d.closeBackend() })
+	}
 	err := d.teardown()
+	if d.uioFd != -1 {
+		unix.Close(d.uioFd)
+		d.uioFd = -1
+	}
+	if d.stopFd != -1 {
+		unix.Close(d.stopFd)
+		d.stopFd = -1
+	}
 	if err != nil {
+		if berr != nil {
+			return fmt.Errorf("%w (closing backend: %v)", err, berr)
+		}
 		return err
 	}
-	if d.uioFd != -1 {
-		unix.Close(d.uioFd)
+	return berr
+}
+
+// stopPolling stops taking commands off the ring and waits for those already
+// handed to the handler to complete. It does nothing if the device was never
+// started, or has already stopped.
+func (d *Device) stopPolling() error {
+	if d.done == nil {
+		return nil
 	}
+	select {
+	case <-d.done:
+		return nil
+	default:
+	}
+	if d.poller != nil {
+		d.poller.remove(d)
+	} else {
+		buf := []byte{1, 0, 0, 0, 0, 0, 0, 0}
+		if _, err := unix.Write(d.stopFd, buf); err != nil {
+			return err
+		}
+	}
+	<-d.done
 	return nil
 }
 
+// closeBackend flushes SCSIHandler.Backend and closes it if it is an io.Closer.
+func (d *Device) closeBackend() error {
+	b := d.scsi.Backend
+	if b == nil {
+		return nil
+	}
+	err := flushBackend(b)
+	if c, ok := b.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Detach stops processing commands and releases the ring, but leaves the kernel
+// device in place, so that AttachTCMUDevice can resume serving it, for example
+// from a newer version of the process. It waits for commands already handed to
+// the handler to complete. While detached, I/O to the device queues in the kernel.
+func (d *Device) Detach() error {
+	if err := d.stopPolling(); err != nil {
+		return err
+	}
+	err := unix.Munmap(d.mmap)
+	d.mmap = nil
+	unix.Close(d.uioFd)
+	d.uioFd = -1
+	if d.stopFd != -1 {
+		unix.Close(d.stopFd)
+		d.stopFd = -1
+	}
+	return err
+}
+
 func (d *Device) preEnableTcmu() error {
 	err := writeLines(path.Join(d.hbaDir, d.scsi.VolumeName, "control"), []string{
 		fmt.Sprintf("dev_size=%d", d.scsi.DataSizes.VolumeSize),
@@ -98,85 +668,165 @@ func (d *Device) preEnableTcmu() error {
 	if err != nil {
 		return err
 	}
+	d.enableTMRNotification()
 
-	return writeLines(path.Join(d.hbaDir, d.scsi.VolumeName, "enable"), []string{
+	err = writeLines(path.Join(d.hbaDir, d.scsi.VolumeName, "enable"), []string{
 		"1",
 	})
+	if err != nil {
+		return err
+	}
+	d.setOptimalSectors()
+	return nil
 }
 
-func (d *Device) getSCSIPrefixAndWnn() (string, string) {
-	return path.Join(scsiDir, d.scsi.WWN.DeviceID(), "tpgt_1"), d.scsi.WWN.NexusID()
+// enableTMRNotification asks the kernel to queue task management functions on
+// the ring, for handleTMR. Kernels without the attribute don't, and aborted
+// commands just complete as usual.
+func (d *Device) enableTMRNotification() {
+	attr := path.Join(d.hbaDir, d.scsi.VolumeName, "attrib", "tmr_notification")
+	if _, err := os.Stat(attr); err != nil {
+		return
+	}
+	if err := ioutil.WriteFile(attr, []byte("1\n"), 0644); err != nil {
+		logrus.Warnf("Failed to enable task management notification: %v", err)
+	}
+}
+
+// setOptimalSectors passes OptimalIOSize on to the backstore's optimal_sectors
+// attribute, in blocks, where the kernel exposes it. The attribute is bounded by
+// the backstore's maximum transfer, so failing to set it is only logged; SCSI
+// initiators learn the size from the Block Limits VPD page regardless.
+func (d *Device) setOptimalSectors() {
+	if d.scsi.OptimalIOSize == 0 {
+		return
+	}
+	attr := path.Join(d.hbaDir, d.scsi.VolumeName, "attrib", "optimal_sectors")
+	if _, err := os.Stat(attr); err != nil {
+		return
+	}
+	sectors := d.scsi.OptimalIOSize / d.scsi.DataSizes.BlockSize
+	if err := ioutil.WriteFile(attr, []byte(fmt.Sprintf("%d\n", sectors)), 0644); err != nil {
+		logrus.Warnf("Failed to set optimal_sectors to %d: %v", sectors, err)
+	}
+}
+
+// fabric returns the Fabric the device is exported through.
+func (d *Device) fabric() Fabric {
+	if d.scsi.Fabric != nil {
+		return d.scsi.Fabric
+	}
+	return LoopbackFabric{}
+}
+
+// initiator returns the name of the I_T nexus commands come in on. TCMU command
+// entries don't say which initiator sent them, so all are taken to come from the
+// same one: on the loopback fabric, its only nexus.
+func (d *Device) initiator() string {
+	if f, ok := d.fabric().(LoopbackFabric); ok {
+		return f.nexus(d.scsi)
+	}
+	return ""
 }
 
 func (d *Device) getLunPath(prefix string) string {
 	return path.Join(prefix, "lun", fmt.Sprintf("lun_%d", d.scsi.LUN))
 }
 
-func (d *Device) postEnableTcmu() error {
-	prefix, nexusWnn := d.getSCSIPrefixAndWnn()
-
-	err := writeLines(path.Join(prefix, "nexus"), []string{
-		nexusWnn,
-	})
+func (d *Device) postEnableTcmu(ctx context.Context) error {
+	// Paths lists the fabric's directories in removal order, so they're
+	// created in reverse.
+	fabricPaths := d.fabric().Paths(d.scsi)
+	for i, j := 0, len(fabricPaths)-1; i < j; i, j = i+1, j-1 {
+		fabricPaths[i], fabricPaths[j] = fabricPaths[j], fabricPaths[i]
+	}
+	fabricPaths = missing(fabricPaths...)
+	err := d.fabric().Setup(d.scsi)
+	d.recordCreated(fabricPaths)
 	if err != nil {
 		return err
 	}
 
-	lunPath := d.getLunPath(prefix)
+	lunPath := d.getLunPath(d.fabric().TPGPath(d.scsi))
 	logrus.Debugf("Creating directory: %s", lunPath)
-	if err := os.MkdirAll(lunPath, 0755); err != nil && !os.IsExist(err) {
+	lunPaths := missing(lunPath)
+	err = os.MkdirAll(lunPath, 0755)
+	d.recordCreated(lunPaths)
+	if err != nil && !os.IsExist(err) {
 		return err
 	}
 
-	logrus.Debugf("Linking: %s => %s", path.Join(lunPath, d.scsi.VolumeName), path.Join(d.hbaDir, d.scsi.VolumeName))
-	if err := os.Symlink(path.Join(d.hbaDir, d.scsi.VolumeName), path.Join(lunPath, d.scsi.VolumeName)); err != nil {
+	link := path.Join(lunPath, d.scsi.VolumeName)
+	logrus.Debugf("Linking: %s => %s", link, path.Join(d.hbaDir, d.scsi.VolumeName))
+	if err := os.Symlink(path.Join(d.hbaDir, d.scsi.VolumeName), link); err != nil {
 		return err
 	}
+	d.toClean = append(d.toClean, link)
 
-	return d.createDevEntry()
+	if !d.fabric().Local() {
+		return nil
+	}
+	return d.createDevEntry(ctx)
 }
 
-func (d *Device) createDevEntry() error {
+func (d *Device) createDevEntry(ctx context.Context) error {
+	devPaths := missing(d.devPath)
 	os.MkdirAll(d.devPath, 0755)
+	d.recordCreated(devPaths)
 
 	dev := filepath.Join(d.devPath, d.scsi.VolumeName)
 
 	if _, err := os.Stat(dev); err == nil {
-		return fmt.Errorf("Device %s already exists, can not create", dev)
+		return fmt.Errorf("%w: %s", ErrDeviceExists, dev)
 	}
 
-	tgt, _ := d.getSCSIPrefixAndWnn()
-
-	address, err := ioutil.ReadFile(path.Join(tgt, "address"))
+	address, err := ioutil.ReadFile(path.Join(d.fabric().TPGPath(d.scsi), "address"))
 	if err != nil {
 		return err
 	}
 
-	found := false
-	matches := []string{}
+	timeout := d.scsi.DevEntryTimeout
+	if timeout == 0 {
+		timeout = defaultDevEntryTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Our SCSI device is named after the loopback address plus the LUN.
+	want := fmt.Sprintf("%s:%d", strings.TrimSpace(string(address)), d.scsi.LUN)
 	path := fmt.Sprintf("/sys/bus/scsi/devices/%s*/block/*/dev", strings.TrimSpace(string(address)))
-	for i := 0; i < 30; i++ {
-		var err error
-		matches, err = filepath.Glob(path)
-		if len(matches) > 0 && err == nil {
-			found = true
+	delay := 50 * time.Millisecond
+	var matches []string
+	for {
+		all, err := filepath.Glob(path)
+		if err != nil {
+			return err
+		}
+		// The glob also catches targets whose number merely starts with ours,
+		// so keep only the entries under our own SCSI device.
+		matches = matches[:0]
+		for _, m := range all {
+			if filepath.Base(filepath.Dir(filepath.Dir(filepath.Dir(m)))) == want {
+				matches = append(matches, m)
+			}
+		}
+		if len(matches) > 0 {
 			break
 		}
 
 		logrus.Debugf("Waiting for %s", path)
-		time.Sleep(1 * time.Second)
-	}
-
-	if !found {
-		return fmt.Errorf("Failed to find %s", path)
-	}
-
-	if len(matches) == 0 {
-		return fmt.Errorf("Failed to find %s", path)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %s: %v", ErrDeviceNotFound, path, ctx.Err())
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > 2*time.Second {
+			delay = 2 * time.Second
+		}
 	}
 
 	if len(matches) > 1 {
-		return fmt.Errorf("Too many matches for %s, found %d", path, len(matches))
+		return fmt.Errorf("%w: %s, found %d", ErrTooManyDevices, path, len(matches))
 	}
 
 	majorMinor, err := ioutil.ReadFile(matches[0])
@@ -199,11 +849,43 @@ func (d *Device) createDevEntry() error {
 	}
 
 	logrus.Debugf("Creating device %s %d:%d", dev, major, minor)
-	return mknod(dev, major, minor)
+	if err := mknod(dev, major, minor); err != nil {
+		return err
+	}
+	d.toClean = append(d.toClean, dev)
+	// The mode passed to mknod is subject to the umask, so set it explicitly.
+	if err := os.Chmod(dev, d.scsi.devMode()); err != nil {
+		return err
+	}
+	if d.scsi.DevUID != 0 || d.scsi.DevGID != 0 {
+		if err := os.Chown(dev, d.scsi.DevUID, d.scsi.DevGID); err != nil {
+			return err
+		}
+	}
+	// matches[0] is .../block/<name>/dev.
+	d.kernelName = filepath.Base(filepath.Dir(matches[0]))
+	return nil
+}
+
+// BlockDevicePath returns the path of the block device node created for the
+// device, under the devPath it was opened with. It is empty if the device is
+// exported through a remote fabric, which creates no local node.
+func (d *Device) BlockDevicePath() string {
+	if !d.fabric().Local() {
+		return ""
+	}
+	return filepath.Join(d.devPath, d.scsi.VolumeName)
+}
+
+// KernelDeviceName returns the kernel's name for the block device, such as sdb,
+// as found in sysfs when the device was opened. It is empty for devices resumed
+// with AttachTCMUDevice, or exported through a remote fabric.
+func (d *Device) KernelDeviceName() string {
+	return d.kernelName
 }
 
 func mknod(device string, major, minor int) error {
-	var fileMode os.FileMode = 0600
+	var fileMode os.FileMode = defaultDevMode
 	fileMode |= syscall.S_IFBLK
 	dev := int((major << 8) | (minor & 0xff) | ((minor & 0xfff00) << 12))
 
@@ -238,50 +920,81 @@ func (d *Device) start() (err error) {
 	if err != nil {
 		return
 	}
-	d.cmdChan = make(chan *SCSICmd, 5)
-	d.respChan = make(chan SCSIResponse, 5)
+	d.cmdChan = make(chan *SCSICmd, d.scsi.queueDepth())
+	d.respChan = make(chan SCSIResponse, d.scsi.queueDepth())
+	d.errChan = make(chan error, 2)
+	d.done = make(chan struct{})
+	d.ctx, d.cancelCtx = context.WithCancel(context.Background())
+	if d.scsi.MaxInFlight > 0 {
+		d.inFlight = make(chan struct{}, d.scsi.MaxInFlight)
+	}
+	// beginPoll and recvResponse
+	d.running = 2
+	if d.poller != nil {
+		if err = d.poller.add(d); err != nil {
+			return
+		}
+	} else if d.stopFd, err = unix.Eventfd(0, unix.EFD_CLOEXEC); err != nil {
+		return
+	}
 	go d.beginPoll()
 	d.scsi.DevReady(d.cmdChan, d.respChan)
 	return
 }
 
+// findDevice waits for the uio device the kernel creates for our backstore to
+// appear, and opens it.
 func (d *Device) findDevice() error {
-	err := filepath.Walk("/dev", func(path string, i os.FileInfo, err error) error {
-		if err != nil {
+	deadline := time.Now().Add(uioWaitTimeout)
+	delay := 10 * time.Millisecond
+	for {
+		found, err := d.scanUio()
+		if err != nil || found {
 			return err
 		}
-		if i.IsDir() && path != "/dev" {
-			return filepath.SkipDir
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Failed to find a uio device for %s", d.GetDevConfig())
 		}
-		if !strings.HasPrefix(i.Name(), "uio") {
-			return nil
+		log.Debugf("Waiting for uio device for %s", d.GetDevConfig())
+		time.Sleep(delay)
+		if delay *= 2; delay > time.Second {
+			delay = time.Second
 		}
-		sysfile := fmt.Sprintf("/sys/class/uio/%s/name", i.Name())
-		bytes, err := ioutil.ReadFile(sysfile)
+	}
+}
+
+// scanUio looks through /sys/class/uio for the tcm-user device matching our
+// dev_config, and opens it if found. The entries there map 1:1 to /dev/uioN.
+func (d *Device) scanUio() (bool, error) {
+	entries, err := ioutil.ReadDir(uioDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, e := range entries {
+		bytes, err := ioutil.ReadFile(path.Join(uioDir, e.Name(), "name"))
 		if err != nil {
-			return err
+			if os.IsNotExist(err) {
+				// Removed while we were looking.
+				continue
+			}
+			return false, err
 		}
 		split := strings.SplitN(strings.TrimRight(string(bytes), "\n"), "/", 4)
-		if split[0] != "tcm-user" {
+		if len(split) != 4 || split[0] != "tcm-user" {
 			// Not a TCM device
-			log.Debugf("%s is not a tcm-user device", i.Name())
-			return nil
+			log.Debugf("%s is not a tcm-user device", e.Name())
+			continue
 		}
 		if split[3] != d.GetDevConfig() {
-			// Not a TCM device
-			log.Debugf("%s is not our tcm-user device", i.Name())
-			return nil
-		}
-		err = d.openDevice(split[1], split[2], i.Name())
-		if err != nil {
-			return err
+			log.Debugf("%s is not our tcm-user device", e.Name())
+			continue
 		}
-		return filepath.SkipDir
-	})
-	if err == filepath.SkipDir {
-		return nil
+		return true, d.openDevice(split[1], split[2], e.Name())
 	}
-	return err
+	return false, nil
 }
 
 func (d *Device) openDevice(user string, vol string, uio string) error {
@@ -301,9 +1014,31 @@ func (d *Device) openDevice(user string, vol string, uio string) error {
 		return err
 	}
 	d.mmap, err = syscall.Mmap(d.uioFd, 0, int(d.mapsize), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	if err := d.checkMailbox(); err != nil {
+		return err
+	}
 	d.cmdTail = d.mbCmdTail()
 	d.debugPrintMb()
-	return err
+	return nil
+}
+
+// checkMailbox verifies that the mailbox at the start of the ring is one whose
+// layout we understand, and that the command ring it describes lies within the
+// mapping.
+func (d *Device) checkMailbox() error {
+	if d.mapsize < mailboxSize {
+		return fmt.Errorf("TCMU mapping of %d bytes is too small for the mailbox", d.mapsize)
+	}
+	if v := d.mbVersion(); v != supportedMailboxVersion {
+		return fmt.Errorf("Unsupported TCMU mailbox version %d, expected %d", v, supportedMailboxVersion)
+	}
+	if end := uint64(d.mbCmdrOffset()) + uint64(d.mbCmdrSize()); end > d.mapsize || d.mbCmdrSize() == 0 {
+		return fmt.Errorf("TCMU command ring at %d+%d does not fit in the %d byte mapping", d.mbCmdrOffset(), d.mbCmdrSize(), d.mapsize)
+	}
+	return nil
 }
 
 func (d *Device) debugPrintMb() {
@@ -318,60 +1053,226 @@ func (d *Device) debugPrintMb() {
 
 func (d *Device) teardown() error {
 	dev := filepath.Join(d.devPath, d.scsi.VolumeName)
-	tpgtPath, _ := d.getSCSIPrefixAndWnn()
-	lunPath := d.getLunPath(tpgtPath)
+	lunPath := d.getLunPath(d.fabric().TPGPath(d.scsi))
 
 	/*
 		We're removing:
-		/sys/kernel/config/target/loopback/naa.<id>/tpgt_1/lun/lun_0/<volume name>
-		/sys/kernel/config/target/loopback/naa.<id>/tpgt_1/lun/lun_0
-		/sys/kernel/config/target/loopback/naa.<id>/tpgt_1
-		/sys/kernel/config/target/loopback/naa.<id>
+		/sys/kernel/config/target/<fabric>/<wwn>/tpgt_1/lun/lun_0/<volume name>
+		/sys/kernel/config/target/<fabric>/<wwn>/tpgt_1/lun/lun_0
 		/sys/kernel/config/target/core/user_42/<volume name>
+		the fabric's own directories, such as tpgt_1 and <wwn>, if no other
+		LUNs use them
 	*/
 	pathsToRemove := []string{
 		path.Join(lunPath, d.scsi.VolumeName),
 		lunPath,
-		tpgtPath,
-		path.Dir(tpgtPath),
 		path.Join(d.hbaDir, d.scsi.VolumeName),
 	}
 
-	for _, p := range pathsToRemove {
-		err := remove(p)
-		if err != nil {
+	// Should be cleaned up automatically, but if it isn't remove it
+	if _, err := os.Stat(dev); err == nil {
+		pathsToRemove = append(pathsToRemove, dev)
+	}
+
+	failed := removePaths(pathsToRemove, time.Now().Add(removeTimeout))
+
+	// The target portal group, target and HBA may be shared with other
+	// devices, so they're only removed once unused.
+	removeUnusedTPG(d.fabric().TPGPath(d.scsi), d.fabric().Paths(d.scsi))
+	removeEmpty(d.hbaDir)
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Unable to remove %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// RemoveDevice cleans up the configfs entries and device node of a device left
+// behind by a process that exited without closing it, such as after a crash, so
+// that it can be created again. It needs only the volume name and the user HBA
+// number, which may be 0 to search for the backstore. The backstore must have
+// been created by go-tcmu for volumeName (its dev_config is GetDevConfig's), and
+// must not be in use by a live Device.
+//
+// The LUNs linking to the backstore are removed along with their target portal
+// groups, then the backstore, and the targets and HBA once empty. Block device
+// nodes named volumeName in a directory directly under /dev, which OpenTCMUDevice
+// creates, are removed if they refer to the LUN's SCSI disk.
+func RemoveDevice(volumeName string, hba int) error {
+	if hba == 0 {
+		var err error
+		if hba, err = findHBA(volumeName); err != nil {
 			return err
 		}
 	}
+	backstore := path.Join(fmt.Sprintf(configDirFmt, hba), volumeName)
+	info, err := ioutil.ReadFile(path.Join(backstore, "info"))
+	if err != nil {
+		return err
+	}
+	devConfig := fmt.Sprintf("go-tcmu//%s", volumeName)
+	if !strings.Contains(string(info), "Config: "+devConfig+" ") {
+		return fmt.Errorf("%s is not a go-tcmu backstore for %s", backstore, volumeName)
+	}
 
-	// Should be cleaned up automatically, but if it isn't remove it
-	if _, err := os.Stat(dev); err == nil {
-		err := remove(dev)
-		if err != nil {
-			return err
+	links, err := findLunLinks(backstore, scsiDir, iscsiDir)
+	if err != nil {
+		return err
+	}
+	var pathsToRemove, tpgs, disks []string
+	for _, link := range links {
+		lunPath := path.Dir(link)
+		tpg := path.Dir(path.Dir(lunPath))
+		if disk := lunDisk(tpg, lunPath); disk != "" {
+			disks = append(disks, disk)
+		}
+		pathsToRemove = append(pathsToRemove, link, lunPath)
+		tpgs = append(tpgs, tpg)
+	}
+	pathsToRemove = append(pathsToRemove, backstore)
+
+	failed := removePaths(pathsToRemove, time.Now().Add(removeTimeout))
+	for _, tpg := range tpgs {
+		// Network portals, for iSCSI targets, then the group and the target,
+		// in the order Fabric.Paths gives.
+		portals, _ := filepath.Glob(path.Join(tpg, "np", "*"))
+		removeUnusedTPG(tpg, append(portals, tpg, path.Dir(tpg)))
+	}
+	removeEmpty(path.Dir(backstore))
+
+	nodes, _ := filepath.Glob(path.Join("/dev", "*", volumeName))
+	for _, node := range nodes {
+		if !isDiskNode(node, disks) {
+			continue
+		}
+		logrus.Debugf("Removing: %s", node)
+		if err := os.Remove(node); err != nil && !os.IsNotExist(err) {
+			failed = append(failed, fmt.Sprintf("%s (%v)", node, err))
 		}
 	}
 
+	if len(failed) > 0 {
+		return fmt.Errorf("Unable to remove %s", strings.Join(failed, ", "))
+	}
 	return nil
 }
 
-func removeAsync(path string, done chan<- error) {
+// findLunLinks returns the LUN symlinks to backstore in the target portal groups
+// of the fabric directories.
+func findLunLinks(backstore string, fabricDirs ...string) ([]string, error) {
+	var links []string
+	for _, dir := range fabricDirs {
+		matches, err := filepath.Glob(path.Join(dir, "*", "tpgt_*", "lun", "lun_*", "*"))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			if target, err := os.Readlink(m); err == nil && path.Clean(target) == backstore {
+				links = append(links, m)
+			}
+		}
+	}
+	return links, nil
+}
+
+// lunDisk returns the major:minor number of the SCSI disk the kernel created
+// for the loopback LUN at lunPath, or "" if there is none.
+func lunDisk(tpg, lunPath string) string {
+	address, err := ioutil.ReadFile(path.Join(tpg, "address"))
+	if err != nil {
+		return ""
+	}
+	lun := strings.TrimPrefix(path.Base(lunPath), "lun_")
+	matches, _ := filepath.Glob(fmt.Sprintf("/sys/bus/scsi/devices/%s:%s/block/*/dev", strings.TrimSpace(string(address)), lun))
+	if len(matches) != 1 {
+		return ""
+	}
+	majorMinor, err := ioutil.ReadFile(matches[0])
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(majorMinor))
+}
+
+// isDiskNode reports whether node is a block device node for one of disks,
+// given as major:minor numbers.
+func isDiskNode(node string, disks []string) bool {
+	var st syscall.Stat_t
+	if err := syscall.Stat(node, &st); err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return false
+	}
+	// The inverse of the encoding in mknod.
+	rdev := uint64(st.Rdev)
+	majorMinor := fmt.Sprintf("%d:%d", (rdev>>8)&0xfff, (rdev&0xff)|((rdev>>12)&0xfff00))
+	for _, disk := range disks {
+		if disk == majorMinor {
+			return true
+		}
+	}
+	return false
+}
+
+// removePaths removes each of paths in turn, as remove does, and returns those
+// it couldn't remove along with the reason.
+func removePaths(paths []string, deadline time.Time) []string {
+	var failed []string
+	for _, p := range paths {
+		if err := remove(p, deadline); err != nil {
+			failed = append(failed, fmt.Sprintf("%s (%v)", p, err))
+		}
+	}
+	return failed
+}
+
+// removeUnusedTPG removes the fabric directories paths of the target portal
+// group tpg, as Fabric.Paths returns them, once it holds no LUNs. Other devices
+// may use the group as LUNs of their own, and its portals with it.
+func removeUnusedTPG(tpg string, paths []string) {
+	if luns, _ := ioutil.ReadDir(path.Join(tpg, "lun")); len(luns) > 0 {
+		logrus.Debugf("Leaving %s, which other LUNs use", tpg)
+		return
+	}
+	removeEmpty(paths...)
+}
+
+// removeEmpty removes those of dirs that are empty.
+func removeEmpty(dirs ...string) {
+	for _, p := range dirs {
+		if err := os.Remove(p); err == nil {
+			logrus.Debugf("Removed: %s", p)
+		}
+	}
+}
+
+// remove deletes path, retrying with backoff until deadline while the kernel
+// reports it busy, such as while an initiator still has the device open.
+func remove(path string, deadline time.Time) error {
 	logrus.Debugf("Removing: %s", path)
-	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
-		logrus.Errorf("Unable to remove: %v", path)
-		done <- err
+	delay := 50 * time.Millisecond
+	for {
+		err := os.Remove(path)
+		if err == nil || os.IsNotExist(err) {
+			logrus.Debugf("Removed: %s", path)
+			return nil
+		}
+		if !isBusy(err) || time.Now().After(deadline) {
+			logrus.Errorf("Unable to remove: %v", path)
+			return err
+		}
+		logrus.Debugf("Waiting to remove busy %s", path)
+		time.Sleep(delay)
+		if delay *= 2; delay > time.Second {
+			delay = time.Second
+		}
 	}
-	logrus.Debugf("Removed: %s", path)
-	done <- nil
 }
 
-func remove(path string) error {
-	done := make(chan error)
-	go removeAsync(path, done)
-	select {
-	case err := <-done:
-		return err
-	case <-time.After(30 * time.Second):
-		return fmt.Errorf("Timeout trying to delete %s.", path)
+// isBusy reports whether err from removing a configfs entry may go away on its
+// own. A directory that isn't empty is still in use by other devices, and stays
+// that way, so directories that may be shared are left to removeEmpty instead.
+func isBusy(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
 	}
+	return err == syscall.EBUSY
 }
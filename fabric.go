@@ -0,0 +1,134 @@
+package tcmu
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const iscsiDir = "/sys/kernel/config/target/iscsi"
+
+// Fabric exports the TCMU backstore to initiators through one of the kernel's
+// target fabric modules. The device's LUN is created in the target portal group
+// returned by TPGPath, after Setup.
+type Fabric interface {
+	// TPGPath returns the configfs directory of the target portal group the
+	// device's LUN is created in.
+	TPGPath(h *SCSIHandler) string
+	// Setup creates and configures the target portal group.
+	Setup(h *SCSIHandler) error
+	// Paths returns the configfs directories created by Setup, in the order
+	// they must be removed once the LUN is gone. The last is the target's own
+	// directory, which may hold other target portal groups, and is only
+	// removed once empty.
+	Paths(h *SCSIHandler) []string
+	// Local reports whether the device appears as a SCSI device on this host,
+	// so that a block device node can be created for it.
+	Local() bool
+}
+
+// LoopbackFabric exports the device on the local host only, through the tcm_loop
+// module. It is the default when SCSIHandler.Fabric is nil.
+type LoopbackFabric struct {
+	// Nexus is the name of the initiator port of the loopback nexus. If empty,
+	// the WWN's NexusID is used.
+	Nexus string
+}
+
+func (LoopbackFabric) TPGPath(h *SCSIHandler) string {
+	return path.Join(scsiDir, h.WWN.DeviceID(), h.tpgtDir())
+}
+
+func (f LoopbackFabric) Setup(h *SCSIHandler) error {
+	return writeLines(path.Join(f.TPGPath(h), "nexus"), []string{f.nexus(h)})
+}
+
+func (f LoopbackFabric) nexus(h *SCSIHandler) string {
+	if f.Nexus != "" {
+		return f.Nexus
+	}
+	return h.WWN.NexusID()
+}
+
+func (f LoopbackFabric) Paths(h *SCSIHandler) []string {
+	/*
+		/sys/kernel/config/target/loopback/naa.<id>/tpgt_<n>
+		/sys/kernel/config/target/loopback/naa.<id>
+	*/
+	tpg := f.TPGPath(h)
+	return []string{tpg, path.Dir(tpg)}
+}
+
+func (LoopbackFabric) Local() bool {
+	return true
+}
+
+// ISCSIFabric exports the device over the network through the iscsi_target_mod
+// module. The target portal group is set up for demo mode: any initiator may log
+// in without authentication and gets read-write access.
+type ISCSIFabric struct {
+	// IQN is the target name. If empty, one is derived from the volume name.
+	IQN string
+	// Portal is the address and port to listen on, such as "0.0.0.0:3260" or
+	// "[::]:3260". If empty, all IPv4 addresses on port 3260 are used.
+	Portal string
+}
+
+func (f ISCSIFabric) iqn(h *SCSIHandler) string {
+	if f.IQN != "" {
+		return f.IQN
+	}
+	return "iqn.2016-06.com.coreos:go-tcmu." + strings.ToLower(h.VolumeName)
+}
+
+func (f ISCSIFabric) portal() string {
+	if f.Portal != "" {
+		return f.Portal
+	}
+	return "0.0.0.0:3260"
+}
+
+func (f ISCSIFabric) TPGPath(h *SCSIHandler) string {
+	return path.Join(iscsiDir, f.iqn(h), h.tpgtDir())
+}
+
+func (f ISCSIFabric) Setup(h *SCSIHandler) error {
+	tpg := f.TPGPath(h)
+	np := path.Join(tpg, "np", f.portal())
+	logrus.Debugf("Creating directory: %s", np)
+	if err := os.MkdirAll(np, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	attribs := []struct{ name, value string }{
+		{"authentication", "0"},
+		{"generate_node_acls", "1"},
+		{"cache_dynamic_acls", "1"},
+		{"demo_mode_write_protect", "0"},
+	}
+	for _, a := range attribs {
+		if err := writeLines(path.Join(tpg, "attrib", a.name), []string{a.value}); err != nil {
+			return err
+		}
+	}
+	if err := writeLines(path.Join(tpg, "enable"), []string{"1"}); err != nil {
+		return fmt.Errorf("Failed to enable %s: %v", tpg, err)
+	}
+	return nil
+}
+
+func (f ISCSIFabric) Paths(h *SCSIHandler) []string {
+	/*
+		/sys/kernel/config/target/iscsi/<iqn>/tpgt_<n>/np/<portal>
+		/sys/kernel/config/target/iscsi/<iqn>/tpgt_<n>
+		/sys/kernel/config/target/iscsi/<iqn>
+	*/
+	tpg := f.TPGPath(h)
+	return []string{path.Join(tpg, "np", f.portal()), tpg, path.Dir(tpg)}
+}
+
+func (ISCSIFabric) Local() bool {
+	return false
+}
@@ -0,0 +1,130 @@
+package tcmu
+
+import (
+	"sync"
+	"time"
+
+	"github.com/coreos/go-tcmu/scsi"
+)
+
+// Fault is a CHECK CONDITION returned by a FaultInjector in place of the real
+// response.
+type Fault struct {
+	Key byte
+	ASC uint16
+}
+
+// FaultRange is a half-open range of LBAs, [Start, End).
+type FaultRange struct {
+	Start, End uint64
+}
+
+// FaultInjector is a SCSICmdHandler that wraps another, failing some of its
+// commands to exercise initiator error paths, such as multipath failover or
+// filesystem error handling.
+//
+// A command is a candidate for injection if its opcode is in Opcodes and, when
+// LBAs is set, its starting LBA falls in one of the ranges. Every Rate-th
+// candidate is failed with the next of Faults, in rotation.
+type FaultInjector struct {
+	// Handler services the commands that are not failed.
+	Handler SCSICmdHandler
+	// Opcodes are the commands to inject faults into. If empty, READ commands
+	// are used. LBAs is only meaningful for opcodes that carry an LBA.
+	Opcodes []byte
+	// LBAs, if set, restricts injection to commands starting in these ranges.
+	LBAs []FaultRange
+	// Rate fails one in every Rate candidates. Zero or one fails them all.
+	Rate int
+	// Faults are returned in rotation. If empty, a MEDIUM ERROR is returned.
+	Faults []Fault
+	// Delay, if set, is slept before handling every candidate, failed or not.
+	Delay time.Duration
+
+	mu            sync.Mutex
+	candidates    int
+	injected      int
+	unitAttention bool
+}
+
+// Reset simulates a reset of the logical unit: the next command, whatever it is,
+// fails with UNIT ATTENTION (power on, reset, or bus device reset occurred).
+func (f *FaultInjector) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.unitAttention = true
+}
+
+// Injected returns the number of faults injected so far.
+func (f *FaultInjector) Injected() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.injected
+}
+
+func (f *FaultInjector) HandleCommand(cmd *SCSICmd) (SCSIResponse, error) {
+	fault, candidate, ua := f.choose(cmd)
+	if ua {
+		return cmd.CheckCondition(scsi.SenseUnitAttention, scsi.AscPowerOnReset), nil
+	}
+	if candidate && f.Delay > 0 {
+		time.Sleep(f.Delay)
+	}
+	if fault != nil {
+		return cmd.CheckCondition(fault.Key, fault.ASC), nil
+	}
+	return f.Handler.HandleCommand(cmd)
+}
+
+// choose decides whether cmd gets a fault, and returns it if so.
+func (f *FaultInjector) choose(cmd *SCSICmd) (fault *Fault, candidate bool, unitAttention bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.unitAttention {
+		f.unitAttention = false
+		return nil, false, true
+	}
+	if !f.matches(cmd) {
+		return nil, false, false
+	}
+	f.candidates++
+	if f.Rate > 1 && f.candidates%f.Rate != 0 {
+		return nil, true, false
+	}
+	fault = &Fault{scsi.SenseMediumError, scsi.AscReadError}
+	if len(f.Faults) > 0 {
+		fault = &f.Faults[f.injected%len(f.Faults)]
+	}
+	f.injected++
+	return fault, true, false
+}
+
+func (f *FaultInjector) matches(cmd *SCSICmd) bool {
+	ops := f.Opcodes
+	if len(ops) == 0 {
+		ops = []byte{scsi.Read6, scsi.Read10, scsi.Read12, scsi.Read16}
+	}
+	found := false
+	for _, op := range ops {
+		if cmd.Command() == op {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+	if len(f.LBAs) == 0 {
+		return true
+	}
+	lba, err := cmd.LBAE()
+	if err != nil {
+		return false
+	}
+	for _, r := range f.LBAs {
+		if lba >= r.Start && lba < r.End {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package tcmu
+
+import "sync"
+
+// lbaRangeLock serializes operations that must appear atomic over a range of
+// logical blocks, such as COMPARE AND WRITE. Non-overlapping ranges proceed
+// concurrently. The zero value is ready to use.
+type lbaRangeLock struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	held []lbaRange
+}
+
+type lbaRange struct {
+	start, end uint64 // [start, end)
+}
+
+func (r lbaRange) overlaps(o lbaRange) bool {
+	return r.start < o.end && o.start < r.end
+}
+
+// Lock blocks until no other holder overlaps [lba, lba+blocks), then claims it.
+func (l *lbaRangeLock) Lock(lba uint64, blocks uint64) lbaRange {
+	r := lbaRange{lba, lba + blocks}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cond == nil {
+		l.cond = sync.NewCond(&l.mu)
+	}
+	for l.conflicts(r) {
+		l.cond.Wait()
+	}
+	l.held = append(l.held, r)
+	return r
+}
+
+// Unlock releases a range previously returned by Lock.
+func (l *lbaRangeLock) Unlock(r lbaRange) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, h := range l.held {
+		if h == r {
+			l.held = append(l.held[:i], l.held[i+1:]...)
+			break
+		}
+	}
+	l.cond.Broadcast()
+}
+
+func (l *lbaRangeLock) conflicts(r lbaRange) bool {
+	for _, h := range l.held {
+		if h.overlaps(r) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+package tcmu
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// memoryChunkSize is the granularity MemoryStore allocates storage in.
+const memoryChunkSize = 64 * 1024
+
+// MemoryStore is a ReadWriterAt held in memory, for tests and ramdisks. Storage is
+// allocated in chunks as it is first written, so a large, mostly empty store is
+// cheap, and unwritten areas read as zeros. Reads and writes are cut short at the
+// end of the store. It is safe for concurrent use.
+//
+// MemoryStore also implements Flusher, Trimmer and LBAStatusReporter.
+type MemoryStore struct {
+	mu     sync.RWMutex
+	size   int64
+	chunks map[int64][]byte
+}
+
+// NewMemoryStore returns a zeroed MemoryStore of size bytes.
+func NewMemoryStore(size int64) *MemoryStore {
+	return &MemoryStore{
+		size:   size,
+		chunks: make(map[int64][]byte),
+	}
+}
+
+// Size returns the size of the store in bytes.
+func (m *MemoryStore) Size() int64 {
+	return m.size
+}
+
+func (m *MemoryStore) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= m.size {
+		return 0, io.EOF
+	}
+	want := len(p)
+	if rest := m.size - off; int64(want) > rest {
+		p = p[:rest]
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n := 0
+	for n < len(p) {
+		idx, coff := (off+int64(n))/memoryChunkSize, (off+int64(n))%memoryChunkSize
+		end := len(p)
+		if l := int(memoryChunkSize - coff); end-n > l {
+			end = n + l
+		}
+		if c, ok := m.chunks[idx]; ok {
+			copy(p[n:end], c[coff:])
+		} else {
+			for i := n; i < end; i++ {
+				p[i] = 0
+			}
+		}
+		n = end
+	}
+	if n < want {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *MemoryStore) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= m.size {
+		return 0, io.ErrShortWrite
+	}
+	want := len(p)
+	if rest := m.size - off; int64(want) > rest {
+		p = p[:rest]
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for n < len(p) {
+		idx, coff := (off+int64(n))/memoryChunkSize, (off+int64(n))%memoryChunkSize
+		c, ok := m.chunks[idx]
+		if !ok {
+			c = make([]byte, memoryChunkSize)
+			m.chunks[idx] = c
+		}
+		n += copy(c[coff:], p[n:])
+	}
+	if n < want {
+		return n, io.ErrShortWrite
+	}
+	return n, nil
+}
+
+// Flush does nothing; writes to a MemoryStore are immediately visible.
+func (m *MemoryStore) Flush() error {
+	return nil
+}
+
+// TrimAt zeroes length bytes at off, releasing the memory of any chunks that are
+// entirely covered.
+func (m *MemoryStore) TrimAt(length, off int64) error {
+	if off < 0 || length < 0 {
+		return errors.New("negative offset or length")
+	}
+	if end := off + length; end > m.size {
+		length = m.size - off
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for length > 0 {
+		idx, coff := off/memoryChunkSize, off%memoryChunkSize
+		l := memoryChunkSize - coff
+		if l > length {
+			l = length
+		}
+		if c, ok := m.chunks[idx]; ok {
+			if l == memoryChunkSize {
+				delete(m.chunks, idx)
+			} else {
+				for i := coff; i < coff+l; i++ {
+					c[i] = 0
+				}
+			}
+		}
+		off += l
+		length -= l
+	}
+	return nil
+}
+
+// StatusAt reports whether off lies in storage that has been written, and the
+// length of the run of chunks with the same status.
+func (m *MemoryStore) StatusAt(off int64) (bool, int64, error) {
+	if off < 0 || off >= m.size {
+		return false, 0, errors.New("offset out of range")
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	idx := off / memoryChunkSize
+	_, mapped := m.chunks[idx]
+	end := (idx + 1) * memoryChunkSize
+	for end < m.size {
+		if _, ok := m.chunks[end/memoryChunkSize]; ok != mapped {
+			break
+		}
+		end += memoryChunkSize
+	}
+	if end > m.size {
+		end = m.size
+	}
+	return mapped, end - off, nil
+}
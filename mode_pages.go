@@ -0,0 +1,131 @@
+package tcmu
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// ModePageHandler is a mode page, reported by MODE SENSE and changed by MODE
+// SELECT. Register one with Device.RegisterModePage.
+type ModePageHandler interface {
+	// PageCode returns the page code, from 0x00 to 0x3e. Subpages are not
+	// supported.
+	PageCode() byte
+	// Marshal returns the page with its current values, including the two byte
+	// page header.
+	Marshal() []byte
+	// Unmarshal applies the page sent by a MODE SELECT, including its header. It
+	// returns an error if the page is malformed or changes a field that isn't
+	// changeable, which fails the command with INVALID FIELD IN PARAMETER LIST.
+	Unmarshal([]byte) error
+}
+
+// RegisterModePage adds p to the device's mode pages, replacing any page with
+// the same code, including the built-in Read-Write Error Recovery (0x01) and
+// Caching (0x08) pages.
+func (d *Device) RegisterModePage(p ModePageHandler) {
+	d.modePagesMu.Lock()
+	defer d.modePagesMu.Unlock()
+	d.initModePages()
+	i := sort.Search(len(d.modePages), func(i int) bool {
+		return d.modePages[i].PageCode() >= p.PageCode()
+	})
+	if i < len(d.modePages) && d.modePages[i].PageCode() == p.PageCode() {
+		d.modePages[i] = p
+		return
+	}
+	d.modePages = append(d.modePages, nil)
+	copy(d.modePages[i+1:], d.modePages[i:])
+	d.modePages[i] = p
+}
+
+// ModePages returns the device's mode pages, in page code order.
+func (d *Device) ModePages() []ModePageHandler {
+	d.modePagesMu.Lock()
+	defer d.modePagesMu.Unlock()
+	d.initModePages()
+	return append([]ModePageHandler(nil), d.modePages...)
+}
+
+// modePage returns the mode page with the given code, or nil.
+func (d *Device) modePage(code byte) ModePageHandler {
+	for _, p := range d.ModePages() {
+		if p.PageCode() == code {
+			return p
+		}
+	}
+	return nil
+}
+
+// initModePages registers the built-in pages the first time the pages are
+// used. modePagesMu must be held.
+func (d *Device) initModePages() {
+	if d.modePages != nil {
+		return
+	}
+	d.modePages = []ModePageHandler{
+		errorRecoveryModePage{},
+		cachingModePage{d},
+	}
+}
+
+// unmarshalUnchangeable checks that data is exactly the page want, as nothing in
+// it may be changed.
+func unmarshalUnchangeable(data, want []byte) error {
+	if !bytes.Equal(data, want) {
+		return fmt.Errorf("mode page 0x%02x: % x doesn't match % x", want[0], data, want)
+	}
+	return nil
+}
+
+// errorRecoveryModePage is the Read-Write Error Recovery page, which can't be
+// changed.
+type errorRecoveryModePage struct{}
+
+func (errorRecoveryModePage) PageCode() byte {
+	return 0x01
+}
+
+func (errorRecoveryModePage) Marshal() []byte {
+	b := &bytes.Buffer{}
+	RWErrorRecoveryModePage(b)
+	return b.Bytes()
+}
+
+func (p errorRecoveryModePage) Unmarshal(data []byte) error {
+	return unmarshalUnchangeable(data, p.Marshal())
+}
+
+// cachingModePage is the Caching page, whose WCE bit sets the device's write
+// cache.
+type cachingModePage struct {
+	d *Device
+}
+
+func (cachingModePage) PageCode() byte {
+	return 0x08
+}
+
+func (p cachingModePage) Marshal() []byte {
+	return p.marshal(p.d.WriteCacheEnabled() && !p.d.readOnly())
+}
+
+func (cachingModePage) marshal(wce bool) []byte {
+	b := &bytes.Buffer{}
+	CachingModePage(b, wce)
+	return b.Bytes()
+}
+
+func (p cachingModePage) Unmarshal(data []byte) error {
+	if len(data) < 3 {
+		return fmt.Errorf("mode page 0x08: too short")
+	}
+	// WCE is changeable; everything else must match.
+	wce := data[2]&0x04 != 0
+	if err := unmarshalUnchangeable(data, p.marshal(wce)); err != nil {
+		return err
+	}
+	p.d.setWriteCacheEnabled(wce)
+	return nil
+}
@@ -0,0 +1,99 @@
+package tcmu
+
+import (
+	"github.com/coreos/go-tcmu/scsi"
+	"github.com/prometheus/common/log"
+)
+
+// nullChunkBytes is the size of the zero buffer NullHandler fills reads from.
+const nullChunkBytes = 64 * 1024
+
+var nullZeros = make([]byte, nullChunkBytes)
+
+// NullHandler is a SCSICmdHandler with no backend, the SCSI equivalent of
+// /dev/null: READs return zeros and WRITEs are acknowledged without their data
+// being looked at. Everything else, including INQUIRY, READ CAPACITY and MODE
+// SENSE, is emulated exactly as by ReadWriterAtCmdHandler. It is meant for
+// profiling the ring and the command dispatch in isolation.
+type NullHandler struct {
+	Inq *InquiryInfo
+}
+
+func (h NullHandler) HandleCommand(cmd *SCSICmd) (SCSIResponse, error) {
+	inq := h.Inq
+	if inq == nil {
+		inq = &defaultInquiry
+	}
+	switch cmd.Command() {
+	case scsi.Read6, scsi.Read10, scsi.Read12, scsi.Read16:
+		if resp, ok := checkDeviceState(cmd); !ok {
+			return resp, nil
+		}
+		if resp, ok := checkTransferLength(cmd, inq); !ok {
+			return resp, nil
+		}
+		return emulateNullRead(cmd)
+	case scsi.Write6, scsi.Write10, scsi.Write12, scsi.Write16:
+		if resp, ok := checkDeviceState(cmd); !ok {
+			return resp, nil
+		}
+		if resp, ok := checkTransferLength(cmd, inq); !ok {
+			return resp, nil
+		}
+		return emulateNullWrite(cmd)
+	}
+	return ReadWriterAtCmdHandler{RW: nullReadWriterAt{}, Inq: h.Inq}.HandleCommand(cmd)
+}
+
+func emulateNullRead(cmd *SCSICmd) (SCSIResponse, error) {
+	lba, blocks, err := lbaXferLen(cmd)
+	if err != nil {
+		return cmd.IllegalRequest(), nil
+	}
+	if !lbaInRange(cmd, lba, uint64(blocks)) {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscLBAOutOfRange), nil
+	}
+	// The data buffers are in the ring, and hold whatever was there before.
+	length := int(blocks) * int(cmd.Device().Sizes().BlockSize)
+	for left := length; left > 0; {
+		buf := nullZeros
+		if left < len(buf) {
+			buf = buf[:left]
+		}
+		n, err := cmd.Write(buf)
+		if err != nil {
+			log.Errorln("null read/write failed: error:", err)
+			return cmd.MediumError(), nil
+		}
+		left -= n
+	}
+	cmd.Device().stats.read(length)
+	return cmd.Ok(), nil
+}
+
+func emulateNullWrite(cmd *SCSICmd) (SCSIResponse, error) {
+	lba, blocks, err := lbaXferLen(cmd)
+	if err != nil {
+		return cmd.IllegalRequest(), nil
+	}
+	if !lbaInRange(cmd, lba, uint64(blocks)) {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscLBAOutOfRange), nil
+	}
+	cmd.Device().stats.wrote(int(blocks) * int(cmd.Device().Sizes().BlockSize))
+	return cmd.Ok(), nil
+}
+
+// nullReadWriterAt backs the commands NullHandler passes on to
+// ReadWriterAtCmdHandler, such as VERIFY and COMPARE AND WRITE.
+type nullReadWriterAt struct{}
+
+func (nullReadWriterAt) ReadAt(p []byte, off int64) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func (nullReadWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	return len(p), nil
+}
@@ -1,4 +1,4 @@
-// +build arm64 amd64
+// +build arm64 amd64 ppc64le mips64le riscv64
 
 package tcmu
 
@@ -22,5 +22,10 @@ const (
 	offReqIov0Len  = entReqRespOff + 48
 
 	offRespSCSIStatus = entReqRespOff + 0
+	offRespReadLen    = entReqRespOff + 4
 	offRespSense      = entReqRespOff + 8
+
+	offTmrType   = entReqRespOff + 0
+	offTmrCmdCnt = entReqRespOff + 4
+	offTmrCmdIds = entReqRespOff + 24
 )
@@ -22,5 +22,10 @@ const (
 	offReqIov0Len  = entReqRespOff + 40
 
 	offRespSCSIStatus = entReqRespOff + 0
+	offRespReadLen    = entReqRespOff + 4
 	offRespSense      = entReqRespOff + 8
+
+	offTmrType   = entReqRespOff + 0
+	offTmrCmdCnt = entReqRespOff + 4
+	offTmrCmdIds = entReqRespOff + 24
 )
@@ -0,0 +1,289 @@
+package tcmu
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/coreos/go-tcmu/scsi"
+)
+
+// reservations is a device's persistent reservation state: the registered I_T
+// nexuses and the reservation, if one is held. It is kept in memory only, so it
+// doesn't persist across the device being recreated.
+type reservations struct {
+	// generation counts the changes to the registrations, as reported by
+	// PERSISTENT RESERVE IN.
+	generation uint32
+	// keys maps each registered I_T nexus to its reservation key.
+	keys map[string]uint64
+
+	// holder is the I_T nexus holding the reservation, and resType its type,
+	// if reserved.
+	reserved bool
+	holder   string
+	resType  byte
+}
+
+// sortedKeys returns the registered reservation keys, ordered by I_T nexus so
+// that the list is stable.
+func (r *reservations) sortedKeys() []uint64 {
+	nexuses := make([]string, 0, len(r.keys))
+	for n := range r.keys {
+		nexuses = append(nexuses, n)
+	}
+	sort.Strings(nexuses)
+	keys := make([]uint64, len(nexuses))
+	for i, n := range nexuses {
+		keys[i] = r.keys[n]
+	}
+	return keys
+}
+
+// EmulatePersistentReserveIn responds to PERSISTENT RESERVE IN with the READ
+// KEYS and READ RESERVATION service actions, from the device's reservation
+// state.
+func EmulatePersistentReserveIn(cmd *SCSICmd) (SCSIResponse, error) {
+	d := cmd.Device()
+	d.state.mu.RLock()
+	r := &d.state.pr
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data[0:4], r.generation)
+	switch cmd.ServiceAction() {
+	case scsi.PriReadKeys:
+		for _, k := range r.sortedKeys() {
+			data = append(data, make([]byte, 8)...)
+			binary.BigEndian.PutUint64(data[len(data)-8:], k)
+		}
+	case scsi.PriReadReservation:
+		if r.reserved {
+			desc := make([]byte, 16)
+			if !allRegistrants(r.resType) {
+				binary.BigEndian.PutUint64(desc[0:8], r.keys[r.holder])
+			}
+			desc[13] = r.resType // scope: logical unit
+			data = append(data, desc...)
+		}
+	default:
+		d.state.mu.RUnlock()
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb), nil
+	}
+	d.state.mu.RUnlock()
+	binary.BigEndian.PutUint32(data[4:8], uint32(len(data)-8))
+
+	outlen := int(binary.BigEndian.Uint16(cmd.cdb[7:9]))
+	if outlen < len(data) {
+		data = data[:outlen]
+	}
+	return cmd.Respond(data), nil
+}
+
+// Persistent reservation types.
+const (
+	prWriteExclusive                 = 0x1
+	prExclusiveAccess                = 0x3
+	prWriteExclusiveRegistrantsOnly  = 0x5
+	prExclusiveAccessRegistrantsOnly = 0x6
+	prWriteExclusiveAllRegistrants   = 0x7
+	prExclusiveAccessAllRegistrants  = 0x8
+)
+
+// allRegistrants reports whether a reservation of type t is held by every
+// registered I_T nexus, rather than the one that reserved it, in which case it
+// has no reservation key of its own.
+func allRegistrants(t byte) bool {
+	return t == prWriteExclusiveAllRegistrants || t == prExclusiveAccessAllRegistrants
+}
+
+// registrantsOnly reports whether a reservation of type t gives every
+// registered I_T nexus the access of the holder.
+func registrantsOnly(t byte) bool {
+	return t == prWriteExclusiveRegistrantsOnly || t == prExclusiveAccessRegistrantsOnly ||
+		allRegistrants(t)
+}
+
+// unregister removes nexus's registration, releasing the reservation if it was
+// the holder, or the last registrant of an all registrants reservation.
+func (r *reservations) unregister(nexus string) {
+	delete(r.keys, nexus)
+	if !r.reserved {
+		return
+	}
+	if allRegistrants(r.resType) {
+		if len(r.keys) == 0 {
+			r.reserved = false
+		}
+	} else if r.holder == nexus {
+		r.reserved = false
+	}
+}
+
+// holds reports whether nexus is a reservation holder: the one that reserved
+// it, or for the all registrants types, any registered nexus.
+func (r *reservations) holds(nexus string) bool {
+	if r.holder == nexus {
+		return true
+	}
+	_, registered := r.keys[nexus]
+	return registered && allRegistrants(r.resType)
+}
+
+// canAccess reports whether nexus has the access of a reservation holder, even
+// if it isn't one, as registered nexuses do with the registrants only types.
+func (r *reservations) canAccess(nexus string) bool {
+	if r.holds(nexus) {
+		return true
+	}
+	_, registered := r.keys[nexus]
+	return registered && registrantsOnly(r.resType)
+}
+
+// reservationConflict reports whether cmd accesses the medium in a way the
+// persistent reservation held by another I_T nexus excludes: writes for the
+// write exclusive types, and any medium access for the exclusive access types.
+func (d *Device) reservationConflict(cmd *SCSICmd) bool {
+	d.state.mu.RLock()
+	defer d.state.mu.RUnlock()
+	r := &d.state.pr
+	if !r.reserved || r.canAccess(cmd.InitiatorID()) {
+		return false
+	}
+	switch r.resType {
+	case prWriteExclusive, prWriteExclusiveRegistrantsOnly, prWriteExclusiveAllRegistrants:
+		return isWriteCommand(cmd.Command())
+	}
+	return isMediumAccess(cmd.Command())
+}
+
+// prOutParamLen is the length of the PERSISTENT RESERVE OUT parameter list,
+// without SPEC_I_PT transport IDs.
+const prOutParamLen = 24
+
+// EmulatePersistentReserveOut handles PERSISTENT RESERVE OUT: REGISTER, REGISTER
+// AND IGNORE EXISTING KEY, RESERVE, RELEASE, CLEAR, PREEMPT and PREEMPT AND
+// ABORT, against the device's reservation state. Only logical unit scope
+// reservations are supported, and the SPEC_I_PT, ALL_TG_PT and APTPL options
+// aren't. PREEMPT AND ABORT can't abort the preempted nexuses' commands, so it
+// behaves as PREEMPT.
+func EmulatePersistentReserveOut(cmd *SCSICmd) (SCSIResponse, error) {
+	sa := cmd.ServiceAction()
+	scope, resType := cmd.GetCDB(2)>>4, cmd.GetCDB(2)&0x0f
+	if binary.BigEndian.Uint32(cmd.cdb[5:9]) != prOutParamLen || cmd.dataLen() < prOutParamLen {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+	}
+	params := make([]byte, prOutParamLen)
+	if n, _ := cmd.Read(params); n < len(params) {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+	}
+	if params[20]&0x0d != 0 {
+		// SPEC_I_PT, ALL_TG_PT, APTPL
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList), nil
+	}
+	key := binary.BigEndian.Uint64(params[0:8])
+	saKey := binary.BigEndian.Uint64(params[8:16])
+
+	d := cmd.Device()
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+	r := &d.state.pr
+	if r.keys == nil {
+		r.keys = make(map[string]uint64)
+	}
+	nexus := cmd.InitiatorID()
+	registered, isRegistered := r.keys[nexus]
+	conflict := cmd.RespondStatus(scsi.SamStatReservationConflict)
+
+	switch sa {
+	case scsi.ProRegister, scsi.ProRegisterAndIgnoreExistingKey:
+		if sa == scsi.ProRegister && key != registered {
+			// An unregistered nexus must give a reservation key of zero.
+			return conflict, nil
+		}
+		switch {
+		case saKey != 0:
+			r.keys[nexus] = saKey
+		case isRegistered:
+			r.unregister(nexus)
+		default:
+			return cmd.Ok(), nil
+		}
+		r.generation++
+		return cmd.Ok(), nil
+	case scsi.ProRegisterAndMove:
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb), nil
+	case scsi.ProReserve, scsi.ProRelease, scsi.ProClear, scsi.ProPreempt, scsi.ProPreemptAndAbort:
+	default:
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb), nil
+	}
+
+	// The other service actions are only for registered nexuses.
+	if !isRegistered || key != registered {
+		return conflict, nil
+	}
+	switch sa {
+	case scsi.ProReserve:
+		if scope != 0 || !validReservationType(resType) {
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb), nil
+		}
+		if r.reserved {
+			if !r.holds(nexus) || r.resType != resType {
+				return conflict, nil
+			}
+			return cmd.Ok(), nil
+		}
+		r.reserved, r.holder, r.resType = true, nexus, resType
+	case scsi.ProRelease:
+		if !r.reserved || !r.holds(nexus) {
+			return cmd.Ok(), nil
+		}
+		if scope != 0 || r.resType != resType {
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidReleaseOfReservation), nil
+		}
+		r.reserved = false
+	case scsi.ProClear:
+		r.keys = make(map[string]uint64)
+		r.reserved = false
+		r.generation++
+	case scsi.ProPreempt, scsi.ProPreemptAndAbort:
+		if r.reserved && (allRegistrants(r.resType) && saKey == 0 ||
+			!allRegistrants(r.resType) && r.keys[r.holder] == saKey) {
+			// Preempt the reservation, along with the registrations.
+			if scope != 0 || !validReservationType(resType) {
+				return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb), nil
+			}
+			for n, k := range r.keys {
+				if n != nexus && (saKey == 0 || k == saKey) {
+					delete(r.keys, n)
+				}
+			}
+			r.holder, r.resType = nexus, resType
+			r.generation++
+			return cmd.Ok(), nil
+		}
+		if saKey == 0 {
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList), nil
+		}
+		removed := false
+		for n, k := range r.keys {
+			if k == saKey {
+				r.unregister(n)
+				removed = true
+			}
+		}
+		if !removed {
+			return conflict, nil
+		}
+		r.generation++
+	}
+	return cmd.Ok(), nil
+}
+
+// validReservationType reports whether t is a persistent reservation type.
+func validReservationType(t byte) bool {
+	switch t {
+	case prWriteExclusive, prExclusiveAccess,
+		prWriteExclusiveRegistrantsOnly, prExclusiveAccessRegistrantsOnly,
+		prWriteExclusiveAllRegistrants, prExclusiveAccessAllRegistrants:
+		return true
+	}
+	return false
+}
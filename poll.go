@@ -1,7 +1,12 @@
 package tcmu
 
 import (
+	"context"
+	"encoding/hex"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/coreos/go-tcmu/scsi"
 	"github.com/prometheus/common/log"
@@ -10,53 +15,152 @@ import (
 
 const (
 	tcmuSenseBufferSize = 96
+
+	// tcmuMailboxFlagCapReadLen is set in the mailbox flags by kernels that
+	// accept a short read length in the response, TCMU_UFLAG_READ_LEN.
+	tcmuMailboxFlagCapReadLen = 1 << 1
 )
 
 func (d *Device) beginPoll() {
 	// Entry point for the goroutine.
+	defer d.pollerExited()
 	go d.recvResponse()
+	if d.poller != nil {
+		d.waitPoller()
+	} else {
+		d.waitUio()
+	}
+	close(d.cmdChan)
+}
+
+// waitUio processes the ring each time the uio device becomes readable, until
+// stopFd is signaled by Detach.
+func (d *Device) waitUio() {
 	buf := make([]byte, 4)
+	fds := []unix.PollFd{
+		{Fd: int32(d.uioFd), Events: unix.POLLIN},
+		{Fd: int32(d.stopFd), Events: unix.POLLIN},
+	}
 	for {
+		_, err := unix.Poll(fds, -1)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			log.Errorf("error polling uio device: %s", err)
+			d.fail(err)
+			break
+		}
+		if fds[1].Revents != 0 {
+			break
+		}
 		var n int
-		var err error
 		n, err = unix.Read(d.uioFd, buf)
 		if n == -1 && err != nil {
-			fmt.Println(err)
+			log.Errorf("error reading uio device: %s", err)
+			d.fail(err)
 			break
 		}
-		for {
-			cmd, err := d.getNextCommand()
-			if err != nil {
-				log.Errorf("error getting next command: %s", err)
-				break
-			}
-			if cmd == nil {
-				break
-			}
-			d.cmdChan <- cmd
+		if err = d.drainCommands(); err != nil {
+			log.Errorf("error getting next command: %s", err)
+			d.fail(err)
+			break
 		}
 	}
-	close(d.cmdChan)
+}
+
+// waitPoller processes the ring each time the shared Poller signals the device.
+func (d *Device) waitPoller() {
+	for range d.kick {
+		if err := d.drainCommands(); err != nil {
+			log.Errorf("error getting next command: %s", err)
+			d.fail(err)
+			d.poller.remove(d)
+			return
+		}
+	}
+}
+
+// drainCommands dispatches every command currently available in the ring. It
+// blocks while cmdChan is full, or SCSIHandler.MaxInFlight commands are in
+// flight, so commands are only taken off the ring as fast as the handlers can
+// accept them.
+func (d *Device) drainCommands() error {
+	for {
+		if d.nextEntryOff() == d.headEntryOff() {
+			return nil
+		}
+		if d.inFlight != nil {
+			d.inFlight <- struct{}{}
+		}
+		cmd, err := d.getNextCommand()
+		if err != nil || cmd == nil {
+			d.releaseInFlight()
+			return err
+		}
+		d.cmdChan <- cmd
+	}
+}
+
+// releaseInFlight frees the MaxInFlight slot of a completed command.
+func (d *Device) releaseInFlight() {
+	if d.inFlight == nil {
+		return
+	}
+	select {
+	case <-d.inFlight:
+	default:
+	}
 }
 
 func (d *Device) recvResponse() {
+	defer d.pollerExited()
 	var n int
 	buf := make([]byte, 4)
 	for resp := range d.respChan {
 		err := d.completeCommand(resp)
 		if err != nil {
 			log.Errorf("error completing command: %s", err)
+			d.fail(err)
 			return
 		}
+		// Complete whatever else is already waiting before notifying the
+		// kernel, so a busy device makes one write per batch rather than one
+		// per command. If nothing else is ready, notify right away.
+		more := true
+		for more {
+			select {
+			case resp, ok := <-d.respChan:
+				if !ok {
+					more = false
+					break
+				}
+				if err = d.completeCommand(resp); err != nil {
+					log.Errorf("error completing command: %s", err)
+					d.fail(err)
+					return
+				}
+			default:
+				more = false
+			}
+		}
 		/* Tell the fd there's something new */
 		n, err = unix.Write(d.uioFd, buf)
 		if n == -1 && err != nil {
-			log.Errorln("poll write")
+			log.Errorf("error writing uio device: %s", err)
+			d.fail(err)
 			return
 		}
 	}
 }
 
+// completeCommand writes resp into the next ring entry the kernel will read
+// completions from, at the tail. Commands may complete in any order, such as
+// from MultiThreadedDevReady's workers: the kernel matches each completion to
+// its command by the id in the entry, not by the entry's position, so the entry
+// at the tail is given resp's id whichever command it first carried. That entry
+// may belong to a command still being handled, whose CDB the response overwrites;
+// getNextCommand copies CDBs out of the ring for this reason.
 func (d *Device) completeCommand(resp SCSIResponse) error {
 	off := d.tailEntryOff()
 	for d.entHdrOp(off) != tcmuOpCmd {
@@ -67,13 +171,58 @@ func (d *Device) completeCommand(resp SCSIResponse) error {
 		d.setEntCmdId(off, resp.id)
 	}
 	d.setEntRespSCSIStatus(off, resp.status)
+	if resp.unknownOp {
+		d.setEntUflagUnknownOp(off)
+	}
+	if resp.residual > 0 && d.mbFlags()&tcmuMailboxFlagCapReadLen != 0 {
+		d.setEntRespReadLen(off, uint32(resp.readLen))
+		d.setEntUflagReadLen(off)
+	}
 	if resp.status != scsi.SamStatGood {
 		d.copyEntRespSenseData(off, resp.senseBuffer)
+		if resp.status == scsi.SamStatCheckCondition {
+			d.setLastSense(resp.senseBuffer)
+		}
 	}
 	d.mbSetTail((d.mbCmdTail() + uint32(d.entHdrGetLen(off))) % d.mbCmdrSize())
+	d.stats.complete(resp)
+	d.cancelCommand(resp.id)
+	d.releaseInFlight()
 	return nil
 }
 
+// context returns the context canceled when the device is closed.
+func (d *Device) context() context.Context {
+	if d.ctx == nil {
+		return context.Background()
+	}
+	return d.ctx
+}
+
+// commandContext returns a context for the command id, canceled by
+// cancelCommand once it is completed, or when the device is closed.
+func (d *Device) commandContext(id uint16) context.Context {
+	ctx, cancel := context.WithCancel(d.context())
+	d.cmdMu.Lock()
+	defer d.cmdMu.Unlock()
+	if d.cancels == nil {
+		d.cancels = make(map[uint16]context.CancelFunc)
+	}
+	d.cancels[id] = cancel
+	return ctx
+}
+
+// cancelCommand cancels the context of the command id, if it is in flight.
+func (d *Device) cancelCommand(id uint16) {
+	d.cmdMu.Lock()
+	cancel := d.cancels[id]
+	delete(d.cancels, id)
+	d.cmdMu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
 func (d *Device) getNextCommand() (*SCSICmd, error) {
 	//d.debugPrintMb()
 	//fmt.Printf("nextEntryOff: %d\n", d.nextEntryOff())
@@ -82,35 +231,113 @@ func (d *Device) getNextCommand() (*SCSICmd, error) {
 		off := d.nextEntryOff()
 		if d.entHdrOp(off) == tcmuOpPad {
 			d.cmdTail = (d.cmdTail + uint32(d.entHdrGetLen(off))) % d.mbCmdrSize()
+		} else if d.entHdrOp(off) == tcmuOpTmr {
+			// Task management notifications need no response; they are
+			// passed over like padding once the commands are completed.
+			if err := d.handleTMR(off); err != nil {
+				return nil, err
+			}
+			d.cmdTail = (d.cmdTail + uint32(d.entHdrGetLen(off))) % d.mbCmdrSize()
 		} else if d.entHdrOp(off) == tcmuOpCmd {
-			//d.printEnt(off)
 			out := &SCSICmd{
-				id:     d.entCmdId(off),
-				device: d,
+				id:        d.entCmdId(off),
+				device:    d,
+				start:     time.Now(),
+				initiator: d.initiator(),
 			}
-			out.cdb = d.entCdb(off)
+			out.ctx = d.commandContext(out.id)
+			// The entry may be reused for another command's response while
+			// this one is in flight; see completeCommand.
+			out.cdb = append([]byte(nil), d.entCdb(off)...)
 			vecs := int(d.entReqIovCnt(off))
+			bidiVecs := int(d.entReqIovBidiCnt(off))
+			difVecs := 0
+			if d.scsi.ProtectionInfo {
+				difVecs = int(d.entReqIovDifCnt(off))
+			}
+			if max := (d.entHdrGetLen(off) - offReqIov0Base) / iovSize; vecs < 0 || bidiVecs < 0 || difVecs < 0 || vecs+bidiVecs+difVecs > max {
+				return nil, fmt.Errorf("entry at %d has %d+%d+%d iovecs, room for %d", off, vecs, bidiVecs, difVecs, max)
+			}
 			out.vecs = make([][]byte, vecs)
 			for i := 0; i < vecs; i++ {
-				v := d.entIovecN(off, i)
+				v, err := d.entIovecN(off, i)
+				if err != nil {
+					return nil, err
+				}
 				out.vecs[i] = v
 			}
+			// The bidirectional iovecs follow the data iovecs.
+			out.bidiVecs = make([][]byte, bidiVecs)
+			for i := 0; i < bidiVecs; i++ {
+				v, err := d.entIovecN(off, vecs+i)
+				if err != nil {
+					return nil, err
+				}
+				out.bidiVecs[i] = v
+			}
+			// The protection information iovecs come last.
+			if difVecs > 0 {
+				out.difVecs = make([][]byte, difVecs)
+				for i := 0; i < difVecs; i++ {
+					v, err := d.entIovecN(off, vecs+bidiVecs+i)
+					if err != nil {
+						return nil, err
+					}
+					out.difVecs[i] = v
+				}
+			}
 			d.cmdTail = (d.cmdTail + uint32(d.entHdrGetLen(off))) % d.mbCmdrSize()
+			d.stats.receive(out)
 			return out, nil
 		} else {
-			panic(fmt.Sprintf("unsupported command from tcmu? %d", d.entHdrOp(off)))
+			return nil, fmt.Errorf("unsupported entry from tcmu:\n%s", d.dumpEntry(off))
 		}
 	}
 	return nil, nil
 }
 
-func (d *Device) printEnt(off int) {
-	for i, x := range d.mmap[off : off+d.entHdrGetLen(off)] {
-		fmt.Printf("0x%02x ", x)
-		if i%16 == 15 {
-			fmt.Printf("\n")
-		}
+// DumpCommand describes cmd for debugging: its opcode, CDB, LBA and transfer
+// length where the command has them, and its data buffers.
+func (d *Device) DumpCommand(cmd *SCSICmd) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: command %d: %s (0x%02x)\n", d.scsi.VolumeName, cmd.id, scsi.CommandName(cmd.Command(), cmd.ServiceAction()), cmd.Command())
+	fmt.Fprintf(&b, "  cdb: % x\n", cmd.cdb)
+	if lba, err := cmd.LBAE(); err == nil {
+		fmt.Fprintf(&b, "  lba: %d\n", lba)
+	}
+	if n, err := cmd.XferLenE(); err == nil {
+		fmt.Fprintf(&b, "  xfer len: %d\n", n)
+	}
+	fmt.Fprintf(&b, "  iovecs: %s\n", vecSizes(cmd.vecs))
+	if len(cmd.bidiVecs) > 0 {
+		fmt.Fprintf(&b, "  bidi iovecs: %s\n", vecSizes(cmd.bidiVecs))
+	}
+	if len(cmd.difVecs) > 0 {
+		fmt.Fprintf(&b, "  dif iovecs: %s\n", vecSizes(cmd.difVecs))
+	}
+	return b.String()
+}
+
+// vecSizes formats the number and sizes of vecs, as in "2 [4096 512]".
+func vecSizes(vecs [][]byte) string {
+	sizes := make([]string, len(vecs))
+	for i, v := range vecs {
+		sizes[i] = strconv.Itoa(len(v))
+	}
+	return fmt.Sprintf("%d [%s]", len(vecs), strings.Join(sizes, " "))
+}
+
+// dumpEntry describes the ring entry at off, with its header fields and a hex
+// dump of the whole entry, for reporting entries that can't be handled.
+func (d *Device) dumpEntry(off int) string {
+	end := off + d.entHdrGetLen(off)
+	if end <= off || end > len(d.mmap) {
+		// The length is corrupt; dump just the header.
+		end = off + entReqRespOff
 	}
+	return fmt.Sprintf("entry at %d: op %d len %d cmd_id %d kflags 0x%02x uflags 0x%02x\n%s",
+		off, d.entHdrOp(off), d.entHdrGetLen(off), d.entCmdId(off), d.entKflags(off), d.entUflags(off),
+		hex.Dump(d.mmap[off:end]))
 }
 
 func (d *Device) nextEntryOff() int {
@@ -0,0 +1,299 @@
+package tcmu
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-tcmu/scsi"
+)
+
+const (
+	testCmdrOff  = 128
+	testCmdrSize = 1024
+	testEntLen   = 256
+)
+
+// newTestRing returns a test device with a mapped mailbox and command ring
+// holding a command entry with each of ids, as the kernel would queue them.
+func newTestRing(ids ...uint16) *Device {
+	d := newTestDevice()
+	d.mmap = make([]byte, 4096)
+	byteOrder.PutUint16(d.mmap[0:], supportedMailboxVersion)
+	byteOrder.PutUint32(d.mmap[4:], testCmdrOff)
+	byteOrder.PutUint32(d.mmap[8:], testCmdrSize)
+	for i, id := range ids {
+		off := testCmdrOff + i*testEntLen
+		byteOrder.PutUint32(d.mmap[off+offLenOp:], testEntLen|tcmuOpCmd)
+		d.setEntCmdId(off, id)
+	}
+	byteOrder.PutUint32(d.mmap[12:], uint32(len(ids)*testEntLen))
+	return d
+}
+
+func TestCompleteCommandOutOfOrder(t *testing.T) {
+	d := newTestRing(1, 2)
+	cdb := []byte{scsi.Read10, 0, 0, 0, 0x12, 0x34, 0, 0, 8, 0}
+	for i := 0; i < 2; i++ {
+		// The CDB follows the request, where the response is written.
+		off := testCmdrOff + i*testEntLen
+		byteOrder.PutUint64(d.mmap[off+offReqCdbOff:], uint64(off+64))
+		copy(d.mmap[off+64:], cdb)
+	}
+	first, err := d.getNextCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := d.getNextCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := second.MediumError()
+
+	// The second command fails first, writing its sense data into the first
+	// command's entry.
+	if err := d.completeCommand(failed); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.cdb, cdb) {
+		t.Errorf("in flight command's CDB % x, want % x", first.cdb, cdb)
+	}
+	if err := d.completeCommand(first.Ok()); err != nil {
+		t.Fatal(err)
+	}
+
+	if tail := d.mbCmdTail(); tail != 2*testEntLen {
+		t.Errorf("tail %d, want %d", tail, 2*testEntLen)
+	}
+	want := []struct {
+		resp   SCSIResponse
+		status byte
+	}{
+		{failed, scsi.SamStatCheckCondition},
+		{first.Ok(), scsi.SamStatGood},
+	}
+	for i, w := range want {
+		off := testCmdrOff + i*testEntLen
+		if id := d.entCmdId(off); id != w.resp.ID() {
+			t.Errorf("entry %d completes id %d, want %d", i, id, w.resp.ID())
+		}
+		if status := d.mmap[off+offRespSCSIStatus]; status != w.status {
+			t.Errorf("entry %d status 0x%x, want 0x%x", i, status, w.status)
+		}
+	}
+	sense := d.mmap[testCmdrOff+offRespSense:]
+	if !bytes.Equal(sense[:len(failed.senseBuffer)], failed.senseBuffer) {
+		t.Errorf("sense % x, want % x", sense[:len(failed.senseBuffer)], failed.senseBuffer)
+	}
+}
+
+func TestCompleteCommandReadLen(t *testing.T) {
+	for _, capable := range []bool{false, true} {
+		d := newTestRing(1, 2)
+		if capable {
+			byteOrder.PutUint16(d.mmap[2:], tcmuMailboxFlagCapReadLen)
+		}
+		short, _ := newTestCmd([]byte{scsi.Inquiry, 0, 0, 0x01, 0x00, 0}, 512)
+		short.id = 1
+		full, _ := newTestCmd([]byte{scsi.Inquiry, 0, 0, 0, 8, 0}, 8)
+		full.id = 2
+		// A 256-byte allocation length is not truncated to its low byte.
+		resp := short.Respond(make([]byte, 300))
+		if resp.Residual() != 256 {
+			t.Fatalf("residual %d, want 256", resp.Residual())
+		}
+		if err := d.completeCommand(resp); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.completeCommand(full.Respond(make([]byte, 36))); err != nil {
+			t.Fatal(err)
+		}
+
+		off := testCmdrOff
+		flagged := d.entUflags(off)&0x02 != 0
+		if flagged != capable {
+			t.Errorf("capable %v: READ_LEN flag %v", capable, flagged)
+		}
+		if n := byteOrder.Uint32(d.mmap[off+offRespReadLen:]); capable && n != 256 {
+			t.Errorf("read_len %d, want 256", n)
+		}
+		if d.entUflags(off+testEntLen)&0x02 != 0 {
+			t.Error("READ_LEN flag set with no residual")
+		}
+	}
+}
+
+func TestDumpCommand(t *testing.T) {
+	cmd, _ := newTestCmd([]byte{scsi.Read10, 0, 0, 0, 0, 0x10, 0, 0, 8, 0}, 4096)
+	cmd.id = 7
+	dump := cmd.Device().DumpCommand(cmd)
+	for _, want := range []string{"command 7: READ_10 (0x28)", "cdb: 28 00 00 00 00 10 00 00 08 00", "lba: 16", "xfer len: 8", "iovecs: 1 [4096]"} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("dump missing %q:\n%s", want, dump)
+		}
+	}
+	if strings.Contains(dump, "bidi") {
+		t.Errorf("dump shows bidi iovecs:\n%s", dump)
+	}
+}
+
+func TestGetNextCommandUnsupportedEntry(t *testing.T) {
+	d := newTestRing(1)
+	// An opcode from a newer ABI.
+	byteOrder.PutUint32(d.mmap[testCmdrOff+offLenOp:], testEntLen|3)
+	cmd, err := d.getNextCommand()
+	if err == nil {
+		t.Fatalf("got %v, want an error", cmd)
+	}
+	if !strings.Contains(err.Error(), "op 3 len 256 cmd_id 1") {
+		t.Errorf("error lacks the entry dump: %v", err)
+	}
+}
+
+func TestCommandContext(t *testing.T) {
+	d := newTestRing(1, 2)
+	d.ctx, d.cancelCtx = context.WithCancel(context.Background())
+	first, err := d.getNextCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := d.getNextCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Context().Err() != nil || second.Context().Err() != nil {
+		t.Fatal("contexts canceled early")
+	}
+
+	if err := d.completeCommand(first.Ok()); err != nil {
+		t.Fatal(err)
+	}
+	if first.Context().Err() == nil {
+		t.Error("completed command's context not canceled")
+	}
+	if second.Context().Err() != nil {
+		t.Error("other command's context canceled")
+	}
+	d.cancelCtx()
+	if second.Context().Err() == nil {
+		t.Error("context not canceled with the device")
+	}
+}
+
+// tmfRecorder is a TMFHandler recording the functions it is told of.
+type tmfRecorder struct {
+	aborted []uint16
+	resets  int
+}
+
+func (r *tmfRecorder) AbortTask(id uint16) error {
+	r.aborted = append(r.aborted, id)
+	return nil
+}
+
+func (r *tmfRecorder) LunReset() error {
+	r.resets++
+	return nil
+}
+
+// putTMR turns the entry at index i of a newTestRing into a task management
+// notification of type typ for ids.
+func putTMR(d *Device, i int, typ byte, ids ...uint16) {
+	off := testCmdrOff + i*testEntLen
+	byteOrder.PutUint32(d.mmap[off+offLenOp:], testEntLen|tcmuOpTmr)
+	d.mmap[off+offTmrType] = typ
+	byteOrder.PutUint32(d.mmap[off+offTmrCmdCnt:], uint32(len(ids)))
+	for j, id := range ids {
+		byteOrder.PutUint16(d.mmap[off+offTmrCmdIds+2*j:], id)
+	}
+}
+
+func TestGetNextCommandTMR(t *testing.T) {
+	for _, tt := range []struct {
+		typ    byte
+		resets int
+	}{
+		{tcmuTmrAbortTask, 0},
+		{tcmuTmrLunReset, 1},
+	} {
+		d := newTestRing(1, 2, 0)
+		rec := &tmfRecorder{}
+		d.scsi.TMF = rec
+		putTMR(d, 2, tt.typ, 1)
+
+		var cmds []*SCSICmd
+		for {
+			cmd, err := d.getNextCommand()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cmd == nil {
+				break
+			}
+			cmds = append(cmds, cmd)
+		}
+		if len(cmds) != 2 {
+			t.Fatalf("type %d: got %d commands, want 2", tt.typ, len(cmds))
+		}
+		if cmds[0].Context().Err() == nil {
+			t.Errorf("type %d: aborted command's context not canceled", tt.typ)
+		}
+		if cmds[1].Context().Err() != nil {
+			t.Errorf("type %d: command 2 canceled", tt.typ)
+		}
+		if len(rec.aborted) != 1 || rec.aborted[0] != 1 {
+			t.Errorf("type %d: aborted %v, want [1]", tt.typ, rec.aborted)
+		}
+		if rec.resets != tt.resets {
+			t.Errorf("type %d: %d resets, want %d", tt.typ, rec.resets, tt.resets)
+		}
+
+		// The aborted command is still completed.
+		for _, cmd := range cmds {
+			if err := d.completeCommand(cmd.Ok()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tail := d.mbCmdTail(); tail != 2*testEntLen {
+			t.Errorf("type %d: tail %d, want %d", tt.typ, tail, 2*testEntLen)
+		}
+	}
+}
+
+func TestDrainCommandsMaxInFlight(t *testing.T) {
+	d := newTestRing(1, 2, 3)
+	d.inFlight = make(chan struct{}, 2)
+	d.cmdChan = make(chan *SCSICmd, 3)
+	drained := make(chan error, 1)
+	go func() { drained <- d.drainCommands() }()
+
+	first := <-d.cmdChan
+	<-d.cmdChan
+	select {
+	case cmd := <-d.cmdChan:
+		t.Fatalf("command %d dispatched beyond the limit", cmd.ID())
+	case <-drained:
+		t.Fatal("drainCommands returned with a command left in the ring")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := d.completeCommand(first.Ok()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case cmd := <-d.cmdChan:
+		if cmd.ID() != 3 {
+			t.Errorf("dispatched command %d, want 3", cmd.ID())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("command not dispatched after a slot was freed")
+	}
+	if err := <-drained; err != nil {
+		t.Fatal(err)
+	}
+	if n := len(d.inFlight); n != 2 {
+		t.Errorf("%d commands in flight, want 2", n)
+	}
+}
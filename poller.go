@@ -0,0 +1,160 @@
+package tcmu
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/prometheus/common/log"
+	"golang.org/x/sys/unix"
+)
+
+// Poller waits for kernel notifications on the uio devices of many Devices with
+// a single epoll loop, rather than each Device blocking an OS thread in read(2).
+// Commands are still dispatched to each Device's handler through its own
+// channels. Share a Poller by setting SCSIHandler.Poller before OpenTCMUDevice.
+type Poller struct {
+	epfd   int
+	wakeFd int
+
+	mu      sync.Mutex
+	devices map[int]*Device
+	closed  bool
+}
+
+// NewPoller creates a Poller and starts its event loop. It must be closed once
+// the devices using it are closed.
+func NewPoller() (*Poller, error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	wakeFd, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+	if err != nil {
+		unix.Close(epfd)
+		return nil, err
+	}
+	p := &Poller{
+		epfd:    epfd,
+		wakeFd:  wakeFd,
+		devices: make(map[int]*Device),
+	}
+	if err := p.ctl(unix.EPOLL_CTL_ADD, wakeFd); err != nil {
+		unix.Close(wakeFd)
+		unix.Close(epfd)
+		return nil, err
+	}
+	go p.run()
+	return p, nil
+}
+
+// Close stops the event loop. Devices still registered stop polling, as if
+// their uio device had failed.
+func (p *Poller) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	buf := []byte{1, 0, 0, 0, 0, 0, 0, 0}
+	_, err := unix.Write(p.wakeFd, buf)
+	return err
+}
+
+func (p *Poller) ctl(op int, fd int) error {
+	ev := unix.EpollEvent{
+		Events: unix.EPOLLIN,
+		Fd:     int32(fd),
+	}
+	return unix.EpollCtl(p.epfd, op, fd, &ev)
+}
+
+// add registers the device's uio fd. The device's kick channel receives a value
+// whenever the kernel signals new commands on the ring, and is closed when the
+// device is removed.
+func (p *Poller) add(d *Device) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errors.New("poller is closed")
+	}
+	d.kick = make(chan struct{}, 1)
+	if err := p.ctl(unix.EPOLL_CTL_ADD, d.uioFd); err != nil {
+		return err
+	}
+	p.devices[d.uioFd] = d
+	// Pick up anything queued before we started watching.
+	d.kick <- struct{}{}
+	return nil
+}
+
+// remove unregisters the device, if it is registered.
+func (p *Poller) remove(d *Device) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.devices[d.uioFd] != d {
+		return
+	}
+	unix.EpollCtl(p.epfd, unix.EPOLL_CTL_DEL, d.uioFd, nil)
+	delete(p.devices, d.uioFd)
+	close(d.kick)
+}
+
+func (p *Poller) run() {
+	events := make([]unix.EpollEvent, 64)
+	buf := make([]byte, 4)
+	var err error
+	for err == nil {
+		var n int
+		n, err = unix.EpollWait(p.epfd, events, -1)
+		if err == unix.EINTR {
+			err = nil
+			continue
+		}
+		if err != nil {
+			break
+		}
+		p.mu.Lock()
+		for _, ev := range events[:n] {
+			fd := int(ev.Fd)
+			if fd == p.wakeFd {
+				err = errors.New("poller is closed")
+				break
+			}
+			d, ok := p.devices[fd]
+			if !ok {
+				continue
+			}
+			// Consume the uio event count, as the blocking read would.
+			if _, rerr := unix.Read(fd, buf); rerr != nil {
+				log.Errorf("error reading uio device: %s", rerr)
+				d.fail(rerr)
+				unix.EpollCtl(p.epfd, unix.EPOLL_CTL_DEL, fd, nil)
+				delete(p.devices, fd)
+				close(d.kick)
+				continue
+			}
+			select {
+			case d.kick <- struct{}{}:
+			default:
+			}
+		}
+		p.mu.Unlock()
+	}
+
+	p.mu.Lock()
+	if !p.closed {
+		log.Errorf("error waiting for uio devices: %s", err)
+	}
+	for fd, d := range p.devices {
+		if !p.closed {
+			d.fail(err)
+		}
+		delete(p.devices, fd)
+		close(d.kick)
+	}
+	p.closed = true
+	p.mu.Unlock()
+	unix.Close(p.wakeFd)
+	unix.Close(p.epfd)
+}
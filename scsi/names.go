@@ -0,0 +1,178 @@
+package scsi
+
+import "fmt"
+
+// opcodeNames are the names OpcodeName returns. Where an opcode has more than
+// one meaning, it is named for its use by block devices.
+var opcodeNames = map[byte]string{
+	TestUnitReady:              "TEST_UNIT_READY",
+	RezeroUnit:                 "REZERO_UNIT",
+	RequestSense:               "REQUEST_SENSE",
+	FormatUnit:                 "FORMAT_UNIT",
+	ReadBlockLimits:            "READ_BLOCK_LIMITS",
+	ReassignBlocks:             "REASSIGN_BLOCKS",
+	Read6:                      "READ_6",
+	Write6:                     "WRITE_6",
+	Seek6:                      "SEEK_6",
+	ReadReverse:                "READ_REVERSE",
+	WriteFilemarks:             "WRITE_FILEMARKS",
+	Space:                      "SPACE",
+	Inquiry:                    "INQUIRY",
+	RecoverBufferedData:        "RECOVER_BUFFERED_DATA",
+	ModeSelect:                 "MODE_SELECT",
+	Reserve:                    "RESERVE",
+	Release:                    "RELEASE",
+	Copy:                       "COPY",
+	Erase:                      "ERASE",
+	ModeSense:                  "MODE_SENSE",
+	StartStop:                  "START_STOP",
+	ReceiveDiagnostic:          "RECEIVE_DIAGNOSTIC",
+	SendDiagnostic:             "SEND_DIAGNOSTIC",
+	AllowMediumRemoval:         "ALLOW_MEDIUM_REMOVAL",
+	ReadFormatCapacities:       "READ_FORMAT_CAPACITIES",
+	SetWindow:                  "SET_WINDOW",
+	ReadCapacity:               "READ_CAPACITY",
+	Read10:                     "READ_10",
+	Write10:                    "WRITE_10",
+	Seek10:                     "SEEK_10",
+	WriteVerify:                "WRITE_VERIFY",
+	Verify:                     "VERIFY",
+	SearchHigh:                 "SEARCH_HIGH",
+	SearchEqual:                "SEARCH_EQUAL",
+	SearchLow:                  "SEARCH_LOW",
+	SetLimits:                  "SET_LIMITS",
+	PreFetch:                   "PRE_FETCH",
+	SynchronizeCache:           "SYNCHRONIZE_CACHE",
+	LockUnlockCache:            "LOCK_UNLOCK_CACHE",
+	ReadDefectData:             "READ_DEFECT_DATA",
+	MediumScan:                 "MEDIUM_SCAN",
+	Compare:                    "COMPARE",
+	CopyVerify:                 "COPY_VERIFY",
+	WriteBuffer:                "WRITE_BUFFER",
+	ReadBuffer:                 "READ_BUFFER",
+	UpdateBlock:                "UPDATE_BLOCK",
+	ReadLong:                   "READ_LONG",
+	WriteLong:                  "WRITE_LONG",
+	ChangeDefinition:           "CHANGE_DEFINITION",
+	WriteSame:                  "WRITE_SAME",
+	Unmap:                      "UNMAP",
+	ReadToc:                    "READ_TOC",
+	ReadHeader:                 "READ_HEADER",
+	GetEventStatusNotification: "GET_EVENT_STATUS_NOTIFICATION",
+	LogSelect:                  "LOG_SELECT",
+	LogSense:                   "LOG_SENSE",
+	Xdwriteread10:              "XDWRITEREAD_10",
+	ModeSelect10:               "MODE_SELECT_10",
+	Reserve10:                  "RESERVE_10",
+	Release10:                  "RELEASE_10",
+	ModeSense10:                "MODE_SENSE_10",
+	PersistentReserveIn:        "PERSISTENT_RESERVE_IN",
+	PersistentReserveOut:       "PERSISTENT_RESERVE_OUT",
+	VariableLengthCmd:          "VARIABLE_LENGTH_CMD",
+	ExtendedCopy:               "EXTENDED_COPY",
+	ReceiveCopyResults:         "RECEIVE_COPY_RESULTS",
+	AtaPassThrough16:           "ATA_PASS_THROUGH_16",
+	AccessControlIn:            "ACCESS_CONTROL_IN",
+	AccessControlOut:           "ACCESS_CONTROL_OUT",
+	Read16:                     "READ_16",
+	CompareAndWrite:            "COMPARE_AND_WRITE",
+	Write16:                    "WRITE_16",
+	ReadAttribute:              "READ_ATTRIBUTE",
+	WriteAttribute:             "WRITE_ATTRIBUTE",
+	WriteVerify16:              "WRITE_VERIFY_16",
+	Verify16:                   "VERIFY_16",
+	PreFetch16:                 "PRE_FETCH_16",
+	SynchronizeCache16:         "SYNCHRONIZE_CACHE_16",
+	WriteSame16:                "WRITE_SAME_16",
+	ServiceActionBidirectional: "SERVICE_ACTION_BIDIRECTIONAL",
+	ServiceActionIn16:          "SERVICE_ACTION_IN_16",
+	ServiceActionOut16:         "SERVICE_ACTION_OUT_16",
+	ReportLuns:                 "REPORT_LUNS",
+	AtaPassThrough12:           "ATA_PASS_THROUGH_12",
+	SecurityProtocolIn:         "SECURITY_PROTOCOL_IN",
+	MaintenanceIn:              "MAINTENANCE_IN",
+	MaintenanceOut:             "MAINTENANCE_OUT",
+	MoveMedium:                 "MOVE_MEDIUM",
+	ExchangeMedium:             "EXCHANGE_MEDIUM",
+	Read12:                     "READ_12",
+	ServiceActionOut12:         "SERVICE_ACTION_OUT_12",
+	Write12:                    "WRITE_12",
+	ServiceActionIn12:          "SERVICE_ACTION_IN_12",
+	WriteVerify12:              "WRITE_VERIFY_12",
+	Verify12:                   "VERIFY_12",
+	SearchHigh12:               "SEARCH_HIGH_12",
+	SearchEqual12:              "SEARCH_EQUAL_12",
+	SearchLow12:                "SEARCH_LOW_12",
+	SecurityProtocolOut:        "SECURITY_PROTOCOL_OUT",
+	SendVolumeTag:              "SEND_VOLUME_TAG",
+	ReadDefectData12:           "READ_DEFECT_DATA_12",
+	ReadElementStatus:          "READ_ELEMENT_STATUS",
+	WriteLong2:                 "WRITE_LONG_2",
+}
+
+// serviceAction is an opcode and one of its service actions.
+type serviceAction struct {
+	op byte
+	sa uint16
+}
+
+// serviceActionNames are the names CommandName returns for service actions.
+var serviceActionNames = map[serviceAction]string{
+	{ServiceActionIn16, SaiReadCapacity16}:                    "READ_CAPACITY_16",
+	{ServiceActionIn16, SaiGetLbaStatus}:                      "GET_LBA_STATUS",
+	{ServiceActionIn16, SaiReportReferrals}:                   "REPORT_REFERRALS",
+	{MaintenanceIn, MiReportIdentifyingInformation}:           "REPORT_IDENTIFYING_INFORMATION",
+	{MaintenanceIn, MiReportTargetPgs}:                        "REPORT_TARGET_PGS",
+	{MaintenanceIn, MiReportAliases}:                          "REPORT_ALIASES",
+	{MaintenanceIn, MiReportSupportedOperationCodes}:          "REPORT_SUPPORTED_OPERATION_CODES",
+	{MaintenanceIn, MiReportSupportedTaskManagementFunctions}: "REPORT_SUPPORTED_TASK_MANAGEMENT_FUNCTIONS",
+	{MaintenanceIn, MiReportPriority}:                         "REPORT_PRIORITY",
+	{MaintenanceIn, MiReportTimestamp}:                        "REPORT_TIMESTAMP",
+	{MaintenanceIn, MiManagementProtocolIn}:                   "MANAGEMENT_PROTOCOL_IN",
+	{MaintenanceOut, MoSetIdentifyingInformation}:             "SET_IDENTIFYING_INFORMATION",
+	{MaintenanceOut, MoSetTargetPgs}:                          "SET_TARGET_PGS",
+	{MaintenanceOut, MoChangeAliases}:                         "CHANGE_ALIASES",
+	{MaintenanceOut, MoSetPriority}:                           "SET_PRIORITY",
+	{MaintenanceOut, MoSetTimestamp}:                          "SET_TIMESTAMP",
+	{MaintenanceOut, MoManagementProtocolOut}:                 "MANAGEMENT_PROTOCOL_OUT",
+	{PersistentReserveIn, PriReadKeys}:                        "PERSISTENT_RESERVE_IN/READ_KEYS",
+	{PersistentReserveIn, PriReadReservation}:                 "PERSISTENT_RESERVE_IN/READ_RESERVATION",
+	{PersistentReserveIn, PriReportCapabilities}:              "PERSISTENT_RESERVE_IN/REPORT_CAPABILITIES",
+	{PersistentReserveIn, PriReadFullStatus}:                  "PERSISTENT_RESERVE_IN/READ_FULL_STATUS",
+	{PersistentReserveOut, ProRegister}:                       "PERSISTENT_RESERVE_OUT/REGISTER",
+	{PersistentReserveOut, ProReserve}:                        "PERSISTENT_RESERVE_OUT/RESERVE",
+	{PersistentReserveOut, ProRelease}:                        "PERSISTENT_RESERVE_OUT/RELEASE",
+	{PersistentReserveOut, ProClear}:                          "PERSISTENT_RESERVE_OUT/CLEAR",
+	{PersistentReserveOut, ProPreempt}:                        "PERSISTENT_RESERVE_OUT/PREEMPT",
+	{PersistentReserveOut, ProPreemptAndAbort}:                "PERSISTENT_RESERVE_OUT/PREEMPT_AND_ABORT",
+	{PersistentReserveOut, ProRegisterAndIgnoreExistingKey}:   "PERSISTENT_RESERVE_OUT/REGISTER_AND_IGNORE_EXISTING_KEY",
+	{PersistentReserveOut, ProRegisterAndMove}:                "PERSISTENT_RESERVE_OUT/REGISTER_AND_MOVE",
+	{VariableLengthCmd, Read32}:                               "READ_32",
+	{VariableLengthCmd, Write32}:                              "WRITE_32",
+	{VariableLengthCmd, Verify32}:                             "VERIFY_32",
+	{VariableLengthCmd, WriteSame32}:                          "WRITE_SAME_32",
+}
+
+// OpcodeName returns the name of the command with opcode op, such as "READ_10",
+// for logging. Unknown opcodes are given in hex.
+func OpcodeName(op byte) string {
+	if name, ok := opcodeNames[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", op)
+}
+
+// CommandName is OpcodeName, naming commands that share an opcode, such as
+// READ CAPACITY (16) under SERVICE ACTION IN (16), by their service action sa.
+// For other opcodes sa is ignored.
+func CommandName(op byte, sa uint16) string {
+	if name, ok := serviceActionNames[serviceAction{op, sa}]; ok {
+		return name
+	}
+	switch op {
+	case ServiceActionIn16, ServiceActionOut16, MaintenanceIn, MaintenanceOut,
+		PersistentReserveIn, PersistentReserveOut, VariableLengthCmd:
+		return fmt.Sprintf("%s/0x%02x", OpcodeName(op), sa)
+	}
+	return OpcodeName(op)
+}
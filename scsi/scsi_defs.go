@@ -81,6 +81,7 @@ const (
 	PersistentReserveOut       = 0x5f
 	VariableLengthCmd          = 0x7f
 	ReportLuns                 = 0xa0
+	AtaPassThrough12           = 0xa1
 	SecurityProtocolIn         = 0xa2
 	MaintenanceIn              = 0xa3
 	MaintenanceOut             = 0xa4
@@ -97,11 +98,13 @@ const (
 	SearchEqual12              = 0xb1
 	SearchLow12                = 0xb2
 	SecurityProtocolOut        = 0xb5
+	ReadDefectData12           = 0xb7
 	ReadElementStatus          = 0xb8
 	SendVolumeTag              = 0xb6
 	WriteLong2                 = 0xea
 	ExtendedCopy               = 0x83
 	ReceiveCopyResults         = 0x84
+	AtaPassThrough16           = 0x85
 	AccessControlIn            = 0x86
 	AccessControlOut           = 0x87
 	Read16                     = 0x88
@@ -111,6 +114,7 @@ const (
 	WriteAttribute             = 0x8d
 	WriteVerify16              = 0x8e
 	Verify16                   = 0x8f
+	PreFetch16                 = 0x90
 	SynchronizeCache16         = 0x91
 	WriteSame16                = 0x93
 	ServiceActionBidirectional = 0x9d
@@ -141,6 +145,20 @@ const (
 	MoSetPriority               = 0x0e
 	MoSetTimestamp              = 0x0f
 	MoManagementProtocolOut     = 0x10
+	/* values for persistent reserve in */
+	PriReadKeys           = 0x00
+	PriReadReservation    = 0x01
+	PriReportCapabilities = 0x02
+	PriReadFullStatus     = 0x03
+	/* values for persistent reserve out */
+	ProRegister                     = 0x00
+	ProReserve                      = 0x01
+	ProRelease                      = 0x02
+	ProClear                        = 0x03
+	ProPreempt                      = 0x04
+	ProPreemptAndAbort              = 0x05
+	ProRegisterAndIgnoreExistingKey = 0x06
+	ProRegisterAndMove              = 0x07
 	/* values for variable length command */
 	Xdread32      = 0x03
 	Xdwrite32     = 0x04
@@ -184,8 +202,28 @@ const (
 	AscMiscompareDuringVerifyOperation = 0x1d00
 	AscInvalidFieldInCdb               = 0x2400
 	AscInvalidFieldInParameterList     = 0x2600
+	AscWriteProtected                  = 0x2700
+	AscPowerOnReset                    = 0x2900
+	AscInitializingCommandRequired     = 0x0402
+	AscInvalidCommandOperationCode     = 0x2000
+	AscLBAOutOfRange                   = 0x2100
+	AscFormatInProgress                = 0x0404
+	AscOperationInProgress             = 0x0016
+	AscNotReadyOperationInProgress     = 0x0407
+	AscTargetPortTransitioning         = 0x040a
+	AscTargetPortStandby               = 0x040b
+	AscTargetPortUnavailable           = 0x040c
+	AscTargetPortOffline               = 0x0412
+	AscInvalidReleaseOfReservation     = 0x2604
+	AscMediumRemovalPrevented          = 0x5302
 )
 
+// SplitAsc splits a sense code above, such as AscFormatInProgress, into its
+// additional sense code and additional sense code qualifier.
+func SplitAsc(code uint16) (asc, ascq byte) {
+	return byte(code >> 8), byte(code)
+}
+
 /*
  * Sense Keys
  */
@@ -1,13 +1,19 @@
 package tcmu
 
 import (
+	"context"
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/coreos/go-tcmu/scsi"
 	"github.com/prometheus/common/log"
@@ -21,9 +27,59 @@ type SCSICmd struct {
 	offset    int
 	vecoffset int
 	device    *Device
+	start     time.Time
+
+	// initiator is the I_T nexus the command came in on; see InitiatorID.
+	initiator string
+
+	// ctx is canceled once the command completes; see Context.
+	ctx context.Context
+
+	// bidiVecs hold the data-in half of a bidirectional command.
+	bidiVecs      [][]byte
+	bidiOffset    int
+	bidiVecoffset int
+
+	// difVecs hold the protection information, if SCSIHandler.ProtectionInfo is set.
+	difVecs      [][]byte
+	difOffset    int
+	difVecoffset int
 
 	// Buf, if provided, may be used as a scratch buffer for copying data to and from the kernel.
+	// It belongs to the DevReady goroutine, which reuses it for the next command.
+	// A handler that keeps using it, or a slice of it such as from DataBuffer,
+	// after HandleCommand returns, eg, to complete the command asynchronously,
+	// must set Buf to nil before returning; a new scratch buffer is then
+	// allocated for the next command.
 	Buf []byte
+
+	// mu guards the data buffers against a handler that is still running after
+	// the command was abandoned for exceeding SCSIHandler.CommandTimeout.
+	mu        sync.Mutex
+	abandoned bool
+}
+
+// errAbandoned is returned by a command's Read and Write methods once the
+// command has been completed without waiting for its handler.
+var errAbandoned = errors.New("scsi cmd abandoned after timing out")
+
+// abandon stops the command's handler from touching the data buffers, which
+// the kernel may reuse as soon as the command is completed.
+func (c *SCSICmd) abandon() {
+	c.mu.Lock()
+	c.abandoned = true
+	c.mu.Unlock()
+}
+
+// Context returns the command's context, for handlers doing I/O against backends
+// that can be canceled. It is canceled once the command has been completed,
+// including when it is failed for exceeding SCSIHandler.CommandTimeout while
+// the handler is still running, and when the device is closed.
+func (c *SCSICmd) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
 }
 
 // Command returns the SCSI command byte for the command. Useful when used as a comparison to the constants in the scsi package:
@@ -32,82 +88,234 @@ func (c *SCSICmd) Command() byte {
 	return c.cdb[0]
 }
 
-// CdbLen returns the length of the command, in bytes.
+// ID returns the kernel's id for the command, which its response carries too. Ids
+// are unique among the commands outstanding on a device, but are reused.
+func (c *SCSICmd) ID() uint16 {
+	return c.id
+}
+
+// InitiatorID identifies the I_T nexus the command came in on, for state kept
+// per initiator, such as persistent reservations. The kernel doesn't pass the
+// initiator on to TCMU, so it is the same for every command on a device: the
+// initiator port name of the loopback nexus, or empty on other fabrics.
+func (c *SCSICmd) InitiatorID() string {
+	return c.initiator
+}
+
+// CdbLen returns the length of the command, in bytes. It panics if the opcode
+// is reserved or vendor specific; use CdbLenE to get an error instead.
 func (c *SCSICmd) CdbLen() int {
+	n, err := c.CdbLenE()
+	if err != nil {
+		panic(err.Error())
+	}
+	return n
+}
+
+// CdbLenE returns the length of the command, in bytes, or an error if the
+// length can't be determined from the opcode.
+func (c *SCSICmd) CdbLenE() (int, error) {
 	opcode := c.cdb[0]
 	// See spc-4 4.2.5.1 operation code
 	//
 	if opcode <= 0x1f {
-		return 6
+		return 6, nil
 	} else if opcode <= 0x5f {
-		return 10
+		return 10, nil
 	} else if opcode == 0x7f {
-		return int(c.cdb[7]) + 8
+		return int(c.cdb[7]) + 8, nil
 	} else if opcode >= 0x80 && opcode <= 0x9f {
-		return 16
+		return 16, nil
 	} else if opcode >= 0xa0 && opcode <= 0xbf {
-		return 12
+		return 12, nil
 	}
-	panic(fmt.Sprintf("what opcode is %x", opcode))
+	return 0, fmt.Errorf("what opcode is %x", opcode)
 }
 
-// LBA returns the block address that this command wishes to access.
+// LBA returns the block address that this command wishes to access. It panics
+// if the CDB has no LBA field; use LBAE to get an error instead.
 func (c *SCSICmd) LBA() uint64 {
+	lba, err := c.LBAE()
+	if err != nil {
+		panic(err.Error())
+	}
+	return lba
+}
+
+// LBAE returns the block address that this command wishes to access, or an
+// error if the CDB has no LBA field.
+func (c *SCSICmd) LBAE() (uint64, error) {
 	order := binary.BigEndian
 
-	switch c.CdbLen() {
+	n, err := c.CdbLenE()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
 	case 6:
 		val6 := uint8(order.Uint16(c.cdb[2:4]))
 		if val6 == 0 {
-			return 256
+			return 256, nil
 		}
-		return uint64(val6)
+		return uint64(val6), nil
 	case 10:
-		return uint64(order.Uint32(c.cdb[2:6]))
+		return uint64(order.Uint32(c.cdb[2:6])), nil
 	case 12:
-		return uint64(order.Uint32(c.cdb[2:6]))
+		return uint64(order.Uint32(c.cdb[2:6])), nil
 	case 16:
-		return uint64(order.Uint64(c.cdb[2:10]))
+		return uint64(order.Uint64(c.cdb[2:10])), nil
 	default:
-		log.Errorf("What LBA has this length: %d", c.CdbLen())
-		panic("unusal scsi command length")
+		log.Errorf("What LBA has this length: %d", n)
+		return 0, fmt.Errorf("unusual scsi command length %d", n)
 	}
 }
 
 // XferLen returns the length of the data buffer this command provides for transfering data to/from the kernel.
+// It panics if the CDB has no transfer length field; use XferLenE to get an error instead.
 func (c *SCSICmd) XferLen() uint32 {
+	n, err := c.XferLenE()
+	if err != nil {
+		panic(err.Error())
+	}
+	return n
+}
+
+// XferLenE returns the transfer length field of the command, or an error if the
+// CDB has no transfer length field.
+func (c *SCSICmd) XferLenE() (uint32, error) {
 	order := binary.BigEndian
-	switch c.CdbLen() {
+	n, err := c.CdbLenE()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
 	case 6:
-		return uint32(c.cdb[4])
+		return uint32(c.cdb[4]), nil
 	case 10:
-		return uint32(order.Uint16(c.cdb[7:9]))
+		return uint32(order.Uint16(c.cdb[7:9])), nil
 	case 12:
-		return uint32(order.Uint32(c.cdb[6:10]))
+		return uint32(order.Uint32(c.cdb[6:10])), nil
 	case 16:
-		return uint32(order.Uint32(c.cdb[10:14]))
+		return uint32(order.Uint32(c.cdb[10:14])), nil
 	default:
-		log.Errorf("What XferLen has this length: %d", c.CdbLen())
-		panic("unusal scsi command length")
+		log.Errorf("What XferLen has this length: %d", n)
+		return 0, fmt.Errorf("unusual scsi command length %d", n)
 	}
 }
 
 // Write, for a SCSICmd, is a io.Writer to the data buffer attached to this SCSI command.
 // It's writing *to* the buffer, which happens most commonly when responding to Read commands (take data and write it back to the kernel buffer)
 func (c *SCSICmd) Write(b []byte) (n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.abandoned {
+		return 0, errAbandoned
+	}
+	return writeVecs(c.vecs, &c.vecoffset, &c.offset, b)
+}
+
+// Respond writes data to the command's data-in buffer and returns Ok, for the
+// common case of a command returning parameter data, such as INQUIRY. data is
+// truncated to the allocation length and to the size of the buffer. If it is
+// shorter, the rest of the buffer is left untouched, and the number of bytes
+// not written is recorded as the response's residual count.
+func (c *SCSICmd) Respond(data []byte) SCSIResponse {
+	if n, err := c.allocLen(); err == nil && int(n) < len(data) {
+		data = data[:n]
+	}
+	n, err := c.Write(data)
+	if err == errAbandoned {
+		return c.TargetFailure()
+	}
+	// Any other error is data overflowing the buffer, which is truncated.
+	resp := c.Ok()
+	resp.residual = c.dataLen() - n
+	resp.readLen = n
+	return resp
+}
+
+// allocLen returns the allocation length of a command returning parameter
+// data. It is the transfer length field, except for the 6-byte commands whose
+// allocation length is two bytes wide, and READ BLOCK LIMITS, which has none
+// and always returns 6 bytes.
+func (c *SCSICmd) allocLen() (uint32, error) {
+	switch c.Command() {
+	case scsi.Inquiry, scsi.ReceiveDiagnostic:
+		return uint32(binary.BigEndian.Uint16(c.cdb[3:5])), nil
+	case scsi.ReadBlockLimits:
+		return 6, nil
+	}
+	return c.XferLenE()
+}
+
+// dataLen returns the size of the command's data buffer.
+func (c *SCSICmd) dataLen() int {
+	n := 0
+	for _, v := range c.vecs {
+		n += len(v)
+	}
+	return n
+}
+
+// IOVecs returns the command's data buffers, which are part of the ring shared
+// with the kernel. Handlers may read data-out from them, or fill them in with
+// data-in, directly rather than through Read and Write, saving a copy. The
+// slice is a copy; only the buffers are shared. They must not be touched
+// after the handler returns, nor at all by handlers that may be abandoned by
+// SCSIHandler.CommandTimeout.
+func (c *SCSICmd) IOVecs() [][]byte {
+	return append([][]byte(nil), c.vecs...)
+}
+
+// WriteBidi writes to the data-in buffer of a bidirectional command, such as
+// XDWRITEREAD. For these commands Read returns the data-out half, and WriteBidi
+// fills in the data returned to the initiator.
+func (c *SCSICmd) WriteBidi(b []byte) (n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.abandoned {
+		return 0, errAbandoned
+	}
+	return writeVecs(c.bidiVecs, &c.bidiVecoffset, &c.bidiOffset, b)
+}
+
+// ProtectionInfo returns the buffers holding the T10 protection information
+// (the 8-byte guard, application and reference tags of each block) that
+// accompanies the command's data. For writes they contain the tags sent by the
+// initiator, to be checked against the data; for reads they may be filled in
+// directly, or with WriteProtectionInfo. It returns nil unless
+// SCSIHandler.ProtectionInfo is set and the kernel passed protection
+// information with the command.
+func (c *SCSICmd) ProtectionInfo() [][]byte {
+	return c.difVecs
+}
+
+// WriteProtectionInfo writes computed protection information for a read to the
+// command's protection information buffers, continuing where the last call left
+// off.
+func (c *SCSICmd) WriteProtectionInfo(b []byte) (n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.abandoned {
+		return 0, errAbandoned
+	}
+	return writeVecs(c.difVecs, &c.difVecoffset, &c.difOffset, b)
+}
+
+func writeVecs(vecs [][]byte, vecoffset *int, offset *int, b []byte) (n int, err error) {
 	toWrite := len(b)
 	boff := 0
 	for toWrite != 0 {
-		if c.vecoffset == len(c.vecs) {
+		if *vecoffset == len(vecs) {
 			return boff, errors.New("out of buffer scsi cmd buffer space")
 		}
-		wrote := copy(c.vecs[c.vecoffset][c.offset:], b[boff:])
+		wrote := copy(vecs[*vecoffset][*offset:], b[boff:])
 		boff += wrote
 		toWrite -= wrote
-		c.offset += wrote
-		if c.offset == len(c.vecs[c.vecoffset]) {
-			c.vecoffset++
-			c.offset = 0
+		*offset += wrote
+		if *offset == len(vecs[*vecoffset]) {
+			*vecoffset++
+			*offset = 0
 		}
 	}
 	return boff, nil
@@ -116,6 +324,11 @@ func (c *SCSICmd) Write(b []byte) (n int, err error) {
 // Read, for a SCSICmd, is a io.Reader from the data buffer attached to this SCSI command.
 // If there's data to be written to the virtual device, this is the way to access it.
 func (c *SCSICmd) Read(b []byte) (n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.abandoned {
+		return 0, errAbandoned
+	}
 	toRead := len(b)
 	boff := 0
 	for toRead != 0 {
@@ -134,6 +347,26 @@ func (c *SCSICmd) Read(b []byte) (n int, err error) {
 	return boff, nil
 }
 
+// DataBuffer returns a slice of Buf sized for the command's transfer length in
+// blocks, growing Buf if it is too small. The slice is scratch space only valid
+// while handling this command: the next command handled may reuse it, unless
+// Buf is set to nil.
+func (c *SCSICmd) DataBuffer() []byte {
+	n, err := c.XferLenE()
+	if err != nil {
+		return nil
+	}
+	return c.buffer(int(n) * int(c.Device().Sizes().BlockSize))
+}
+
+// buffer returns the first n bytes of Buf, reallocating it if it is too small.
+func (c *SCSICmd) buffer(n int) []byte {
+	if len(c.Buf) < n {
+		c.Buf = make([]byte, n)
+	}
+	return c.Buf[:n]
+}
+
 // Device accesses the details of the SCSI device this command is handling.
 func (c *SCSICmd) Device() *Device {
 	return c.device
@@ -141,10 +374,7 @@ func (c *SCSICmd) Device() *Device {
 
 // Ok creates a SCSIResponse to this command with SAM_STAT_GOOD, the common case for commands that succeed.
 func (c *SCSICmd) Ok() SCSIResponse {
-	return SCSIResponse{
-		id:     c.id,
-		status: scsi.SamStatGood,
-	}
+	return c.RespondStatus(scsi.SamStatGood)
 }
 
 // GetCDB returns the byte at `index` inside the command.
@@ -152,12 +382,40 @@ func (c *SCSICmd) GetCDB(index int) byte {
 	return c.cdb[index]
 }
 
+// CDB returns a copy of the command descriptor block. The copy may be kept and
+// modified freely; the original lives in memory shared with the kernel.
+func (c *SCSICmd) CDB() []byte {
+	n, err := c.CdbLenE()
+	if err != nil || n > len(c.cdb) {
+		n = len(c.cdb)
+	}
+	out := make([]byte, n)
+	copy(out, c.cdb)
+	return out
+}
+
+// ServiceAction returns the service action field of commands that have one, such
+// as SERVICE ACTION IN and MAINTENANCE IN, and zero for other commands.
+func (c *SCSICmd) ServiceAction() uint16 {
+	switch c.cdb[0] {
+	case scsi.VariableLengthCmd:
+		if len(c.cdb) < 10 {
+			return 0
+		}
+		return binary.BigEndian.Uint16(c.cdb[8:10])
+	case scsi.PersistentReserveIn, scsi.PersistentReserveOut,
+		scsi.ExtendedCopy, scsi.ReceiveCopyResults,
+		scsi.ServiceActionIn16, scsi.ServiceActionOut16,
+		scsi.MaintenanceIn, scsi.MaintenanceOut,
+		scsi.ServiceActionIn12, scsi.ServiceActionOut12:
+		return uint16(c.cdb[1] & 0x1f)
+	}
+	return 0
+}
+
 // RespondStatus returns a SCSIResponse with the given status byte set. Ok() is equivalent to RespondStatus(scsi.SamStatGood).
 func (c *SCSICmd) RespondStatus(status byte) SCSIResponse {
-	return SCSIResponse{
-		id:     c.id,
-		status: status,
-	}
+	return c.RespondSenseData(status, nil)
 }
 
 // RespondSenseData returns a SCSIResponse with the given status byte set and takes a byte array representing the SCSI sense data to be written.
@@ -166,38 +424,133 @@ func (c *SCSICmd) RespondSenseData(status byte, sense []byte) SCSIResponse {
 		id:          c.id,
 		status:      status,
 		senseBuffer: sense,
+		start:       c.start,
 	}
 }
 
 // NotHandled creates a response and sense data that tells the kernel this device does not emulate this command.
+// The response also carries the TCMU UNKNOWN_OP flag.
 func (c *SCSICmd) NotHandled() SCSIResponse {
-	buf := make([]byte, tcmuSenseBufferSize)
-	buf[0] = 0x70 /* fixed, current */
-	buf[2] = 0x5  /* illegal request */
-	buf[7] = 0xa
-	buf[12] = 0x20 /* ASC: invalid command operation code */
-	buf[13] = 0x0  /* ASCQ: (none) */
-
-	return SCSIResponse{
-		id:          c.id,
-		status:      scsi.SamStatCheckCondition,
-		senseBuffer: buf,
-	}
+	resp := c.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidCommandOperationCode)
+	resp.unknownOp = true
+	return resp
 }
 
 // CheckCondition returns a response providing extra sense data. Takes a Sense Key and an Additional Sense Code.
+// The sense data is in the format selected by SCSIHandler.SenseFormat.
 func (c *SCSICmd) CheckCondition(key byte, asc uint16) SCSIResponse {
-	buf := make([]byte, tcmuSenseBufferSize)
+	a, q := scsi.SplitAsc(asc)
+	return c.CheckConditionEx(key, a, q)
+}
+
+// CheckConditionEx is CheckCondition with the additional sense code and its
+// qualifier given separately, for codes not among the scsi.Asc constants.
+func (c *SCSICmd) CheckConditionEx(key, asc, ascq byte) SCSIResponse {
+	return c.RespondSense(Sense{Key: key, ASC: asc, ASCQ: ascq})
+}
+
+// checkConditionInfo is CheckCondition with the INFORMATION field set, eg, to
+// the LBA that failed.
+func (c *SCSICmd) checkConditionInfo(key byte, asc uint16, info uint64) SCSIResponse {
+	s := NewSense(key, asc)
+	s.Info = &info
+	return c.RespondSense(s)
+}
+
+// RespondSense returns a CHECK CONDITION response with the sense data s, in the
+// format selected by SCSIHandler.SenseFormat.
+func (c *SCSICmd) RespondSense(s Sense) SCSIResponse {
+	if c.senseFormat() == DescriptorSense {
+		return c.RespondSenseData(scsi.SamStatCheckCondition, s.Descriptor())
+	}
+	return c.RespondSenseData(scsi.SamStatCheckCondition, s.Fixed())
+}
+
+func (c *SCSICmd) senseFormat() SenseFormat {
+	if c.device == nil || c.device.scsi == nil {
+		return FixedSense
+	}
+	return c.device.scsi.SenseFormat
+}
+
+// Sense is the sense data reported with a CHECK CONDITION, for the current
+// command. Fixed and Descriptor lay it out in either format.
+type Sense struct {
+	Key  byte
+	ASC  byte
+	ASCQ byte
+	// Info, if set, is reported in the INFORMATION field, eg, the LBA that
+	// failed. Fixed format only has room for 32 bits, so larger values are
+	// reported as not valid.
+	Info *uint64
+	// Progress, if set, is reported as a progress indication in the sense key
+	// specific field, in 65536ths.
+	Progress *uint16
+	// Deferred reports the error of an earlier command, such as a background
+	// task, rather than the current one.
+	Deferred bool
+}
+
+// NewSense returns the sense data for key and asc, with the ASC and ASCQ
+// combined as in the scsi.Asc constants.
+func NewSense(key byte, asc uint16) Sense {
+	a, q := scsi.SplitAsc(asc)
+	return Sense{Key: key, ASC: a, ASCQ: q}
+}
+
+// Fixed returns s as fixed format sense data (response code 0x70, or 0x71 if
+// deferred).
+func (s Sense) Fixed() []byte {
+	buf := make([]byte, 18)
 	buf[0] = 0x70 /* fixed, current */
-	buf[2] = key
+	if s.Deferred {
+		buf[0] = 0x71 /* fixed, deferred */
+	}
+	buf[2] = s.Key
 	buf[7] = 0xa
-	buf[12] = byte(uint8((asc >> 8) & 0xff))
-	buf[13] = byte(uint8(asc & 0xff))
-	return SCSIResponse{
-		id:          c.id,
-		status:      scsi.SamStatCheckCondition,
-		senseBuffer: buf,
+	buf[12] = s.ASC
+	buf[13] = s.ASCQ
+	if s.Info != nil && *s.Info <= 0xffffffff {
+		buf[0] |= 0x80 /* VALID */
+		binary.BigEndian.PutUint32(buf[3:7], uint32(*s.Info))
+	}
+	if s.Progress != nil {
+		buf[15] = 0x80 /* SKSV */
+		binary.BigEndian.PutUint16(buf[16:18], *s.Progress)
+	}
+	return buf
+}
+
+// Descriptor returns s as descriptor format sense data (response code 0x72,
+// or 0x73 if deferred), with information and sense key specific descriptors as
+// needed.
+func (s Sense) Descriptor() []byte {
+	buf := make([]byte, 8, 28)
+	buf[0] = 0x72 /* descriptor, current */
+	if s.Deferred {
+		buf[0] = 0x73 /* descriptor, deferred */
 	}
+	buf[1] = s.Key
+	buf[2] = s.ASC
+	buf[3] = s.ASCQ
+	if s.Info != nil {
+		desc := make([]byte, 12)
+		desc[0] = 0x00 /* information descriptor */
+		desc[1] = 0x0a
+		desc[2] = 0x80 /* VALID */
+		binary.BigEndian.PutUint64(desc[4:12], *s.Info)
+		buf = append(buf, desc...)
+	}
+	if s.Progress != nil {
+		desc := make([]byte, 8)
+		desc[0] = 0x02 /* sense key specific descriptor */
+		desc[1] = 0x06
+		desc[4] = 0x80 /* SKSV */
+		binary.BigEndian.PutUint16(desc[5:7], *s.Progress)
+		buf = append(buf, desc...)
+	}
+	buf[7] = byte(len(buf) - 8)
+	return buf
 }
 
 // MediumError is a preset response for a read error condition from the device
@@ -205,6 +558,12 @@ func (c *SCSICmd) MediumError() SCSIResponse {
 	return c.CheckCondition(scsi.SenseMediumError, scsi.AscReadError)
 }
 
+// MediumErrorAt is MediumError with the INFORMATION field set to the LBA that
+// failed, so the initiator can recover that block specifically.
+func (c *SCSICmd) MediumErrorAt(lba uint64) SCSIResponse {
+	return c.checkConditionInfo(scsi.SenseMediumError, scsi.AscReadError, lba)
+}
+
 // IllegalRequest is a preset response for a request that is malformed or unexpected.
 func (c *SCSICmd) IllegalRequest() SCSIResponse {
 	return c.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb)
@@ -220,6 +579,26 @@ type SCSIResponse struct {
 	id          uint16
 	status      byte
 	senseBuffer []byte
+	start       time.Time
+	// unknownOp sets TCMU_UFLAG_UNKNOWN_OP on completion, telling the kernel we
+	// do not emulate the command.
+	unknownOp bool
+	// residual is the number of bytes of the data-in buffer left unwritten,
+	// and readLen the number written, reported as TCMU_UFLAG_READ_LEN.
+	residual int
+	readLen  int
+}
+
+// ID returns the id of the command this is the response to; see SCSICmd.ID.
+func (r SCSIResponse) ID() uint16 {
+	return r.id
+}
+
+// Residual returns the number of bytes of the command's data-in buffer that the
+// response leaves unwritten, as recorded by SCSICmd.Respond. Kernels that
+// support it are told, so that the initiator sees the underrun.
+func (r SCSIResponse) Residual() int {
+	return r.residual
 }
 
 // SCSIHandler is the high-level data for the emulated SCSI device.
@@ -228,23 +607,210 @@ type SCSIHandler struct {
 	VolumeName string
 	// The size of the device and the blocksize for the device.
 	DataSizes DataSizes
-	// The loopback HBA for the emulated SCSI device
+	// OptimalIOSize, in bytes, is the transfer size the backend handles best,
+	// such as the size of its objects. It is advertised as the optimal transfer
+	// length in the Block Limits VPD page, unless InquiryInfo sets one, which
+	// Linux initiators report as the queue's optimal_io_size. It must be a
+	// multiple of the block size; zero advertises none.
+	OptimalIOSize int64
+	// The loopback HBA for the emulated SCSI device. If zero, OpenTCMUDevice
+	// allocates an unused one.
 	HBA int
 	// The LUN for the emulated HBA
 	LUN int
 	// The SCSI World Wide Identifer for the device
 	WWN WWN
+	// Backend, if set, is the storage behind DevReady's handler, such as the
+	// ReadWriterAtCmdHandler's RW. Device.Close flushes it, as SYNCHRONIZE
+	// CACHE does, once the last command has completed, and then closes it if it
+	// is an io.Closer.
+	Backend interface{}
 	// Called once the device is ready. Should spawn a goroutine (or several)
 	// to handle commands coming in the first channel, and send their associated
 	// responses down the second channel, ordering optional.
 	DevReady DevReadyFunc
+	// ReadOnly rejects commands that modify the medium with DATA PROTECT sense,
+	// and reports the device as write protected. The user backstore has no
+	// configfs attribute for this, so it is enforced by the command handler.
+	// A Backend that is an io.ReaderAt but not an io.WriterAt makes the device
+	// read-only too.
+	ReadOnly bool
+	// StrictStartStop fails reads and writes with NOT READY while the unit is
+	// stopped by START STOP UNIT, rather than servicing them anyway.
+	StrictStartStop bool
+	// ReportPowerOn makes the device report a UNIT ATTENTION (power on, reset,
+	// or bus device reset occurred) once after it is created, as a newly powered
+	// on logical unit does. The first command other than INQUIRY, REPORT LUNS or
+	// REQUEST SENSE fails with it; REQUEST SENSE returns it as its sense data.
+	// Either clears it. The condition is not tracked per initiator.
+	ReportPowerOn bool
+	// WriteCacheEnabled is the initial state of the write cache reported in the
+	// caching mode page. Initiators may change it with MODE SELECT; see
+	// Device.WriteCacheEnabled. Backends with a volatile cache should implement
+	// Flusher.
+	WriteCacheEnabled bool
+	// SenseFormat is the format of sense data returned for failed commands.
+	SenseFormat SenseFormat
+	// Poller, if set, is shared with other devices to wait for commands from the
+	// kernel. Otherwise the device blocks a goroutine reading its uio device.
+	Poller *Poller
+	// TMF, if set, is told of the task management functions, such as ABORT
+	// TASK, that initiators send to the device.
+	TMF TMFHandler
+	// Fabric exports the device to initiators. If nil, LoopbackFabric is used,
+	// making the device available only on this host.
+	Fabric Fabric
+	// TPGT is the number of the target portal group the LUN is created in, as
+	// in tpgt_<n> under the fabric's target. If zero, 1 is used. Devices sharing
+	// a target need distinct TPGTs, or distinct LUNs in the same group.
+	TPGT int
+	// DevEntryTimeout bounds how long OpenTCMUDevice waits for the kernel to
+	// create the block device. If zero, it waits 30 seconds.
+	DevEntryTimeout time.Duration
+	// DevMode is the permissions of the block device node created under
+	// devPath; if zero, 0600 is used. DevUID and DevGID are its owner and
+	// group, root by default, so that the device can be handed to an
+	// unprivileged process.
+	DevMode os.FileMode
+	DevUID  int
+	DevGID  int
+	// ProtectionInfo passes the T10 protection information the kernel sends
+	// alongside each command's data to the handler, through
+	// SCSICmd.ProtectionInfo. Set it only for handlers that emulate a device
+	// formatted with protection information; otherwise it is ignored.
+	ProtectionInfo bool
+	// QueueDepth is the number of commands and responses that may be buffered
+	// between the device and DevReady's handlers. If zero, 5 is used. Once the
+	// handlers fall this far behind, the device stops taking commands off the
+	// ring; further commands wait in the kernel's command ring, and initiators
+	// are held off once that fills. A depth larger than the ring can hold
+	// entries for gains nothing.
+	QueueDepth int
+	// MaxInFlight, if set, bounds the number of commands handed to DevReady's
+	// handlers and not yet completed, however many handler goroutines there
+	// are, to protect backends with limited concurrency. At the limit, the
+	// device stops taking commands off the ring until one completes. A command
+	// failed for exceeding CommandTimeout frees its slot even though its
+	// handler may still be running.
+	MaxInFlight int
+	// CommandTimeout, if set, bounds how long SingleThreadedDevReady and
+	// MultiThreadedDevReady wait for the handler to service a command. A command
+	// that takes longer fails with HARDWARE ERROR (internal target failure)
+	// before the kernel gives up on it and resets the device. The handler can't
+	// be cancelled: it keeps running, and its goroutine and whatever it blocks on
+	// are leaked until it returns. Its later reads and writes of the command's
+	// data fail, but it may still have side effects, such as a write reaching
+	// the backend after the initiator was told it failed.
+	CommandTimeout time.Duration
+}
+
+func (h *SCSIHandler) queueDepth() int {
+	if h.QueueDepth > 0 {
+		return h.QueueDepth
+	}
+	return defaultQueueDepth
+}
+
+func (h *SCSIHandler) devMode() os.FileMode {
+	if h.DevMode == 0 {
+		return defaultDevMode
+	}
+	return h.DevMode.Perm()
 }
 
+func (h *SCSIHandler) tpgt() int {
+	if h.TPGT == 0 {
+		return 1
+	}
+	return h.TPGT
+}
+
+func (h *SCSIHandler) tpgtDir() string {
+	return fmt.Sprintf("tpgt_%d", h.tpgt())
+}
+
+// SenseFormat selects the layout of the sense data returned with CHECK CONDITION.
+type SenseFormat int
+
+const (
+	// FixedSense is fixed format sense data (response code 0x70), the default.
+	FixedSense SenseFormat = iota
+	// DescriptorSense is descriptor format sense data (response code 0x72), which
+	// can report 64-bit LBAs in the INFORMATION field.
+	DescriptorSense
+)
+
 type DevReadyFunc func(chan *SCSICmd, chan SCSIResponse) error
 
 type DataSizes struct {
 	VolumeSize int64
 	BlockSize  int64
+	// PhysicalBlockExponent is the log2 of the number of logical blocks in each
+	// physical block, so that initiators align I/O to the physical blocks: 3 for
+	// a 512e device with 4096 byte physical blocks. It is zero when logical and
+	// physical blocks are the same size, including native 4K devices with a
+	// BlockSize of 4096.
+	PhysicalBlockExponent uint8
+	// LowestAlignedLBA is the first LBA that starts a physical block. READ
+	// CAPACITY (16) has 14 bits for it, so it is at most 0x3fff.
+	LowestAlignedLBA uint16
+}
+
+// physicalBlocks returns the number of logical blocks per physical block.
+func (s DataSizes) physicalBlocks() int64 {
+	return 1 << s.PhysicalBlockExponent
+}
+
+// Validate reports whether the sizes are usable: the block size must be a power
+// of two of at least 512 bytes, the volume a whole, nonzero number of blocks, and
+// the physical block layout one READ CAPACITY (16) can report.
+func (s DataSizes) Validate() error {
+	if s.BlockSize < 512 || s.BlockSize&(s.BlockSize-1) != 0 {
+		return fmt.Errorf("invalid block size %d: must be a power of two of at least 512", s.BlockSize)
+	}
+	if s.VolumeSize <= 0 || s.VolumeSize%s.BlockSize != 0 {
+		return fmt.Errorf("invalid volume size %d: must be a nonzero multiple of the block size %d", s.VolumeSize, s.BlockSize)
+	}
+	if s.PhysicalBlockExponent > 15 {
+		return fmt.Errorf("invalid physical block exponent %d: must be at most 15", s.PhysicalBlockExponent)
+	}
+	if s.LowestAlignedLBA > 0x3fff {
+		return fmt.Errorf("invalid lowest aligned LBA %d: must be at most %d", s.LowestAlignedLBA, 0x3fff)
+	}
+	if int64(s.LowestAlignedLBA) >= s.physicalBlocks() {
+		return fmt.Errorf("invalid lowest aligned LBA %d: must be less than the %d blocks in a physical block", s.LowestAlignedLBA, s.physicalBlocks())
+	}
+	return nil
+}
+
+// Validate reports whether the handler is well-formed, so that a misconfigured
+// one can be caught before anything is created in configfs. OpenTCMUDevice and
+// AttachTCMUDevice call it first.
+func (h *SCSIHandler) Validate() error {
+	if h.VolumeName == "" || h.VolumeName == "." || h.VolumeName == ".." || strings.ContainsAny(h.VolumeName, "/\x00") {
+		return fmt.Errorf("invalid volume name %q: must be a nonempty file name", h.VolumeName)
+	}
+	if h.DevReady == nil {
+		return errors.New("No DevReady configured")
+	}
+	if h.HBA < 0 || h.LUN < 0 || h.TPGT < 0 {
+		return fmt.Errorf("invalid HBA %d, LUN %d or TPGT %d: must not be negative", h.HBA, h.LUN, h.TPGT)
+	}
+	if err := validateWWN(h.WWN); err != nil {
+		return err
+	}
+	if err := h.DataSizes.Validate(); err != nil {
+		return err
+	}
+	return h.validateOptimalIOSize()
+}
+
+// validateOptimalIOSize checks OptimalIOSize against the block size.
+func (h *SCSIHandler) validateOptimalIOSize() error {
+	if h.OptimalIOSize < 0 || h.OptimalIOSize%h.DataSizes.BlockSize != 0 {
+		return fmt.Errorf("invalid optimal I/O size %d: must be a multiple of the block size %d", h.OptimalIOSize, h.DataSizes.BlockSize)
+	}
+	return nil
 }
 
 // NaaWWN represents the World Wide Name of the SCSI device we are emulating, using the
@@ -269,6 +835,18 @@ func (n NaaWWN) NexusID() string {
 	return n.genID("1")
 }
 
+// Binary returns the binary form of DeviceID, as reported in the NAA designator of
+// the Device Identification VPD page: 8 bytes for NAA IEEE Registered (type 5), or
+// 16 bytes for IEEE Registered Extended (type 6) when VendorIDExt is set. It
+// returns nil if the fields are not valid hex.
+func (n NaaWWN) Binary() []byte {
+	b, err := hex.DecodeString(strings.TrimPrefix(n.DeviceID(), "naa."))
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
 func (n NaaWWN) genID(s string) string {
 	n.assertCorrect()
 	naa := "naa.5"
@@ -279,6 +857,33 @@ func (n NaaWWN) genID(s string) string {
 	return naa + n.OUI + s + vend
 }
 
+// Validate reports whether the fields have the lengths the NAA formats require
+// and are made of hex digits.
+func (n NaaWWN) Validate() error {
+	if len(n.OUI) != 6 {
+		return fmt.Errorf("invalid WWN: OUI %q is not 6 hex characters", n.OUI)
+	}
+	if len(n.VendorID) != 8 {
+		return fmt.Errorf("invalid WWN: VendorID %q is not 8 hex characters", n.VendorID)
+	}
+	if l := len(n.VendorIDExt); l != 0 && l != 16 {
+		return fmt.Errorf("invalid WWN: VendorIDExt %q is not empty or 16 hex characters", n.VendorIDExt)
+	}
+	fields := []struct{ name, value string }{
+		{"OUI", n.OUI},
+		{"VendorID", n.VendorID},
+		{"VendorIDExt", n.VendorIDExt},
+	}
+	for _, f := range fields {
+		if _, err := hex.DecodeString(f.value); err != nil {
+			return fmt.Errorf("invalid WWN: %s %q is not hex", f.name, f.value)
+		}
+	}
+	return nil
+}
+
+// assertCorrect panics if the WWN is invalid. OpenTCMUDevice validates the WWN
+// up front, so this only guards against misuse of an unchecked NaaWWN.
 func (n NaaWWN) assertCorrect() {
 	if len(n.OUI) != 6 {
 		panic("OUI needs to be exactly 6 hex characters")
@@ -291,12 +896,107 @@ func (n NaaWWN) assertCorrect() {
 	}
 }
 
+// EUI64WWN represents the World Wide Name of the SCSI device using the IEEE
+// EUI-64 format, for environments that name devices that way rather than by NAA.
+//
+// The kernel's loopback fabric only accepts NAA names for its target, so an
+// EUI64WWN is meant for other fabrics, such as ISCSIFabric.
+type EUI64WWN struct {
+	// CompanyID is the IEEE company identifier (OUI), as six hex digits in ASCII.
+	CompanyID string
+	// Extension is the vendor assigned device extension, as ten hex digits in
+	// ASCII.
+	Extension string
+}
+
+// NewEUI64WWN returns the EUI-64 WWN made of companyID and extension, or an error
+// if they are not 6 and 10 hex digits respectively.
+func NewEUI64WWN(companyID, extension string) (EUI64WWN, error) {
+	e := EUI64WWN{CompanyID: companyID, Extension: extension}
+	return e, e.Validate()
+}
+
+// DeviceID returns the configfs name, "eui." followed by 16 hex digits.
+func (e EUI64WWN) DeviceID() string {
+	return "eui." + e.CompanyID + e.Extension
+}
+
+// NexusID returns an NAA IEEE Registered name for the initiator side of a
+// loopback nexus, built from the company ID and the low 32 bits of the extension,
+// as EUI-64 names aren't accepted there.
+func (e EUI64WWN) NexusID() string {
+	ext := e.Extension
+	if len(ext) > 8 {
+		ext = ext[len(ext)-8:]
+	}
+	return "naa.5" + e.CompanyID + "1" + ext
+}
+
+// Binary returns the 8 byte EUI-64, as reported in the EUI-64 designator of the
+// Device Identification VPD page. It returns nil if the fields are not valid.
+func (e EUI64WWN) Binary() []byte {
+	if e.Validate() != nil {
+		return nil
+	}
+	b, _ := hex.DecodeString(e.CompanyID + e.Extension)
+	return b
+}
+
+// Validate reports whether the fields have the lengths EUI-64 requires and are
+// made of hex digits.
+func (e EUI64WWN) Validate() error {
+	if len(e.CompanyID) != 6 {
+		return fmt.Errorf("invalid WWN: CompanyID %q is not 6 hex characters", e.CompanyID)
+	}
+	if len(e.Extension) != 10 {
+		return fmt.Errorf("invalid WWN: Extension %q is not 10 hex characters", e.Extension)
+	}
+	if _, err := hex.DecodeString(e.CompanyID + e.Extension); err != nil {
+		return fmt.Errorf("invalid WWN: %q is not hex", e.CompanyID+e.Extension)
+	}
+	return nil
+}
+
 func GenerateSerial(name string) string {
 	digest := md5.New()
 	digest.Write([]byte(name))
 	return hex.EncodeToString(digest.Sum([]byte{}))[:8]
 }
 
+// NewNaaWWN returns an NAA IEEE Registered Extended WWN for oui, with the vendor
+// specific fields derived from seed. The same seed always gives the same WWN, so
+// a seed that is unique and stable for the device, such as the hostname and
+// volume name together, gives WWNs that survive restarts and don't collide
+// across hosts. Clear VendorIDExt of the result for the shorter NAA IEEE
+// Registered form. NewNaaWWN panics if oui is not 6 hex characters.
+func NewNaaWWN(oui string, seed string) NaaWWN {
+	sum := sha256.Sum256([]byte(seed))
+	return newNaaWWN(oui, sum[:12])
+}
+
+// RandomNaaWWN returns an NAA IEEE Registered Extended WWN for oui with random
+// vendor specific fields, for ephemeral devices. It panics if oui is not 6 hex
+// characters.
+func RandomNaaWWN(oui string) NaaWWN {
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		panic("failed to read random WWN: " + err.Error())
+	}
+	return newNaaWWN(oui, id)
+}
+
+func newNaaWWN(oui string, id []byte) NaaWWN {
+	n := NaaWWN{
+		OUI:         oui,
+		VendorID:    hex.EncodeToString(id[:4]),
+		VendorIDExt: hex.EncodeToString(id[4:12]),
+	}
+	if err := n.Validate(); err != nil {
+		panic(err.Error())
+	}
+	return n
+}
+
 func GenerateTestWWN() WWN {
 	return NaaWWN{
 		OUI:      "000000",
@@ -309,14 +1009,61 @@ type ReadWriterAt interface {
 	io.WriterAt
 }
 
+// Flusher is an optional interface for backends that buffer writes. Flush should
+// not return until previously written data is on stable storage.
+type Flusher interface {
+	Flush() error
+}
+
+// Trimmer is an optional interface for thin-provisioned backends. TrimAt tells
+// the backend that length bytes at off are no longer in use; they should read as
+// zeros afterwards.
+type Trimmer interface {
+	TrimAt(length, off int64) error
+}
+
+// SatHandler is an optional interface for backends wrapping a real ATA device,
+// to handle ATA PASS-THROUGH commands themselves. AtaPassThrough is given the
+// command as is, ATA registers and data, and responds as a SCSICmdHandler would.
+type SatHandler interface {
+	AtaPassThrough(cmd *SCSICmd) (SCSIResponse, error)
+}
+
+// VectoredReadWriter is an optional interface for backends that can do
+// scatter/gather I/O, such as with preadv and pwritev. ReadWriterAtCmdHandler
+// passes it the command's data buffers directly, rather than copying through a
+// single buffer. Like ReadAt and WriteAt, each must return an error if it
+// transfers less than the total length of vecs.
+type VectoredReadWriter interface {
+	ReadAtv(vecs [][]byte, off int64) (int, error)
+	WriteAtv(vecs [][]byte, off int64) (int, error)
+}
+
+type syncer interface {
+	Sync() error
+}
+
+// flushBackend flushes the backend if it implements Flusher, or Sync() as
+// *os.File does. Backends implementing neither are assumed to be durable.
+func flushBackend(backend interface{}) error {
+	switch f := backend.(type) {
+	case Flusher:
+		return f.Flush()
+	case syncer:
+		return f.Sync()
+	}
+	return nil
+}
+
 func BasicSCSIHandler(rw ReadWriterAt) *SCSIHandler {
 	return &SCSIHandler{
-		HBA:        30,
+		HBA:        0,
 		LUN:        0,
 		WWN:        GenerateTestWWN(),
 		VolumeName: "testvol",
 		// 1GiB, 1K
-		DataSizes: DataSizes{1024 * 1024 * 1024, 1024},
+		DataSizes: DataSizes{VolumeSize: 1024 * 1024 * 1024, BlockSize: 1024},
+		Backend:   rw,
 		DevReady: MultiThreadedDevReady(
 			ReadWriterAtCmdHandler{
 				RW: rw,
@@ -324,23 +1071,94 @@ func BasicSCSIHandler(rw ReadWriterAt) *SCSIHandler {
 	}
 }
 
+// BasicReadOnlyHandler is like BasicSCSIHandler, for a backend that can only be
+// read, such as a file opened read-only. The device is write protected: writes
+// fail with DATA PROTECT, and MODE SENSE reports it.
+func BasicReadOnlyHandler(r io.ReaderAt) *SCSIHandler {
+	h := BasicSCSIHandler(readOnlyBackend{r})
+	h.Backend = r
+	h.ReadOnly = true
+	return h
+}
+
+// errReadOnlyBackend is returned by writes to a readOnlyBackend, which the
+// write protection should prevent from happening.
+var errReadOnlyBackend = errors.New("backend is read-only")
+
+// readOnlyBackend adapts an io.ReaderAt for ReadWriterAtCmdHandler.
+type readOnlyBackend struct {
+	io.ReaderAt
+}
+
+func (readOnlyBackend) WriteAt(p []byte, off int64) (int, error) {
+	return 0, errReadOnlyBackend
+}
+
+// scratchBufferSize is the size of the scratch buffer each DevReady goroutine
+// starts with, as io.Copy does.
+const scratchBufferSize = 32 * 1024
+
+// handleCommand runs h on cmd with buf as its scratch buffer, enforcing the
+// device's CommandTimeout. It returns the scratch buffer for the next command:
+// the one the handler left in cmd.Buf, possibly grown, or a new one of size
+// bytes if the handler kept it by setting cmd.Buf to nil, or was abandoned still
+// using it.
+func handleCommand(h SCSICmdHandler, cmd *SCSICmd, buf []byte, size int) (SCSIResponse, []byte, error) {
+	cmd.Buf = buf
+	timeout := time.Duration(0)
+	if cmd.Device() != nil {
+		timeout = cmd.Device().scsi.CommandTimeout
+	}
+	if timeout <= 0 {
+		resp, err := h.HandleCommand(cmd)
+		return resp, nextScratch(cmd.Buf, size), err
+	}
+	type result struct {
+		resp SCSIResponse
+		buf  []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := h.HandleCommand(cmd)
+		done <- result{resp, cmd.Buf, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.resp, nextScratch(r.buf, size), r.err
+	case <-timer.C:
+	}
+	cmd.abandon()
+	log.Errorf("command 0x%02x (id %d) timed out after %s, abandoning its handler", cmd.Command(), cmd.id, timeout)
+	return cmd.TargetFailure(), make([]byte, size), nil
+}
+
+// nextScratch returns buf for reuse as the next command's scratch buffer, or a
+// new one of size bytes if the handler gave it up.
+func nextScratch(buf []byte, size int) []byte {
+	if buf == nil {
+		return make([]byte, size)
+	}
+	return buf
+}
+
 func SingleThreadedDevReady(h SCSICmdHandler) DevReadyFunc {
 	return func(in chan *SCSICmd, out chan SCSIResponse) error {
 		go func(h SCSICmdHandler, in chan *SCSICmd, out chan SCSIResponse) {
-			// Use io.Copy's trick
-			buf := make([]byte, 32*1024)
+			buf := make([]byte, scratchBufferSize)
 			for {
 				v, ok := <-in
 				if !ok {
 					close(out)
 					return
 				}
-				v.Buf = buf
-				x, err := h.HandleCommand(v)
-				buf = v.Buf
+				x, next, err := handleCommand(h, v, buf, scratchBufferSize)
+				buf = next
 				if err != nil {
 					log.Error(err)
-					return
+					x = v.TargetFailure()
 				}
 				out <- x
 			}
@@ -356,22 +1174,23 @@ func MultiThreadedDevReady(h SCSICmdHandler, threads int) DevReadyFunc {
 			w.Add(threads)
 			for i := 0; i < threads; i++ {
 				go func(h SCSICmdHandler, in chan *SCSICmd, out chan SCSIResponse, w *sync.WaitGroup) {
-					buf := make([]byte, 32*1024)
+					// Done even if the handler fails, so the others can still
+					// close out once they're finished.
+					defer w.Done()
+					buf := make([]byte, scratchBufferSize)
 					for {
 						v, ok := <-in
 						if !ok {
 							break
 						}
-						v.Buf = buf
-						x, err := h.HandleCommand(v)
-						buf = v.Buf
+						x, next, err := handleCommand(h, v, buf, scratchBufferSize)
+						buf = next
 						if err != nil {
 							log.Error(err)
-							return
+							x = v.TargetFailure()
 						}
 						out <- x
 					}
-					w.Done()
 				}(h, in, out, &w)
 			}
 			w.Wait()
@@ -380,3 +1199,60 @@ func MultiThreadedDevReady(h SCSICmdHandler, threads int) DevReadyFunc {
 		return nil
 	}
 }
+
+// PoolOptions configures PooledDevReady.
+type PoolOptions struct {
+	// Workers is the number of goroutines handling commands. If zero, 1 is used.
+	Workers int
+	// BufferSize is the size of each worker's scratch buffer; see SCSICmd.Buf.
+	// If zero, 32KiB is used.
+	BufferSize int
+	// MaxBufferSize, if set, bounds the scratch buffer a worker keeps between
+	// commands. Handlers like EmulateRead grow it for large transfers; a worker
+	// whose buffer grew past MaxBufferSize goes back to one of BufferSize, so a
+	// burst of large commands doesn't hold on to that memory.
+	MaxBufferSize int
+}
+
+// PooledDevReady handles commands with a pool of opts.Workers goroutines, each
+// reusing its own scratch buffer. Once the device stops taking commands, the
+// workers finish those already queued before out is closed, so every command
+// received is responded to. If the handler returns an error, it is logged and
+// the command failed with a TargetFailure, and the worker carries on.
+func PooledDevReady(h SCSICmdHandler, opts PoolOptions) DevReadyFunc {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	size := opts.BufferSize
+	if size <= 0 {
+		size = scratchBufferSize
+	}
+	return func(in chan *SCSICmd, out chan SCSIResponse) error {
+		var w sync.WaitGroup
+		w.Add(workers)
+		for i := 0; i < workers; i++ {
+			go func() {
+				defer w.Done()
+				buf := make([]byte, size)
+				for v := range in {
+					x, next, err := handleCommand(h, v, buf, size)
+					if err != nil {
+						log.Error(err)
+						x = v.TargetFailure()
+					}
+					if opts.MaxBufferSize > 0 && cap(next) > opts.MaxBufferSize {
+						next = make([]byte, size)
+					}
+					buf = next
+					out <- x
+				}
+			}()
+		}
+		go func() {
+			w.Wait()
+			close(out)
+		}()
+		return nil
+	}
+}
@@ -0,0 +1,783 @@
+package tcmu
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-tcmu/scsi"
+)
+
+func TestSCSICmdCDB(t *testing.T) {
+	raw := []byte{scsi.Read10, 0, 0, 0, 0, 1, 0, 0, 1, 0, 0xff, 0xff}
+	cmd, _ := newTestCmd(raw, 0)
+	cdb := cmd.CDB()
+	if !bytes.Equal(cdb, raw[:10]) {
+		t.Fatalf("CDB() = % x, want % x", cdb, raw[:10])
+	}
+	cdb[0] = 0
+	if cmd.Command() != scsi.Read10 {
+		t.Fatal("modifying the copy changed the command")
+	}
+}
+
+func TestSCSICmdServiceAction(t *testing.T) {
+	tests := []struct {
+		cdb  []byte
+		want uint16
+	}{
+		{[]byte{scsi.ServiceActionIn16, 0xe0 | scsi.SaiReadCapacity16, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, scsi.SaiReadCapacity16},
+		{[]byte{scsi.MaintenanceIn, scsi.MiReportSupportedOperationCodes, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, scsi.MiReportSupportedOperationCodes},
+		{[]byte{scsi.PersistentReserveIn, 0x01, 0, 0, 0, 0, 0, 0, 0, 0}, 0x01},
+		{[]byte{scsi.Read10, 0x1f, 0, 0, 0, 0, 0, 0, 0, 0}, 0},
+	}
+	for _, tt := range tests {
+		cmd, _ := newTestCmd(tt.cdb, 0)
+		if got := cmd.ServiceAction(); got != tt.want {
+			t.Errorf("opcode 0x%02x: ServiceAction() = 0x%x, want 0x%x", tt.cdb[0], got, tt.want)
+		}
+	}
+}
+
+func TestSCSICmdDataBuffer(t *testing.T) {
+	bs := int(testSizes.BlockSize)
+	cmd, _ := newTestCmd([]byte{scsi.Read10, 0, 0, 0, 0, 0, 0, 0, 2, 0}, 2*bs)
+	scratch := make([]byte, 4*bs)
+	cmd.Buf = scratch
+	buf := cmd.DataBuffer()
+	if len(buf) != 2*bs || &buf[0] != &scratch[0] {
+		t.Fatalf("DataBuffer() didn't reuse a large enough Buf")
+	}
+
+	cmd.Buf = make([]byte, bs)
+	if buf := cmd.DataBuffer(); len(buf) != 2*bs || len(cmd.Buf) < 2*bs {
+		t.Fatalf("DataBuffer() didn't grow a small Buf: len %d, Buf %d", len(buf), len(cmd.Buf))
+	}
+}
+
+func TestSCSICmdProtectionInfo(t *testing.T) {
+	cmd, _ := newTestCmd([]byte{scsi.Read10, 0, 0, 0, 0, 0, 0, 0, 2, 0}, 1024)
+	if cmd.ProtectionInfo() != nil {
+		t.Fatal("ProtectionInfo() non-nil without protection information")
+	}
+	if _, err := cmd.WriteProtectionInfo(make([]byte, 8)); err == nil {
+		t.Fatal("WriteProtectionInfo() succeeded without buffers")
+	}
+
+	pi := [][]byte{make([]byte, 8), make([]byte, 8)}
+	cmd.difVecs = pi
+	tags := make([]byte, 16)
+	for i := range tags {
+		tags[i] = byte(i)
+	}
+	if n, err := cmd.WriteProtectionInfo(tags); err != nil || n != len(tags) {
+		t.Fatalf("WriteProtectionInfo() = %d, %v", n, err)
+	}
+	if !bytes.Equal(pi[0], tags[:8]) || !bytes.Equal(pi[1], tags[8:]) {
+		t.Fatalf("protection information = % x % x, want % x", pi[0], pi[1], tags)
+	}
+}
+
+func TestNewNaaWWN(t *testing.T) {
+	a := NewNaaWWN("0a1b2c", "host1/vol")
+	if a != NewNaaWWN("0a1b2c", "host1/vol") {
+		t.Fatal("NewNaaWWN isn't deterministic")
+	}
+	if a == NewNaaWWN("0a1b2c", "host2/vol") {
+		t.Fatal("different seeds gave the same WWN")
+	}
+	if id := a.DeviceID(); len(id) != len("naa.")+32 || !strings.HasPrefix(id, "naa.60a1b2c") {
+		t.Errorf("DeviceID() = %q", id)
+	}
+	if len(a.Binary()) != 16 {
+		t.Errorf("Binary() is %d bytes, want 16", len(a.Binary()))
+	}
+	if RandomNaaWWN("0a1b2c") == RandomNaaWWN("0a1b2c") {
+		t.Error("RandomNaaWWN returned the same WWN twice")
+	}
+}
+
+func TestNaaWWNValidate(t *testing.T) {
+	tests := []struct {
+		wwn NaaWWN
+		ok  bool
+	}{
+		{NaaWWN{OUI: "0a1b2c", VendorID: "2416c05f"}, true},
+		{NaaWWN{OUI: "0a1b2c", VendorID: "2416c05f", VendorIDExt: "0123456789abcdef"}, true},
+		{NaaWWN{OUI: "0a1b2", VendorID: "2416c05f"}, false},
+		{NaaWWN{OUI: "0a1b2c", VendorID: "2416c05"}, false},
+		{NaaWWN{OUI: "0a1b2c", VendorID: "2416c05f", VendorIDExt: "0123"}, false},
+		{NaaWWN{OUI: "0a1b2g", VendorID: "2416c05f"}, false},
+		{NaaWWN{OUI: "0a1b2c", VendorID: "2416c05f", VendorIDExt: "0123456789abcdeX"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.wwn.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%+v: Validate() = %v", tt.wwn, err)
+		}
+	}
+}
+
+func TestEUI64WWN(t *testing.T) {
+	e, err := NewEUI64WWN("0a1b2c", "0123456789")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := e.DeviceID(); id != "eui.0a1b2c0123456789" {
+		t.Errorf("DeviceID() = %q", id)
+	}
+	want := []byte{0x0a, 0x1b, 0x2c, 0x01, 0x23, 0x45, 0x67, 0x89}
+	if !bytes.Equal(e.Binary(), want) {
+		t.Errorf("Binary() = % x, want % x", e.Binary(), want)
+	}
+	if _, err := NewEUI64WWN("0a1b2c", "012345678"); err == nil {
+		t.Error("short extension accepted")
+	}
+	if _, err := NewEUI64WWN("0a1b2x", "0123456789"); err == nil {
+		t.Error("non-hex company id accepted")
+	}
+}
+
+func TestSCSIHandlerValidate(t *testing.T) {
+	valid := func() *SCSIHandler {
+		return &SCSIHandler{
+			VolumeName: "vol",
+			DataSizes:  testSizes,
+			WWN:        NaaWWN{OUI: "000000", VendorID: "12345678"},
+			DevReady:   SingleThreadedDevReady(ReadWriterAtCmdHandler{}),
+		}
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	tests := []struct {
+		name   string
+		mutate func(h *SCSIHandler)
+	}{
+		{"no volume name", func(h *SCSIHandler) { h.VolumeName = "" }},
+		{"volume path", func(h *SCSIHandler) { h.VolumeName = "a/b" }},
+		{"dot volume", func(h *SCSIHandler) { h.VolumeName = ".." }},
+		{"no DevReady", func(h *SCSIHandler) { h.DevReady = nil }},
+		{"negative LUN", func(h *SCSIHandler) { h.LUN = -1 }},
+		{"no WWN", func(h *SCSIHandler) { h.WWN = nil }},
+		{"bad WWN", func(h *SCSIHandler) { h.WWN = NaaWWN{OUI: "xyz"} }},
+		{"bad sizes", func(h *SCSIHandler) { h.DataSizes.BlockSize = 1000 }},
+		{"bad optimal I/O size", func(h *SCSIHandler) { h.OptimalIOSize = 513 }},
+	}
+	for _, tt := range tests {
+		h := valid()
+		tt.mutate(h)
+		if err := h.Validate(); err == nil {
+			t.Errorf("%s: Validate() succeeded", tt.name)
+		}
+	}
+}
+
+func TestDataSizesValidate(t *testing.T) {
+	tests := []struct {
+		sizes DataSizes
+		ok    bool
+	}{
+		{DataSizes{VolumeSize: 1024 * 1024, BlockSize: 512}, true},
+		{DataSizes{VolumeSize: 1024 * 1024, BlockSize: 4096}, true},
+		{DataSizes{VolumeSize: 1024 * 1024, BlockSize: 0}, false},
+		{DataSizes{VolumeSize: 1024 * 1024, BlockSize: 256}, false},
+		{DataSizes{VolumeSize: 1024 * 1024, BlockSize: 1000}, false},
+		{DataSizes{VolumeSize: 1024*1024 + 1, BlockSize: 512}, false},
+		{DataSizes{VolumeSize: 0, BlockSize: 512}, false},
+		{DataSizes{VolumeSize: 1024 * 1024, BlockSize: 512, PhysicalBlockExponent: 15, LowestAlignedLBA: 0x3fff}, true},
+		{DataSizes{VolumeSize: 1024 * 1024, BlockSize: 512, PhysicalBlockExponent: 15, LowestAlignedLBA: 0x4000}, false},
+		{DataSizes{VolumeSize: 1024 * 1024, BlockSize: 512, PhysicalBlockExponent: 3, LowestAlignedLBA: 8}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.sizes.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%+v: Validate() = %v", tt.sizes, err)
+		}
+	}
+}
+
+// blockingHandler writes to the command's data buffer once release is closed,
+// reporting the result on written.
+type blockingHandler struct {
+	release chan struct{}
+	written chan error
+}
+
+func (h blockingHandler) HandleCommand(cmd *SCSICmd) (SCSIResponse, error) {
+	<-h.release
+	_, err := cmd.Write([]byte{1})
+	h.written <- err
+	return cmd.Ok(), nil
+}
+
+func TestHandleCommandTimeout(t *testing.T) {
+	cmd, buf := newTestCmd([]byte{scsi.Read10, 0, 0, 0, 0, 0, 0, 0, 1, 0}, 512)
+	cmd.device.scsi.CommandTimeout = 10 * time.Millisecond
+	h := blockingHandler{release: make(chan struct{}), written: make(chan error, 1)}
+	scratch := make([]byte, scratchBufferSize)
+	resp, next, err := handleCommand(h, cmd, scratch, scratchBufferSize)
+	checkSense(t, resp, scsi.SenseHardwareError, scsi.AscInternalTargetFailure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(next) == 0 || &next[0] == &scratch[0] {
+		t.Error("scratch buffer reused after abandoning the handler")
+	}
+	close(h.release)
+	if err := <-h.written; err != errAbandoned {
+		t.Errorf("late Write() = %v, want errAbandoned", err)
+	}
+	if buf[0] != 0 {
+		t.Error("abandoned handler wrote to the data buffer")
+	}
+}
+
+func TestSCSICmdID(t *testing.T) {
+	cmd, _ := newTestCmd([]byte{scsi.TestUnitReady, 0, 0, 0, 0, 0}, 0)
+	cmd.id = 0x1234
+	if cmd.ID() != 0x1234 || cmd.Ok().ID() != 0x1234 {
+		t.Errorf("ID() = 0x%x, response ID() = 0x%x, want 0x1234", cmd.ID(), cmd.Ok().ID())
+	}
+}
+
+func TestDeviceInitiator(t *testing.T) {
+	d := newTestDevice()
+	if got, want := d.initiator(), d.scsi.WWN.NexusID(); got != want {
+		t.Errorf("loopback initiator %q, want %q", got, want)
+	}
+	d.scsi.Fabric = LoopbackFabric{Nexus: "naa.5001405000000001"}
+	if got := d.initiator(); got != "naa.5001405000000001" {
+		t.Errorf("initiator %q, want the configured nexus", got)
+	}
+	d.scsi.Fabric = ISCSIFabric{}
+	if got := d.initiator(); got != "" {
+		t.Errorf("iSCSI initiator %q, want none", got)
+	}
+}
+
+func TestBlockDevicePath(t *testing.T) {
+	d := newTestDevice()
+	d.devPath = "/dev/tcmu"
+	if got, want := d.BlockDevicePath(), "/dev/tcmu/"+d.scsi.VolumeName; got != want {
+		t.Errorf("block device path %q, want %q", got, want)
+	}
+	d.scsi.Fabric = ISCSIFabric{}
+	if got := d.BlockDevicePath(); got != "" {
+		t.Errorf("iSCSI block device path %q, want none", got)
+	}
+}
+
+func TestDevMode(t *testing.T) {
+	h := &SCSIHandler{}
+	if got := h.devMode(); got != 0600 {
+		t.Errorf("default mode %v", got)
+	}
+	h.DevMode = os.ModeDevice | 0660
+	if got := h.devMode(); got != 0660 {
+		t.Errorf("mode %v, want the permission bits", got)
+	}
+}
+
+func TestFabricTPGT(t *testing.T) {
+	h := &SCSIHandler{VolumeName: "vol", WWN: NaaWWN{OUI: "000000", VendorID: "12345678"}}
+	if got := (LoopbackFabric{}).TPGPath(h); path.Base(got) != "tpgt_1" {
+		t.Errorf("default TPG path %s", got)
+	}
+	h.TPGT = 3
+	for _, f := range []Fabric{LoopbackFabric{}, ISCSIFabric{}} {
+		paths := f.Paths(h)
+		if tpg := f.TPGPath(h); path.Base(tpg) != "tpgt_3" {
+			t.Errorf("%T: TPG path %s", f, tpg)
+		}
+		if target := paths[len(paths)-1]; target != path.Dir(f.TPGPath(h)) {
+			t.Errorf("%T: last path %s isn't the target", f, target)
+		}
+	}
+}
+
+func TestSense(t *testing.T) {
+	info, progress := uint64(0x1234), uint16(0x8000)
+	s := NewSense(scsi.SenseMediumError, scsi.AscReadError)
+	s.Info, s.Progress = &info, &progress
+
+	want := []byte{0xf0, 0, scsi.SenseMediumError, 0, 0, 0x12, 0x34, 0xa, 0, 0, 0, 0, 0x11, 0, 0, 0x80, 0x80, 0}
+	if got := s.Fixed(); !bytes.Equal(got, want) {
+		t.Errorf("Fixed() = % x, want % x", got, want)
+	}
+	want = []byte{0x72, scsi.SenseMediumError, 0x11, 0, 0, 0, 0, 20,
+		0, 0x0a, 0x80, 0, 0, 0, 0, 0, 0, 0, 0x12, 0x34,
+		0x02, 0x06, 0, 0, 0x80, 0x80, 0, 0}
+	if got := s.Descriptor(); !bytes.Equal(got, want) {
+		t.Errorf("Descriptor() = % x, want % x", got, want)
+	}
+
+	cmd, _ := newTestCmd([]byte{scsi.TestUnitReady, 0, 0, 0, 0, 0}, 0)
+	cmd.Device().scsi.SenseFormat = DescriptorSense
+	resp := cmd.RespondSense(Sense{Key: scsi.SenseNotReady, ASC: 0x04, ASCQ: 0x04})
+	if resp.status != scsi.SamStatCheckCondition || !bytes.Equal(resp.senseBuffer, []byte{0x72, scsi.SenseNotReady, 0x04, 0x04, 0, 0, 0, 0}) {
+		t.Errorf("RespondSense: status 0x%x, sense % x", resp.status, resp.senseBuffer)
+	}
+}
+
+func TestCheckConditionEx(t *testing.T) {
+	cmd, _ := newTestCmd([]byte{scsi.TestUnitReady, 0, 0, 0, 0, 0}, 0)
+	resp := cmd.CheckConditionEx(scsi.SenseNotReady, 0x04, 0x04)
+	checkSense(t, resp, scsi.SenseNotReady, scsi.AscFormatInProgress)
+	if a, q := scsi.SplitAsc(scsi.AscFormatInProgress); a != 0x04 || q != 0x04 {
+		t.Errorf("SplitAsc(AscFormatInProgress) = %x, %x", a, q)
+	}
+	if !bytes.Equal(cmd.CheckCondition(scsi.SenseNotReady, scsi.AscFormatInProgress).senseBuffer, resp.senseBuffer) {
+		t.Error("CheckCondition and CheckConditionEx differ")
+	}
+}
+
+func TestCommandName(t *testing.T) {
+	tests := []struct {
+		op   byte
+		sa   uint16
+		want string
+	}{
+		{scsi.Read10, 0, "READ_10"},
+		{scsi.WriteVerify16, 0, "WRITE_VERIFY_16"},
+		{scsi.ServiceActionIn16, scsi.SaiReadCapacity16, "READ_CAPACITY_16"},
+		{scsi.MaintenanceIn, scsi.MiReportTargetPgs, "REPORT_TARGET_PGS"},
+		{scsi.MaintenanceIn, 0x1f, "MAINTENANCE_IN/0x1f"},
+		{0xc5, 0, "0xc5"},
+	}
+	for _, tt := range tests {
+		if got := scsi.CommandName(tt.op, tt.sa); got != tt.want {
+			t.Errorf("CommandName(0x%02x, 0x%02x) = %q, want %q", tt.op, tt.sa, got, tt.want)
+		}
+	}
+
+	d := newTestDevice()
+	for _, op := range []byte{scsi.Read10, scsi.Read10, scsi.TestUnitReady} {
+		cmd, _ := newTestCmd([]byte{op, 0, 0, 0, 0, 0, 0, 0, 0, 0}, 0)
+		d.stats.receive(cmd)
+	}
+	if by := d.Stats().ByCommand; len(by) != 2 || by["READ_10"] != 2 || by["TEST_UNIT_READY"] != 1 {
+		t.Errorf("ByCommand = %v", by)
+	}
+}
+
+// bufferRecorder is a handler that records the size of each command's scratch
+// buffer, and grows it to grow bytes.
+type bufferRecorder struct {
+	mu    sync.Mutex
+	sizes []int
+	grow  int
+}
+
+func (b *bufferRecorder) HandleCommand(cmd *SCSICmd) (SCSIResponse, error) {
+	b.mu.Lock()
+	b.sizes = append(b.sizes, len(cmd.Buf))
+	b.mu.Unlock()
+	cmd.Buf = make([]byte, b.grow)
+	return cmd.Ok(), nil
+}
+
+func TestPooledDevReady(t *testing.T) {
+	h := &bufferRecorder{grow: 1 << 20}
+	in, out := make(chan *SCSICmd, 20), make(chan SCSIResponse)
+	if err := PooledDevReady(h, PoolOptions{Workers: 3, BufferSize: 4096, MaxBufferSize: 64 << 10})(in, out); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		cmd, _ := newTestCmd([]byte{scsi.TestUnitReady, 0, 0, 0, 0, 0}, 0)
+		cmd.id = uint16(i)
+		in <- cmd
+	}
+	// The queued commands are still handled once in is closed.
+	close(in)
+	seen := make(map[uint16]bool)
+	for resp := range out {
+		seen[resp.ID()] = true
+	}
+	if len(seen) != 20 {
+		t.Errorf("%d responses, want 20", len(seen))
+	}
+	for _, n := range h.sizes {
+		if n != 4096 {
+			t.Errorf("scratch buffer of %d bytes, want the grown one replaced by 4096", n)
+		}
+	}
+}
+
+// retainingHandler grows the scratch buffer for command 0, keeps it for command
+// 1, and records the buffer each command was given.
+type retainingHandler struct {
+	bufs     [][]byte
+	retained []byte
+}
+
+func (r *retainingHandler) HandleCommand(cmd *SCSICmd) (SCSIResponse, error) {
+	r.bufs = append(r.bufs, cmd.Buf)
+	switch cmd.ID() {
+	case 0:
+		cmd.buffer(1 << 20)
+	case 1:
+		r.retained = cmd.Buf
+		cmd.Buf = nil
+	}
+	return cmd.Ok(), nil
+}
+
+func TestDevReadyScratchReuse(t *testing.T) {
+	h := &retainingHandler{}
+	in, out := make(chan *SCSICmd, 3), make(chan SCSIResponse, 3)
+	MultiThreadedDevReady(h, 1)(in, out)
+	for i := 0; i < 3; i++ {
+		cmd, _ := newTestCmd([]byte{scsi.TestUnitReady, 0, 0, 0, 0, 0}, 0)
+		cmd.id = uint16(i)
+		in <- cmd
+	}
+	close(in)
+	for range out {
+	}
+	if len(h.bufs) != 3 {
+		t.Fatalf("%d commands handled, want 3", len(h.bufs))
+	}
+	if len(h.bufs[1]) != 1<<20 {
+		t.Errorf("grown scratch buffer not reused: %d bytes", len(h.bufs[1]))
+	}
+	if next := h.bufs[2]; len(next) != scratchBufferSize || &next[0] == &h.retained[0] {
+		t.Error("retained scratch buffer reused for the next command")
+	}
+}
+
+// failingHandler returns an error for command 1.
+type failingHandler struct{}
+
+func (failingHandler) HandleCommand(cmd *SCSICmd) (SCSIResponse, error) {
+	if cmd.ID() == 1 {
+		return SCSIResponse{}, errors.New("handler failed")
+	}
+	return cmd.Ok(), nil
+}
+
+func TestDevReadyHandlerError(t *testing.T) {
+	for name, ready := range map[string]DevReadyFunc{
+		"single": SingleThreadedDevReady(failingHandler{}),
+		"multi":  MultiThreadedDevReady(failingHandler{}, 1),
+		"pooled": PooledDevReady(failingHandler{}, PoolOptions{}),
+	} {
+		in, out := make(chan *SCSICmd, 3), make(chan SCSIResponse, 3)
+		if err := ready(in, out); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			cmd, _ := newTestCmd([]byte{scsi.TestUnitReady, 0, 0, 0, 0, 0}, 0)
+			cmd.id = uint16(i)
+			in <- cmd
+		}
+		close(in)
+		// Every command is responded to, and out still closed.
+		n := 0
+		for resp := range out {
+			n++
+			if resp.ID() == 1 && resp.status != scsi.SamStatCheckCondition {
+				t.Errorf("%s: failed command status 0x%x, want CHECK CONDITION", name, resp.status)
+			}
+		}
+		if n != 3 {
+			t.Errorf("%s: %d responses, want 3", name, n)
+		}
+	}
+}
+
+func TestSCSICmdRespond(t *testing.T) {
+	data := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	tests := []struct {
+		name     string
+		allocLen byte
+		bufLen   int
+		written  int
+		residual int
+	}{
+		{"short data", 64, 64, 8, 56},
+		{"allocation length", 4, 64, 4, 60},
+		{"buffer", 64, 6, 6, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, buf := newTestCmd([]byte{scsi.Inquiry, 0, 0, 0, tt.allocLen, 0}, tt.bufLen)
+			for i := range buf {
+				buf[i] = 0xee
+			}
+			resp := cmd.Respond(data)
+			checkGood(t, resp, nil)
+			if !bytes.Equal(buf[:tt.written], data[:tt.written]) {
+				t.Errorf("wrote % x", buf[:tt.written])
+			}
+			if tt.written < len(buf) && buf[tt.written] != 0xee {
+				t.Error("wrote past the data")
+			}
+			if resp.Residual() != tt.residual {
+				t.Errorf("residual %d, want %d", resp.Residual(), tt.residual)
+			}
+		})
+	}
+}
+
+func TestDeviceRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcmu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	shared := filepath.Join(dir, "target")
+	if err := os.Mkdir(shared, 0755); err != nil {
+		t.Fatal(err)
+	}
+	tpg := filepath.Join(shared, "tpgt_1")
+	lun := filepath.Join(tpg, "lun_0")
+
+	d := newTestDevice()
+	created := missing(shared, tpg, lun)
+	if err := os.MkdirAll(lun, 0755); err != nil {
+		t.Fatal(err)
+	}
+	d.recordCreated(created)
+	if len(d.toClean) != 2 {
+		t.Fatalf("recorded %v, want the two new directories", d.toClean)
+	}
+
+	if err := d.rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tpg); !os.IsNotExist(err) {
+		t.Errorf("%s not removed: %v", tpg, err)
+	}
+	if _, err := os.Stat(shared); err != nil {
+		t.Errorf("preexisting %s removed: %v", shared, err)
+	}
+}
+
+func TestRemoveNotEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcmu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "lun_1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// A directory other devices still use isn't waited on.
+	start := time.Now()
+	if err := remove(dir, start.Add(time.Minute)); err == nil {
+		t.Error("removed a directory that isn't empty")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waited %s", elapsed)
+	}
+}
+
+func TestRemoveUnusedTPG(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcmu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tpg := filepath.Join(dir, "iqn.test", "tpgt_1")
+	portal := filepath.Join(tpg, "np", "0.0.0.0:3260")
+	other := filepath.Join(tpg, "lun", "lun_1")
+	for _, p := range []string{portal, other} {
+		if err := os.MkdirAll(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	paths := []string{portal, tpg, filepath.Dir(tpg)}
+
+	// Another device's LUN keeps the group and its portal.
+	removeUnusedTPG(tpg, paths)
+	if _, err := os.Stat(portal); err != nil {
+		t.Errorf("portal removed from a group in use: %v", err)
+	}
+
+	if err := os.Remove(other); err != nil {
+		t.Fatal(err)
+	}
+	removeUnusedTPG(tpg, paths)
+	if _, err := os.Stat(portal); !os.IsNotExist(err) {
+		t.Errorf("portal of an unused group not removed: %v", err)
+	}
+}
+
+func TestFindLunLinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcmu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backstore := filepath.Join(dir, "core", "user_1", "vol")
+	other := filepath.Join(dir, "core", "user_1", "other")
+	fabric := filepath.Join(dir, "loopback")
+	links := map[string]string{
+		filepath.Join(fabric, "naa.1", "tpgt_1", "lun", "lun_0", "vol"):   backstore,
+		filepath.Join(fabric, "naa.2", "tpgt_1", "lun", "lun_3", "other"): other,
+	}
+	for link, target := range links {
+		if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := findLunLinks(backstore, fabric, filepath.Join(dir, "iscsi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(fabric, "naa.1", "tpgt_1", "lun", "lun_0", "vol")
+	if len(got) != 1 || got[0] != want {
+		t.Errorf("found %v, want [%s]", got, want)
+	}
+}
+
+// closingBackend records the order Flush and Close are called in.
+type closingBackend struct {
+	calls    []string
+	flushErr error
+}
+
+func (b *closingBackend) Flush() error {
+	b.calls = append(b.calls, "flush")
+	return b.flushErr
+}
+
+func (b *closingBackend) Close() error {
+	b.calls = append(b.calls, "close")
+	return nil
+}
+
+func TestDeviceCloseBackend(t *testing.T) {
+	d := newTestDevice()
+	if err := d.closeBackend(); err != nil {
+		t.Fatalf("no backend: %v", err)
+	}
+	b := &closingBackend{flushErr: errors.New("flush failed")}
+	d.scsi.Backend = b
+	if err := d.closeBackend(); err != b.flushErr {
+		t.Errorf("closeBackend() = %v, want the flush error", err)
+	}
+	if got := strings.Join(b.calls, ","); got != "flush,close" {
+		t.Errorf("calls %s, want flush then close", got)
+	}
+
+	// A device that was never started, or has stopped, needs no stopping.
+	if err := d.stopPolling(); err != nil {
+		t.Error(err)
+	}
+	d.done = make(chan struct{})
+	close(d.done)
+	if err := d.stopPolling(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeviceBackgroundWork(t *testing.T) {
+	cmd, _ := newTestCmd([]byte{scsi.FormatUnit, 0, 0, 0, 0, 0}, 0)
+	d := cmd.Device()
+	release := make(chan struct{})
+	resp, err := runTask(cmd, "format", scsi.SenseNotReady, scsi.AscFormatInProgress, true, func(ctx context.Context, progress func(uint16)) error {
+		<-release
+		return nil
+	})
+	checkGood(t, resp, err)
+
+	// Close waits for the IMMED work before closing the backend.
+	waited := make(chan struct{})
+	go func() {
+		d.background.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("background work not waited for")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	<-waited
+}
+
+func TestDeviceBackgroundFailure(t *testing.T) {
+	cmd, _ := newTestCmd([]byte{scsi.FormatUnit, 0, 0, 0, 0, 0}, 0)
+	d := cmd.Device()
+	d.ctx, d.cancelCtx = context.WithCancel(context.Background())
+	resp, err := runTask(cmd, "format", scsi.SenseNotReady, scsi.AscFormatInProgress, true, func(ctx context.Context, progress func(uint16)) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	checkGood(t, resp, err)
+
+	// The task sees the device close, and its failure is kept for later.
+	d.cancelCtx()
+	d.background.Wait()
+	cmd, _ = newTestCmd([]byte{scsi.TestUnitReady, 0, 0, 0, 0, 0}, 0)
+	cmd.device = d
+	resp, _ = EmulateTestUnitReady(cmd)
+	checkSense(t, resp, scsi.SenseMediumError, scsi.AscReadError)
+	if resp.senseBuffer[0]&0x7f != 0x71 {
+		t.Errorf("response code 0x%x, want deferred 0x71", resp.senseBuffer[0])
+	}
+	cmd, _ = newTestCmd([]byte{scsi.TestUnitReady, 0, 0, 0, 0, 0}, 0)
+	cmd.device = d
+	resp, err = EmulateTestUnitReady(cmd)
+	checkGood(t, resp, err)
+
+	// REQUEST SENSE reports it too, if it comes first.
+	d.setDeferredError(Sense{Key: scsi.SenseMediumError, Deferred: true})
+	cmd, buf := newTestCmd([]byte{scsi.RequestSense, 0, 0, 0, 18, 0}, 18)
+	cmd.device = d
+	resp, err = EmulateRequestSense(cmd)
+	checkGood(t, resp, err)
+	if buf[0] != 0x71 || buf[2] != scsi.SenseMediumError {
+		t.Errorf("deferred sense: got % x", buf[:14])
+	}
+	if _, ok := d.takeDeferredError(); ok {
+		t.Error("REQUEST SENSE didn't clear the deferred error")
+	}
+}
+
+func BenchmarkSCSICmdWrite(b *testing.B) {
+	for _, l := range benchLayouts {
+		b.Run(l.name, func(b *testing.B) {
+			cmd := newVecsCmd([]byte{scsi.Read10, 0, 0, 0, 0, 0, 0, 0, 0, 0}, l.length, l.vecLen)
+			data := make([]byte, l.length)
+			b.SetBytes(int64(l.length))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				cmd.vecoffset, cmd.offset = 0, 0
+				if _, err := cmd.Write(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSCSICmdRead(b *testing.B) {
+	for _, l := range benchLayouts {
+		b.Run(l.name, func(b *testing.B) {
+			cmd := newVecsCmd([]byte{scsi.Write10, 0, 0, 0, 0, 0, 0, 0, 0, 0}, l.length, l.vecLen)
+			data := make([]byte, l.length)
+			b.SetBytes(int64(l.length))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				cmd.vecoffset, cmd.offset = 0, 0
+				if _, err := cmd.Read(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package tcmu
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/go-tcmu/scsi"
+)
+
+// Stats holds cumulative command counters for a Device, as returned by
+// Device.Stats.
+type Stats struct {
+	// Commands is the number of commands received from the kernel.
+	Commands      uint64
+	ReadCommands  uint64
+	WriteCommands uint64
+	// BytesRead and BytesWritten count data moved by EmulateRead, EmulateWrite
+	// and EmulateCompareAndWrite.
+	BytesRead    uint64
+	BytesWritten uint64
+	// CheckConditions is the number of commands completed with CHECK CONDITION.
+	CheckConditions uint64
+	// InFlight is the number of commands received but not yet completed.
+	InFlight int64
+	// Completed is the number of commands completed, and TotalLatency the sum of
+	// the time each took from being read off the ring to being completed.
+	Completed    uint64
+	TotalLatency time.Duration
+	// ByCommand counts the commands received by opcode, keyed by
+	// scsi.OpcodeName. Opcodes not yet seen are left out.
+	ByCommand map[string]uint64
+}
+
+// deviceStats is updated atomically from the polling goroutines and handlers.
+// It must be the first field of Device to keep 64-bit alignment on 32-bit
+// platforms.
+type deviceStats struct {
+	commands        uint64
+	readCommands    uint64
+	writeCommands   uint64
+	bytesRead       uint64
+	bytesWritten    uint64
+	checkConditions uint64
+	completed       uint64
+	latency         int64
+	inFlight        int64
+	byOpcode        [256]uint64
+}
+
+// Stats returns a snapshot of the device's command counters.
+func (d *Device) Stats() Stats {
+	s := &d.stats
+	byCommand := make(map[string]uint64)
+	for op := range s.byOpcode {
+		if n := atomic.LoadUint64(&s.byOpcode[op]); n > 0 {
+			byCommand[scsi.OpcodeName(byte(op))] = n
+		}
+	}
+	return Stats{
+		Commands:        atomic.LoadUint64(&s.commands),
+		ReadCommands:    atomic.LoadUint64(&s.readCommands),
+		WriteCommands:   atomic.LoadUint64(&s.writeCommands),
+		BytesRead:       atomic.LoadUint64(&s.bytesRead),
+		BytesWritten:    atomic.LoadUint64(&s.bytesWritten),
+		CheckConditions: atomic.LoadUint64(&s.checkConditions),
+		InFlight:        atomic.LoadInt64(&s.inFlight),
+		Completed:       atomic.LoadUint64(&s.completed),
+		TotalLatency:    time.Duration(atomic.LoadInt64(&s.latency)),
+		ByCommand:       byCommand,
+	}
+}
+
+func (s *deviceStats) receive(cmd *SCSICmd) {
+	atomic.AddUint64(&s.commands, 1)
+	atomic.AddInt64(&s.inFlight, 1)
+	atomic.AddUint64(&s.byOpcode[cmd.Command()], 1)
+	switch cmd.Command() {
+	case scsi.Read6, scsi.Read10, scsi.Read12, scsi.Read16:
+		atomic.AddUint64(&s.readCommands, 1)
+	case scsi.Write6, scsi.Write10, scsi.Write12, scsi.Write16,
+		scsi.WriteVerify, scsi.WriteVerify12, scsi.WriteVerify16, scsi.CompareAndWrite:
+		atomic.AddUint64(&s.writeCommands, 1)
+	}
+}
+
+func (s *deviceStats) complete(resp SCSIResponse) {
+	atomic.AddInt64(&s.inFlight, -1)
+	atomic.AddUint64(&s.completed, 1)
+	if resp.status == scsi.SamStatCheckCondition {
+		atomic.AddUint64(&s.checkConditions, 1)
+	}
+	if !resp.start.IsZero() {
+		atomic.AddInt64(&s.latency, int64(time.Since(resp.start)))
+	}
+}
+
+func (s *deviceStats) read(n int) {
+	atomic.AddUint64(&s.bytesRead, uint64(n))
+}
+
+func (s *deviceStats) wrote(n int) {
+	atomic.AddUint64(&s.bytesWritten, uint64(n))
+}
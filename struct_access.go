@@ -41,6 +41,7 @@ func (d *Device) mbSetTail(u uint32) {
 enum tcmu_opcode {
   TCMU_OP_PAD = 0,
   TCMU_OP_CMD,
+  TCMU_OP_TMR,
 };
 */
 type tcmuOpcode int
@@ -48,6 +49,7 @@ type tcmuOpcode int
 const (
 	tcmuOpPad tcmuOpcode = 0
 	tcmuOpCmd            = 1
+	tcmuOpTmr            = 2
 )
 
 /*
@@ -58,6 +60,7 @@ struct tcmu_cmd_entry_hdr {
   __u16 cmd_id;
   __u8 kflags;
 #define TCMU_UFLAG_UNKNOWN_OP 0x1
+#define TCMU_UFLAG_READ_LEN   0x2
   __u8 uflags;
 
 } __packed;
@@ -88,7 +91,11 @@ func (d *Device) entUflags(off int) uint8 {
 }
 
 func (d *Device) setEntUflagUnknownOp(off int) {
-	d.mmap[off+offUFlags] = 0x01
+	d.mmap[off+offUFlags] |= 0x01
+}
+
+func (d *Device) setEntUflagReadLen(off int) {
+	d.mmap[off+offUFlags] |= 0x02
 }
 
 /*
@@ -112,7 +119,7 @@ struct tcmu_cmd_entry {
 				uint8_t scsi_status;
 				uint8_t __pad1;
 				uint16_t __pad2;
-				uint32_t __pad3;
+				uint32_t read_len;
 				char sense_buffer[TCMU_SENSE_BUFFERSIZE];
 
 			} rsp;
@@ -140,6 +147,10 @@ func (d *Device) setEntRespSCSIStatus(off int, status byte) {
 	d.mmap[off+offRespSCSIStatus] = status
 }
 
+func (d *Device) setEntRespReadLen(off int, n uint32) {
+	byteOrder.PutUint32(d.mmap[off+offRespReadLen:], n)
+}
+
 func (d *Device) copyEntRespSenseData(off int, data []byte) {
 	buf := d.mmap[off+offRespSense : off+offRespSense+tcmuSenseBufferSize]
 	copy(buf, data)
@@ -150,12 +161,47 @@ func (d *Device) copyEntRespSenseData(off int, data []byte) {
 	}
 }
 
-func (d *Device) entIovecN(off int, idx int) []byte {
+/*
+struct tcmu_tmr_entry {
+	struct tcmu_cmd_entry_hdr hdr;
+
+	__u8 tmr_type;
+	__u8 __pad1;
+	__u16 __pad2;
+	__u32 cmd_cnt;
+	__u64 __pad3;
+	__u64 __pad4;
+	__u16 cmd_ids[];
+} __packed;
+*/
+
+func (d *Device) entTmrType(off int) uint8 {
+	return d.mmap[off+offTmrType]
+}
+
+func (d *Device) entTmrCmdCnt(off int) uint32 {
+	return *(*uint32)(unsafe.Pointer(&d.mmap[off+offTmrCmdCnt]))
+}
+
+func (d *Device) entTmrCmdId(off int, idx int) uint16 {
+	return *(*uint16)(unsafe.Pointer(&d.mmap[off+offTmrCmdIds+2*idx]))
+}
+
+// entIovecN returns the data buffer described by the idx'th iovec of the entry
+// at off. The iovec and the buffer must both lie within the mapped region.
+func (d *Device) entIovecN(off int, idx int) ([]byte, error) {
 	out := syscall.Iovec{}
-	p := unsafe.Pointer(&d.mmap[off+offReqIov0Base])
-	out = *(*syscall.Iovec)(unsafe.Pointer(uintptr(p) + uintptr(idx)*unsafe.Sizeof(out)))
-	moff := *(*int)(unsafe.Pointer(&out.Base))
-	return d.mmap[moff : moff+int(out.Len)]
+	ioff := off + offReqIov0Base + idx*iovSize
+	if ioff < 0 || ioff+iovSize > off+d.entHdrGetLen(off) || ioff+iovSize > len(d.mmap) {
+		return nil, fmt.Errorf("iovec %d of entry at %d is outside the entry", idx, off)
+	}
+	out = *(*syscall.Iovec)(unsafe.Pointer(&d.mmap[ioff]))
+	moff := uint64(*(*uintptr)(unsafe.Pointer(&out.Base)))
+	mlen := uint64(out.Len)
+	if moff > uint64(len(d.mmap)) || mlen > uint64(len(d.mmap))-moff {
+		return nil, fmt.Errorf("iovec %d of entry at %d (%d+%d) is outside the %d byte mapping", idx, off, moff, mlen, len(d.mmap))
+	}
+	return d.mmap[moff : moff+mlen], nil
 }
 
 func (d *Device) entCdb(off int) []byte {
@@ -178,7 +224,11 @@ func (d *Device) cdbLen(cdbStart int) int {
 		return 16
 	} else if opcode >= 0xa0 && opcode <= 0xbf {
 		return 12
-	} else {
-		panic(fmt.Sprintf("what opcode is %x", opcode))
+	} else if opcode >= 0x60 && opcode <= 0x7e {
+		// Reserved; the kernel copies 12 bytes for these.
+		return 12
 	}
+	// Vendor specific; the kernel copies 10 bytes for these. The command is
+	// still passed to the handler, which can reject it.
+	return 10
 }
@@ -0,0 +1,47 @@
+// +build ignore
+
+/*
+ * Prints the offsets used by offsets*.go for the architecture it's built on:
+ *
+ *   cc -o /tmp/tcmu-offsets test.c && /tmp/tcmu-offsets
+ *
+ * Offsets are relative to the start of struct tcmu_cmd_entry, except those
+ * after entReqRespOff, which are relative to the req/rsp union.
+ */
+#include <stddef.h>
+#include <stdio.h>
+#include <linux/target_core_user.h>
+
+#define OFF(name, field) \
+	printf("%-18s = %zu\n", name, offsetof(struct tcmu_cmd_entry, field))
+#define REQ(name, field) \
+	printf("%-18s = entReqRespOff + %zu\n", name, \
+	       offsetof(struct tcmu_cmd_entry, field) - offsetof(struct tcmu_cmd_entry, req))
+#define TMR(name, field) \
+	printf("%-18s = entReqRespOff + %zu\n", name, \
+	       offsetof(struct tcmu_tmr_entry, field) - sizeof(struct tcmu_cmd_entry_hdr))
+
+int main(void)
+{
+	OFF("offLenOp", hdr.len_op);
+	OFF("offCmdId", hdr.cmd_id);
+	OFF("offKFlags", hdr.kflags);
+	OFF("offUFlags", hdr.uflags);
+	OFF("entReqRespOff", req);
+	REQ("offReqIovCnt", req.iov_cnt);
+	REQ("offReqIovBidiCnt", req.iov_bidi_cnt);
+	REQ("offReqIovDifCnt", req.iov_dif_cnt);
+	REQ("offReqCdbOff", req.cdb_off);
+	printf("\n%-18s = %zu\n", "iovSize", sizeof(struct iovec));
+	REQ("offReqIov0Base", req.iov[0].iov_base);
+	REQ("offReqIov0Len", req.iov[0].iov_len);
+	printf("\n");
+	REQ("offRespSCSIStatus", rsp.scsi_status);
+	REQ("offRespReadLen", rsp.read_len);
+	REQ("offRespSense", rsp.sense_buffer);
+	printf("\n");
+	TMR("offTmrType", tmr_type);
+	TMR("offTmrCmdCnt", cmd_cnt);
+	TMR("offTmrCmdIds", cmd_ids);
+	return 0;
+}
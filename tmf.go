@@ -0,0 +1,67 @@
+package tcmu
+
+import (
+	"fmt"
+
+	"github.com/prometheus/common/log"
+)
+
+// TMFHandler is an optional handler for the task management functions initiators
+// use to recover from errors, set as SCSIHandler.TMF. The kernel only notifies
+// userspace of them: it has already responded to the initiator, and the commands
+// involved must still be completed as usual, but their handlers can stop work on
+// them. Their contexts are canceled whether or not a TMFHandler is set; see
+// SCSICmd.Context. The methods are called from the goroutine taking commands off
+// the ring, so they shouldn't block for long.
+type TMFHandler interface {
+	// AbortTask is called for each command aborted, by id, as by ABORT TASK,
+	// ABORT TASK SET or a reset.
+	AbortTask(id uint16) error
+	// LunReset is called after the commands aborted by a LUN RESET, or a target
+	// reset.
+	LunReset() error
+}
+
+// Task management functions in a TCMU_OP_TMR entry's tmr_type.
+const (
+	tcmuTmrUnknown         = 0
+	tcmuTmrAbortTask       = 1
+	tcmuTmrAbortTaskSet    = 2
+	tcmuTmrClearACA        = 3
+	tcmuTmrClearTaskSet    = 4
+	tcmuTmrLunReset        = 5
+	tcmuTmrTargetWarmReset = 6
+	tcmuTmrTargetColdReset = 7
+	tcmuTmrLunResetPROut   = 128 // on a PERSISTENT RESERVE OUT preempting and aborting
+)
+
+// handleTMR processes the task management notification at off: the commands it
+// lists have their contexts canceled and are passed to the TMFHandler, and resets
+// are passed on too.
+func (d *Device) handleTMR(off int) error {
+	typ := d.entTmrType(off)
+	n := int(d.entTmrCmdCnt(off))
+	if n < 0 || offTmrCmdIds+2*n > d.entHdrGetLen(off) || off+offTmrCmdIds+2*n > len(d.mmap) {
+		return fmt.Errorf("task management entry lists %d commands, more than fit:\n%s", n, d.dumpEntry(off))
+	}
+	log.Debugf("task management function %d for %d commands", typ, n)
+	tmf := d.scsi.TMF
+	for i := 0; i < n; i++ {
+		id := d.entTmrCmdId(off, i)
+		d.cancelCommand(id)
+		if tmf != nil {
+			if err := tmf.AbortTask(id); err != nil {
+				log.Errorln("tmf/abort failed: error:", err)
+			}
+		}
+	}
+	switch typ {
+	case tcmuTmrLunReset, tcmuTmrLunResetPROut, tcmuTmrTargetWarmReset, tcmuTmrTargetColdReset:
+		if tmf != nil {
+			if err := tmf.LunReset(); err != nil {
+				log.Errorln("tmf/reset failed: error:", err)
+			}
+		}
+	}
+	return nil
+}